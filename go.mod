@@ -7,6 +7,7 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/kr/pretty v0.1.0 // indirect
+	github.com/pelletier/go-toml v1.9.5
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/pkg/errors v0.8.1
 	github.com/scribd/vault-authenticator v0.0.0-20191120154727-5c2ec43f4c6f
@@ -18,4 +19,5 @@ require (
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.2.5
+	gopkg.in/yaml.v3 v3.0.1
 )
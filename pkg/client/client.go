@@ -0,0 +1,270 @@
+/*
+Package client is the consumer side of keymaster.
+
+Given the Team, Role and Environment an application runs as, it logs into Vault through the Role's realm, reads the Role's own policy, and fetches every Secret the policy grants.  Paths are worked out by keymaster itself, so consumers can't drift from how keymaster writes them.
+
+	c := client.NewClient("team1", "app1", "production")
+	c.SetRealm(keymaster.K8S, "bravo")
+
+	err := c.Login()
+	...
+
+	secrets, err := c.Secrets()
+	...
+
+	fmt.Println(secrets["foo"].Value)
+
+Clients that don't know their Environment can work it out from their own address, given the environment catalog:
+
+	c := client.NewClient("team1", "app1", "")
+	c.SetEnvironments(environments)
+
+	err := c.DetectEnvironment()
+	...
+*/
+package client
+
+import (
+	"fmt"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"github.com/scribd/keymaster/pkg/keymaster"
+	"github.com/scribd/vault-authenticator/pkg/authenticator"
+	"net"
+	"strings"
+)
+
+const ERR_UNSUPPORTED_REALM = "unsupported realm for login"
+const ERR_MISSING_IDENTIFIER = "k8s login requires a cluster name"
+const ERR_NOT_LOGGED_IN = "not logged in to vault"
+const ERR_NO_POLICY = "no policy found for role"
+const ERR_DUPLICATE_SECRET_NAME = "role can read more than one secret with the same name"
+const ERR_NO_ENVIRONMENT_DETECTED = "none of this machine's addresses are in an environment"
+
+// Client Fetches the Secrets of a Role in an Environment.
+type Client struct {
+	Team             string
+	Role             string
+	Environment      string
+	Realm            string
+	Identifier       string // the cluster name for k8s logins
+	Address          string
+	CACertificate    string
+	TlsClientCrtPath string
+	TlsClientKeyPath string
+	Verbose          bool
+	VaultClient      *api.Client
+	KeyMaster        *keymaster.KeyMaster
+}
+
+// NewClient creates a Client for a Role in an Environment.
+func NewClient(team string, role string, env string) (client *Client) {
+	client = &Client{
+		Team:        team,
+		Role:        role,
+		Environment: env,
+		KeyMaster:   keymaster.NewKeyMaster(nil),
+	}
+
+	return client
+}
+
+// SetRealm sets the realm to login through.  The identifier is the cluster name for k8s, and ignored otherwise.
+func (c *Client) SetRealm(realm string, identifier string) {
+	c.Realm = realm
+	c.Identifier = identifier
+}
+
+func (c *Client) SetAddress(address string) {
+	c.Address = address
+}
+
+func (c *Client) SetCACertificate(certificate string) {
+	c.CACertificate = certificate
+}
+
+func (c *Client) SetTlsClientCert(crtPath string, keyPath string) {
+	c.TlsClientCrtPath = crtPath
+	c.TlsClientKeyPath = keyPath
+}
+
+func (c *Client) SetVerbose(verbose bool) {
+	c.Verbose = verbose
+}
+
+// SetVaultClient uses an already authenticated vault client, rather than logging in.
+func (c *Client) SetVaultClient(vaultClient *api.Client) {
+	c.VaultClient = vaultClient
+	c.KeyMaster.VaultClient = vaultClient
+}
+
+// SetSecretPathTemplate sets the secret path layout, for installations that don't use the default.  It has to match the layout keymaster writes with.
+func (c *Client) SetSecretPathTemplate(mountTemplate string, pathTemplate string) (err error) {
+	return c.KeyMaster.SetSecretPathTemplate(mountTemplate, pathTemplate)
+}
+
+// SetEnvironments sets the environment catalog, whose CIDRs DetectEnvironment() uses.
+func (c *Client) SetEnvironments(environments []*keymaster.Environment) {
+	c.KeyMaster.SetEnvironments(environments)
+}
+
+// DetectEnvironment sets the Client's Environment to the one this machine is in, going by the CIDRs of the environment catalog.
+func (c *Client) DetectEnvironment() (err error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to list network addresses")
+		return err
+	}
+
+	addresses := make([]string, 0)
+	for _, addr := range addrs {
+		network, ok := addr.(*net.IPNet)
+		if ok && !network.IP.IsLoopback() {
+			addresses = append(addresses, network.IP.String())
+		}
+	}
+
+	return c.detectEnvironment(addresses)
+}
+
+// detectEnvironment sets the Client's Environment to that of the first address that's in one.
+func (c *Client) detectEnvironment(addresses []string) (err error) {
+	for _, address := range addresses {
+		env, err := c.KeyMaster.EnvironmentForIp(address)
+		if err == nil {
+			verboseOutput(c.Verbose, "detected environment %s from %s", env.Name, address)
+			c.Environment = env.Name
+			return nil
+		}
+	}
+
+	err = errors.New(fmt.Sprintf("%s: %s", ERR_NO_ENVIRONMENT_DETECTED, strings.Join(addresses, ", ")))
+
+	return err
+}
+
+// AuthRoleName returns the name of the role to login as, which depends on the realm.
+func AuthRoleName(realm string, team string, role string, env string) (name string, err error) {
+	switch realm {
+	case keymaster.K8S, keymaster.IAM:
+		name = fmt.Sprintf("%s-%s", team, role)
+	case keymaster.TLS:
+		name = fmt.Sprintf("%s-%s-%s", team, role, env)
+	default:
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_UNSUPPORTED_REALM, realm))
+	}
+
+	return name, err
+}
+
+// Login logs into Vault through the Client's realm.  A token in the environment, or on the filesystem, is used instead if there is one.
+func (c *Client) Login() (err error) {
+	roleName, err := AuthRoleName(c.Realm, c.Team, c.Role, c.Environment)
+	if err != nil {
+		return err
+	}
+
+	if c.Realm == keymaster.K8S && c.Identifier == "" {
+		err = errors.New(ERR_MISSING_IDENTIFIER)
+		return err
+	}
+
+	a := authenticator.NewAuthenticator()
+	a.SetAddress(c.Address)
+	a.SetCACertificate(c.CACertificate)
+	a.SetVerbose(c.Verbose)
+	a.SetAuthMethods([]string{c.Realm})
+	a.SetRole(roleName)
+	a.SetIdentifier(c.Identifier)
+	a.SetTlsClientCrtPath(c.TlsClientCrtPath)
+	a.SetTlsClientKeyPath(c.TlsClientKeyPath)
+
+	vaultClient, err := a.Auth()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to login to vault as %s", roleName)
+		return err
+	}
+
+	c.SetVaultClient(vaultClient)
+
+	return err
+}
+
+// Secrets fetches every Secret the Role can read in its Environment, by name.
+func (c *Client) Secrets() (secrets map[string]*keymaster.SecretValue, err error) {
+	secrets = make(map[string]*keymaster.SecretValue)
+
+	if c.VaultClient == nil {
+		err = errors.New(ERR_NOT_LOGGED_IN)
+		return secrets, err
+	}
+
+	policyPath, err := c.KeyMaster.PolicyPath(c.Team, c.Role, c.Environment)
+	if err != nil {
+		return secrets, err
+	}
+
+	policy, err := c.KeyMaster.ReadPolicyFromVault(policyPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read policy %s", policyPath)
+		return secrets, err
+	}
+
+	paths, ok := policy.Payload["path"].(map[string]interface{})
+	if !ok {
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_NO_POLICY, policyPath))
+		return secrets, err
+	}
+
+	for path := range paths {
+		if strings.HasPrefix(path, "sys/") {
+			continue
+		}
+
+		elements, location, err := c.KeyMaster.ParseSecretPath(path)
+		if err != nil {
+			// metadata paths, and anything else that isn't a secret, are in the policy too
+			verboseOutput(c.Verbose, "skipping %s", path)
+			continue
+		}
+
+		if elements.Env != c.Environment {
+			verboseOutput(c.Verbose, "skipping %s, which is in env %s", path, elements.Env)
+			continue
+		}
+
+		verboseOutput(c.Verbose, "reading %s", path)
+
+		value, err := c.KeyMaster.ReadSecretValueAt(location, elements)
+		if err != nil {
+			return secrets, err
+		}
+
+		if value == nil {
+			verboseOutput(c.Verbose, "  nothing at %s", path)
+			continue
+		}
+
+		existing, ok := secrets[value.Name]
+		if ok {
+			err = errors.New(fmt.Sprintf("%s: %s/%s and %s/%s", ERR_DUPLICATE_SECRET_NAME, existing.Team, existing.Name, value.Team, value.Name))
+			return secrets, err
+		}
+
+		secrets[value.Name] = value
+	}
+
+	return secrets, err
+}
+
+func verboseOutput(verbose bool, message string, args ...interface{}) {
+	if verbose {
+		if len(args) == 0 {
+			fmt.Printf("%s\n", message)
+			return
+		}
+
+		msg := fmt.Sprintf(message, args...)
+		fmt.Printf("%s\n", msg)
+	}
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"fmt"
+	"github.com/hashicorp/vault/api"
+	"github.com/phayes/freeport"
+	"github.com/scribd/keymaster/pkg/keymaster"
+	"github.com/scribd/vaulttest/pkg/vaulttest"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testVault *vaulttest.VaultDevServer
+var rootClient *api.Client
+
+func TestMain(m *testing.M) {
+	setUp()
+
+	code := m.Run()
+
+	tearDown()
+
+	os.Exit(code)
+}
+
+func setUp() {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		log.Fatalf("Failed to get a free port on which to run the test vault server: %s", err)
+	}
+
+	testAddress := fmt.Sprintf("127.0.0.1:%d", port)
+
+	testVault = vaulttest.NewVaultDevServer(testAddress)
+
+	if !testVault.Running {
+		testVault.ServerStart()
+
+		rootClient = testVault.VaultTestClient()
+
+		for _, endpoint := range []string{
+			"team1",
+			"team2",
+		} {
+			data := map[string]interface{}{
+				"type":        "kv-v2",
+				"description": "Production Secrets",
+			}
+			_, err := rootClient.Logical().Write(fmt.Sprintf("sys/mounts/%s", endpoint), data)
+			if err != nil {
+				log.Fatalf("Unable to create secret engine %q: %s", endpoint, err)
+			}
+		}
+	}
+}
+
+func tearDown() {
+	testVault.ServerShutDown()
+}
+
+func TestAuthRoleName(t *testing.T) {
+	inputs := []struct {
+		realm string
+		out   string
+		err   string
+	}{
+		{keymaster.K8S, "team1-app1", ""},
+		{keymaster.IAM, "team1-app1", ""},
+		{keymaster.TLS, "team1-app1-production", ""},
+		{keymaster.EXTERNAL, "", ERR_UNSUPPORTED_REALM},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.realm, func(t *testing.T) {
+			name, err := AuthRoleName(tc.realm, "team1", "app1", "production")
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error creating role name: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.out, name, "role name meets expectations")
+		})
+	}
+
+	c := NewClient("team1", "app1", "production")
+	c.SetRealm(keymaster.K8S, "")
+	err := c.Login()
+	assert.True(t, err != nil && err.Error() == ERR_MISSING_IDENTIFIER, "k8s logins need a cluster")
+}
+
+func TestDetectEnvironment(t *testing.T) {
+	environments := []*keymaster.Environment{
+		{Name: "production", Tier: keymaster.TIER_PROD, Cidrs: []string{"10.0.0.0/16"}},
+		{Name: "staging", Tier: keymaster.TIER_NON_PROD, Cidrs: []string{"10.1.0.0/16"}},
+	}
+
+	inputs := []struct {
+		name      string
+		addresses []string
+		env       string
+	}{
+		{"production", []string{"10.0.3.4"}, "production"},
+		{"first-match", []string{"172.17.0.2", "10.1.3.4", "10.0.3.4"}, "staging"},
+		{"nowhere", []string{"172.17.0.2"}, ""},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewClient("team1", "app1", "")
+			c.SetEnvironments(environments)
+
+			err := c.detectEnvironment(tc.addresses)
+			if tc.env == "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_NO_ENVIRONMENT_DETECTED), "expected no environment, got %v", err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error detecting environment: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.env, c.Environment, "environment is detected")
+		})
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	km := keymaster.NewKeyMaster(rootClient)
+
+	team2Data := `---
+name: team2
+secrets:
+  - name: shared
+    generator:
+      type: uuid
+environments:
+  - production
+  - staging
+`
+
+	team1Data := `---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 10
+  - name: bar
+    generator:
+      type: static
+  - name: unread
+    generator:
+      type: hex
+      length: 12
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: foo
+      - name: bar
+      - name: shared
+        team: team2
+environments:
+  - production
+  - staging
+`
+
+	var role *keymaster.Role
+
+	for _, teamData := range []string{team2Data, team1Data} {
+		team, err := km.NewTeam([]byte(teamData), true)
+		if err != nil {
+			log.Printf("Error creating team: %s", err)
+			t.Fail()
+			return
+		}
+
+		for _, secret := range team.Secrets {
+			err = km.WriteSecretIfBlank(secret, true)
+			if err != nil {
+				log.Printf("Failed to write secret: %s", err)
+				t.Fail()
+				return
+			}
+		}
+
+		for _, r := range team.Roles {
+			role = r
+		}
+	}
+
+	policy, err := km.NewPolicy(role, "production")
+	if err != nil {
+		log.Printf("Error creating policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	err = km.WritePolicyToVault(policy, true)
+	if err != nil {
+		log.Printf("Error writing policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	// stands in for logging in through the realm, which gets a token with the role's policy
+	s, err := rootClient.Logical().Write("auth/token/create-orphan", map[string]interface{}{"policies": []string{policy.Name}})
+	if err != nil {
+		log.Printf("Failed to create token: %s", err)
+		t.Fail()
+		return
+	}
+
+	roleClient, err := rootClient.Clone()
+	if err != nil {
+		log.Printf("Failed to clone vault client: %s", err)
+		t.Fail()
+		return
+	}
+
+	roleClient.SetToken(s.Auth.ClientToken)
+
+	c := NewClient("team1", "app1", "production")
+
+	_, err = c.Secrets()
+	assert.True(t, err != nil && err.Error() == ERR_NOT_LOGGED_IN, "clients have to login first")
+
+	c.SetVaultClient(roleClient)
+	c.SetVerbose(true)
+
+	secrets, err := c.Secrets()
+	if err != nil {
+		log.Printf("Failed to fetch secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	names := make([]string, 0)
+	for name := range secrets {
+		names = append(names, name)
+	}
+
+	assert.ElementsMatch(t, []string{"foo", "bar", "shared"}, names, "fetched all the secrets of the role")
+
+	expected, err := km.ReadSecretValue("team1", "foo", "production")
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, expected.Value, secrets["foo"].Value, "fetched value of foo")
+	assert.Equal(t, "alpha", secrets["foo"].Type, "fetched type of foo")
+	assert.Equal(t, "static", secrets["bar"].Type, "fetched type of bar")
+	assert.Equal(t, "team2", secrets["shared"].Team, "fetched secret of another team")
+	assert.Equal(t, 36, len(secrets["shared"].Value), "fetched value of shared")
+
+	// the role has no policy in development
+	c = NewClient("team1", "app1", "development")
+	c.SetVaultClient(roleClient)
+
+	_, err = c.Secrets()
+	assert.True(t, err != nil, "roles without a policy fail")
+}
@@ -0,0 +1,429 @@
+/*
+	These functions load the settings of a keymaster installation from a yaml file, rather than having them compiled in.
+
+	version: 1
+	vault:
+	  address: https://vault.example.com:8200   # VAULT_ADDR overrides
+	secrets:
+	  mount_template: "{{.Team}}"
+	  path_template: "{{.Name}}/{{.Env}}"
+	  kv_versions:
+	    legacy-team1: 1
+	pki:
+	  mount: service                          # defaults for tls generators that don't say
+	  role: keymaster
+	  ttl: 8760h
+	tls_auth:
+	  ip_restrict: true
+	  ca_cert: |                              # KEYMASTER_TLS_AUTH_CA_CERT overrides
+	    -----BEGIN CERTIFICATE-----
+	    ...
+	  ca_certs:                               # per environment, instead of ca_cert
+	    production: |
+	      -----BEGIN CERTIFICATE-----
+	      ...
+	k8s_auth:
+	  ip_restrict: true
+	templates:                                # for roles of every team to extend.  See templates.go
+	  - name: k8s-service
+	    realms:
+	      - type: k8s
+	        identifiers:
+	          - alpha
+	        principals:
+	          - "{{.namespace}}"
+	        environment: production
+	environments:                             # the environment catalog.  See environment.go
+	  - name: production
+	    tier: prod
+	    cidrs:
+	      - 10.0.0.0/16
+	    aliases:
+	      - prod
+	clusters:
+	  - name: alpha
+	    apiserver: https://kubernetes-alpha:6443
+	    ca_cert: |
+	      ...
+	    environment: production
+	    bound_cidrs:
+	      - 10.0.0.0/16
+
+	Secrets, like the Vault token, are best left out of the file.  They can be given in the environment instead.
+
+*/
+package keymaster
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"text/template"
+	"time"
+)
+
+const CONFIG_VERSION = 1
+const ERR_CONFIG_LOAD = "failed to load keymaster config"
+const ERR_CONFIG_VERSION = "unsupported keymaster config version"
+const ERR_NAMELESS_CLUSTER = "nameless clusters are not supported"
+const ERR_DUPLICATE_CLUSTER = "cluster is defined more than once"
+const ERR_BAD_BOUND_CIDR = "bound cidrs must be ip addresses or cidr blocks"
+const ERR_BAD_CA_CERT = "ca certs must be pem encoded certificates"
+const ERR_BAD_KV_VERSION = "kv versions must be 1 or 2"
+const ERR_BAD_PKI_TTL = "pki ttl must be a duration"
+
+const DEFAULT_PKI_MOUNT = "service"
+const DEFAULT_PKI_ROLE = "keymaster"
+const DEFAULT_PKI_TTL = "8760h"
+
+// ConfigEnvOverrides The environment variables that override settings in the config file, and the settings they override.
+var ConfigEnvOverrides = map[string]string{
+	"VAULT_ADDR":                 "vault.address",
+	"VAULT_TOKEN":                "vault.token",
+	"KEYMASTER_TLS_AUTH_CA_CERT": "tls_auth.ca_cert",
+}
+
+// Config The settings of a keymaster installation.
+type Config struct {
+	Version      int             `yaml:"version"`
+	Vault        VaultConfig     `yaml:"vault"`
+	Secrets      SecretsConfig   `yaml:"secrets"`
+	Pki          PkiConfig       `yaml:"pki"`
+	TlsAuth      TlsAuthConfig   `yaml:"tls_auth"`
+	K8sAuth      K8sAuthConfig   `yaml:"k8s_auth"`
+	Environments []*Environment  `yaml:"environments"`
+	Templates    []*RoleTemplate `yaml:"templates"`
+	Clusters     []*Cluster      `yaml:"clusters"`
+}
+
+// VaultConfig How to reach Vault.
+type VaultConfig struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"` // better given as VAULT_TOKEN
+}
+
+// SecretsConfig Where Secrets are stored.
+type SecretsConfig struct {
+	MountTemplate string         `yaml:"mount_template"`
+	PathTemplate  string         `yaml:"path_template"`
+	KvVersions    map[string]int `yaml:"kv_versions"` // mounts whose version shouldn't be detected
+}
+
+// PkiConfig Defaults for TLS Secrets that don't set them in their generator.
+type PkiConfig struct {
+	Mount string `yaml:"mount"`
+	Role  string `yaml:"role"`
+	Ttl   string `yaml:"ttl"`
+}
+
+// TlsAuthConfig Settings for the TLS auth backend.
+type TlsAuthConfig struct {
+	IpRestrict bool              `yaml:"ip_restrict"`
+	CaCert     string            `yaml:"ca_cert"`  // used in Environments without their own
+	CaCerts    map[string]string `yaml:"ca_certs"` // by Environment
+}
+
+// K8sAuthConfig Settings for the k8s auth backends.
+type K8sAuthConfig struct {
+	IpRestrict bool `yaml:"ip_restrict"`
+}
+
+// LoadConfig reads a keymaster config file.
+func LoadConfig(file string) (config *Config, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		err = errors.Wrapf(err, "%s: %s", ERR_CONFIG_LOAD, file)
+		return config, err
+	}
+
+	return NewConfig(file, data)
+}
+
+// NewConfig parses a keymaster config, applies overrides from the environment, and validates it.  Err will be ConfigErrors if the config isn't valid.
+func NewConfig(file string, data []byte) (config *Config, err error) {
+	var root yaml.Node
+
+	err = yaml.Unmarshal(data, &root)
+	if err != nil {
+		return config, yamlConfigError(file, nil, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	config = &Config{}
+
+	err = decoder.Decode(config)
+	if err != nil && err != io.EOF {
+		return config, yamlConfigError(file, &root, err)
+	}
+
+	err = nil
+
+	config.applyEnvOverrides()
+
+	source := &configSource{File: file, Root: &root}
+	for i, tmpl := range config.Templates {
+		tmpl.source = source.child(fmt.Sprintf("templates[%d]", i))
+	}
+
+	problems := config.validate(source)
+	if len(problems) > 0 {
+		err = problems
+		return config, err
+	}
+
+	return config, err
+}
+
+// applyEnvOverrides replaces settings with the environment variables that override them, if they're set.
+func (c *Config) applyEnvOverrides() {
+	settings := map[string]*string{
+		"vault.address":    &c.Vault.Address,
+		"vault.token":      &c.Vault.Token,
+		"tls_auth.ca_cert": &c.TlsAuth.CaCert,
+	}
+
+	for name, setting := range ConfigEnvOverrides {
+		value, ok := os.LookupEnv(name)
+		if ok && value != "" {
+			*settings[setting] = value
+		}
+	}
+}
+
+// validate checks the settings make sense, returning every problem found.
+func (c *Config) validate(source *configSource) (problems ConfigErrors) {
+	if c.Version != CONFIG_VERSION {
+		problems = append(problems, source.errorAt("version", errors.New(fmt.Sprintf("%s: %d", ERR_CONFIG_VERSION, c.Version))))
+	}
+
+	_, err := template.New("path").Option("missingkey=error").Parse(c.Secrets.MountTemplate)
+	if err != nil {
+		problems = append(problems, source.errorAt("secrets.mount_template", errors.Wrap(err, ERR_BAD_SECRET_PATH_TEMPLATE)))
+	}
+
+	_, err = template.New("path").Option("missingkey=error").Parse(c.Secrets.PathTemplate)
+	if err != nil {
+		problems = append(problems, source.errorAt("secrets.path_template", errors.Wrap(err, ERR_BAD_SECRET_PATH_TEMPLATE)))
+	}
+
+	mounts := make([]string, 0)
+	for mount := range c.Secrets.KvVersions {
+		mounts = append(mounts, mount)
+	}
+
+	sort.Strings(mounts)
+
+	for _, mount := range mounts {
+		version := c.Secrets.KvVersions[mount]
+		if version != KV_V1 && version != KV_V2 {
+			problems = append(problems, source.errorAt(fmt.Sprintf("secrets.kv_versions.%s", mount), errors.New(fmt.Sprintf("%s: %s", ERR_BAD_KV_VERSION, mount))))
+		}
+	}
+
+	if c.Pki.Ttl != "" {
+		_, err = time.ParseDuration(c.Pki.Ttl)
+		if err != nil {
+			problems = append(problems, source.errorAt("pki.ttl", errors.New(fmt.Sprintf("%s: %s", ERR_BAD_PKI_TTL, c.Pki.Ttl))))
+		}
+	}
+
+	if c.TlsAuth.CaCert != "" && !isPemCertificate(c.TlsAuth.CaCert) {
+		problems = append(problems, source.errorAt("tls_auth.ca_cert", errors.New(ERR_BAD_CA_CERT)))
+	}
+
+	problems = append(problems, validateEnvironments(c.Environments, source)...)
+	problems = append(problems, validateTemplates(c.Templates)...)
+
+	for _, env := range sortedKeys(c.TlsAuth.CaCerts) {
+		if !isPemCertificate(c.TlsAuth.CaCerts[env]) {
+			problems = append(problems, source.errorAt(fmt.Sprintf("tls_auth.ca_certs.%s", env), errors.New(fmt.Sprintf("%s: %s", ERR_BAD_CA_CERT, env))))
+		}
+
+		if !c.knownEnvironment(env) {
+			problems = append(problems, source.errorAt(fmt.Sprintf("tls_auth.ca_certs.%s", env), errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_ENVIRONMENT, env))))
+		}
+	}
+
+	names := make([]string, 0)
+
+	for i, cluster := range c.Clusters {
+		clusterSource := source.child(fmt.Sprintf("clusters[%d]", i))
+
+		if cluster.Name == "" {
+			problems = append(problems, clusterSource.errorAt("name", errors.New(ERR_NAMELESS_CLUSTER)))
+		} else if stringInSlice(cluster.Name, names) {
+			problems = append(problems, clusterSource.errorAt("name", errors.New(fmt.Sprintf("%s: %s", ERR_DUPLICATE_CLUSTER, cluster.Name))))
+		}
+
+		names = append(names, cluster.Name)
+
+		for j, cidr := range cluster.BoundCidrs {
+			_, _, err := net.ParseCIDR(cidr)
+			if err != nil && net.ParseIP(cidr) == nil {
+				problems = append(problems, clusterSource.errorAt(fmt.Sprintf("bound_cidrs[%d]", j), errors.New(fmt.Sprintf("%s: %s", ERR_BAD_BOUND_CIDR, cidr))))
+			}
+		}
+
+		if cluster.CACert != "" && !isPemCertificate(cluster.CACert) {
+			problems = append(problems, clusterSource.errorAt("ca_cert", errors.New(fmt.Sprintf("%s: %s", ERR_BAD_CA_CERT, cluster.Name))))
+		}
+
+		if cluster.EnvName != "" && !c.knownEnvironment(cluster.EnvName) {
+			problems = append(problems, clusterSource.errorAt("environment", errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_ENVIRONMENT, cluster.EnvName))))
+		}
+	}
+
+	return problems
+}
+
+// knownEnvironment returns true if the name or alias is in the environment catalog, or if there's no catalog to check it against.
+func (c *Config) knownEnvironment(name string) bool {
+	if len(c.Environments) == 0 {
+		return true
+	}
+
+	for _, env := range c.Environments {
+		if env.Name == name || stringInSlice(name, env.Aliases) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VaultClient makes a Vault client from the config.  Vault's own environment variables are honored for anything the config doesn't set.
+func (c *Config) VaultClient() (client *api.Client, err error) {
+	apiConfig := api.DefaultConfig()
+	if c.Vault.Address != "" {
+		apiConfig.Address = c.Vault.Address
+	}
+
+	client, err = api.NewClient(apiConfig)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create vault client")
+		return client, err
+	}
+
+	if c.Vault.Token != "" {
+		client.SetToken(c.Vault.Token)
+	}
+
+	return client, err
+}
+
+// NewKeyMasterFromConfig creates a KeyMaster with a Vault client and settings from the config.
+func NewKeyMasterFromConfig(config *Config) (km *KeyMaster, err error) {
+	client, err := config.VaultClient()
+	if err != nil {
+		return km, err
+	}
+
+	km = NewKeyMaster(client)
+
+	err = km.ApplyConfig(config)
+
+	return km, err
+}
+
+// ApplyConfig sets up the KeyMaster with the settings of a config.
+func (km *KeyMaster) ApplyConfig(config *Config) (err error) {
+	err = km.SetSecretPathTemplate(config.Secrets.MountTemplate, config.Secrets.PathTemplate)
+	if err != nil {
+		return err
+	}
+
+	for mount, version := range config.Secrets.KvVersions {
+		km.SetKvVersion(mount, version)
+	}
+
+	km.SetPkiDefaults(config.Pki.Mount, config.Pki.Role, config.Pki.Ttl)
+
+	// without a catalog, teams can name their environments as they like
+	if len(config.Environments) > 0 {
+		km.SetEnvironments(config.Environments)
+	}
+
+	km.SetIpRestrictTlsAuth(config.TlsAuth.IpRestrict)
+	km.SetTlsAuthCaCert(config.TlsAuth.CaCert)
+
+	for env, cert := range config.TlsAuth.CaCerts {
+		km.SetTlsAuthCaCertForEnv(km.EnvironmentName(env), cert)
+	}
+
+	km.SetIpRestrictK8sAuth(config.K8sAuth.IpRestrict)
+
+	km.SetRoleTemplates(config.Templates)
+
+	for _, cluster := range config.Clusters {
+		cluster.Environment = km.EnvironmentName(cluster.EnvName)
+	}
+
+	km.SetK8sClusters(config.Clusters)
+
+	return err
+}
+
+// SetTlsAuthCaCertForEnv sets the CA certificate TLS auth trusts in one Environment.
+func (km *KeyMaster) SetTlsAuthCaCertForEnv(env string, certificate string) {
+	if km.TlsAuthCaCerts == nil {
+		km.TlsAuthCaCerts = make(map[string]string)
+	}
+
+	km.TlsAuthCaCerts[env] = certificate
+}
+
+// TlsAuthCaCertFor returns the CA certificate TLS auth trusts in an Environment.
+func (km *KeyMaster) TlsAuthCaCertFor(env string) (certificate string) {
+	certificate, ok := km.TlsAuthCaCerts[env]
+	if ok {
+		return certificate
+	}
+
+	return km.TlsAuthCaCert
+}
+
+// SetPkiDefaults sets the PKI mount, role, and ttl that TLS Secrets use unless their generator says otherwise.  Empty values revert to the defaults.
+func (km *KeyMaster) SetPkiDefaults(mount string, role string, ttl string) {
+	km.PkiMount = mount
+	km.PkiRole = role
+	km.PkiTtl = ttl
+}
+
+// tlsGeneratorOptions fills in the PKI defaults for the options of a tls generator.  The options given aren't changed.
+func (km *KeyMaster) tlsGeneratorOptions(options GeneratorData) (filled GeneratorData) {
+	filled = make(GeneratorData)
+	for k, v := range options {
+		filled[k] = v
+	}
+
+	defaults := map[string]string{
+		"ca":   km.PkiMount,
+		"role": km.PkiRole,
+		"ttl":  km.PkiTtl,
+	}
+
+	for option, value := range defaults {
+		_, ok := filled[option]
+		if !ok && value != "" {
+			filled[option] = value
+		}
+	}
+
+	return filled
+}
+
+func isPemCertificate(data string) bool {
+	block, _ := pem.Decode([]byte(data))
+
+	return block != nil && block.Type == "CERTIFICATE"
+}
@@ -0,0 +1,423 @@
+/*
+	These functions say where in a Team's yaml each problem is.
+
+	Teams are decoded with their yaml nodes kept alongside, so every Secret, Role and Realm knows the file it came from, and where in that file it is.  Problems are reported as ConfigErrors carrying the file, the line and column, and the path of the field, e.g.
+
+		missing secret in role (team1.yml:42:17 roles[2].secrets[0].name)
+
+	Loading a Team collects every problem, rather than stopping at the first, so a Team with many mistakes can be fixed in one go.
+
+	Decoding is strict.  A field keymaster doesn't know, like 'principal' for 'principals', is an error rather than being quietly dropped.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var fieldPathPattern = regexp.MustCompile(`([^.\[\]]+)|\[(\d+)\]`)
+var yamlErrorLinePattern = regexp.MustCompile(`line (\d+): `)
+var unknownFieldPattern = regexp.MustCompile(`^field (\S+) not found in type`)
+
+const ERR_UNKNOWN_FIELD = "unknown field in config"
+const ERR_MULTIPLE_TEAMS = "config holds more than one team.  Load it as an org"
+
+// ConfigError A problem with a Team's config, and where it is.
+type ConfigError struct {
+	File   string // empty if the config didn't come from a file
+	Line   int    // 0 if unknown
+	Column int
+	Field  string // e.g. roles[2].realms[0].environment
+	Err    error
+	Via    *ConfigError // where the template the problem is in was used, if it's in one.  Err is nil.
+}
+
+func (e *ConfigError) Error() string {
+	location := e.location()
+	if location == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%s (%s)", e.Err, location)
+}
+
+// location describes where the problem is, followed by where the templates it's in were used.
+func (e *ConfigError) location() string {
+	location := make([]string, 0)
+
+	if e.File != "" && e.Line > 0 {
+		location = append(location, fmt.Sprintf("%s:%d:%d", e.File, e.Line, e.Column))
+	} else if e.File != "" {
+		location = append(location, e.File)
+	} else if e.Line > 0 {
+		location = append(location, fmt.Sprintf("line %d column %d", e.Line, e.Column))
+	}
+
+	if e.Field != "" {
+		location = append(location, e.Field)
+	}
+
+	where := strings.Join(location, " ")
+
+	if e.Via != nil {
+		via := fmt.Sprintf("via %s", e.Via.location())
+		if where == "" {
+			return via
+		}
+
+		where = fmt.Sprintf("%s, %s", where, via)
+	}
+
+	return where
+}
+
+// Cause lets errors.Cause() find the underlying error.
+func (e *ConfigError) Cause() error {
+	return e.Err
+}
+
+// ConfigErrors Every problem found with a Team's config.  A single problem reads just like the problem itself.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	lines := make([]string, 0)
+	for _, problem := range e {
+		lines = append(lines, fmt.Sprintf("  %s", problem))
+	}
+
+	return fmt.Sprintf("%d config errors:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// configSource Where in the yaml a Secret, Role, or Realm was defined.
+type configSource struct {
+	File  string
+	Root  *yaml.Node
+	Field string
+	Via   *configSource // where the template it was defined in was used, for expanded content
+}
+
+// errorAt makes a ConfigError for a field below the source, e.g. 'generator'.  A nil source gives an error without a location.
+func (s *configSource) errorAt(field string, err error) (configErr *ConfigError) {
+	if s == nil {
+		return &ConfigError{Field: field, Err: err}
+	}
+
+	path := s.Field
+	if field != "" {
+		if path != "" && !strings.HasPrefix(field, "[") {
+			path += "."
+		}
+
+		path += field
+	}
+
+	line, column := locateField(s.Root, path)
+
+	configErr = &ConfigError{
+		File:   s.File,
+		Line:   line,
+		Column: column,
+		Field:  path,
+		Err:    err,
+	}
+
+	if s.Via != nil {
+		configErr.Via = s.Via.errorAt("", nil)
+	}
+
+	return configErr
+}
+
+// child returns the source of something defined below this one, e.g. 'realms[0]'.
+func (s *configSource) child(field string) (child *configSource) {
+	if s == nil {
+		return child
+	}
+
+	separator := "."
+	if s.Field == "" || strings.HasPrefix(field, "[") {
+		separator = ""
+	}
+
+	child = &configSource{
+		File:  s.File,
+		Root:  s.Root,
+		Field: s.Field + separator + field,
+		Via:   s.Via,
+	}
+
+	return child
+}
+
+// via returns a copy of the source, for content of a template expanded where the template was used.  A template without a source still says where it was used.
+func (s *configSource) via(use *configSource) (expanded *configSource) {
+	if s == nil {
+		return &configSource{Via: use}
+	}
+
+	expanded = &configSource{
+		File:  s.File,
+		Root:  s.Root,
+		Field: s.Field,
+		Via:   use,
+	}
+
+	return expanded
+}
+
+// locateField finds the line and column of a field path in a yaml document.  If the field isn't there, the position of the closest enclosing field is given instead.
+func locateField(root *yaml.Node, path string) (line int, column int) {
+	if root == nil {
+		return line, column
+	}
+
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line, column = node.Line, node.Column
+
+	for _, match := range fieldPathPattern.FindAllStringSubmatch(path, -1) {
+		var next *yaml.Node
+
+		if match[1] != "" && node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == match[1] {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		}
+
+		if match[2] != "" && node.Kind == yaml.SequenceNode {
+			index, _ := strconv.Atoi(match[2])
+			if index < len(node.Content) {
+				next = node.Content[index]
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node = next
+		line, column = node.Line, node.Column
+	}
+
+	return line, column
+}
+
+// decodeTeam decodes a Team from a file, recording where each of its parts came from.  Fields that aren't part of a Team are errors.  Manifests of the same Team are merged.  Team will be nil if there are no documents.
+func decodeTeam(file string, data []byte) (team *Team, err error) {
+	return decodeTeamAs(file, data, fileFormat(file))
+}
+
+// decodeTeamAs is decodeTeam(), for data in the given format.
+func decodeTeamAs(file string, data []byte, format string) (team *Team, err error) {
+	teams, err := decodeTeamsAs(file, data, format)
+	if err != nil || len(teams) == 0 {
+		return team, err
+	}
+
+	if len(teams) == 1 {
+		return teams[0], err
+	}
+
+	merger := newTeamMerger()
+	for _, t := range teams {
+		merger.add(t, file, false)
+	}
+
+	if len(merger.problems) > 0 {
+		return team, merger.problems
+	}
+
+	if len(merger.teams) > 1 {
+		names := make([]string, 0)
+		for _, t := range merger.teams {
+			names = append(names, t.Name)
+		}
+
+		err = ConfigErrors{&ConfigError{File: file, Err: errors.New(fmt.Sprintf("%s: %s", ERR_MULTIPLE_TEAMS, strings.Join(names, ", ")))}}
+		return team, err
+	}
+
+	return merger.teams[0], err
+}
+
+// decodeTeams decodes every document in a file, whether plain Teams or manifests (see manifest.go).  Each document gives a Team, which for manifests of Secrets and Roles holds just them.  Empty documents are skipped.
+func decodeTeams(file string, data []byte) (teams []*Team, err error) {
+	return decodeTeamsAs(file, data, fileFormat(file))
+}
+
+// decodeTeamsAs is decodeTeams(), for data in the given format (see formats.go).
+func decodeTeamsAs(file string, data []byte, format string) (teams []*Team, err error) {
+	teams = make([]*Team, 0)
+
+	documents, strict, err := readDocuments(file, data, format)
+	if err != nil {
+		return teams, err
+	}
+
+	problems := make(ConfigErrors, 0)
+
+	for _, root := range documents {
+		source := &configSource{File: file, Root: root}
+
+		if isManifest(root) {
+			team, manifestProblems := decodeManifest(strict, source)
+			problems = append(problems, manifestProblems...)
+
+			if team != nil {
+				teams = append(teams, team)
+			}
+
+			continue
+		}
+
+		var team *Team
+
+		err = strict.Decode(&team)
+		if err != nil {
+			problems = append(problems, yamlConfigError(file, root, err)...)
+			continue
+		}
+
+		if team == nil {
+			continue
+		}
+
+		team.setSources(source)
+		teams = append(teams, team)
+	}
+
+	if len(problems) > 0 {
+		err = problems
+		return teams, err
+	}
+
+	return teams, nil
+}
+
+// setSources records where the Team, and each of its parts, came from.
+func (t *Team) setSources(source *configSource) {
+	t.source = source
+
+	for i, secret := range t.Secrets {
+		secret.source = source.child(fmt.Sprintf("secrets[%d]", i))
+	}
+
+	for i, tmpl := range t.Templates {
+		tmpl.source = source.child(fmt.Sprintf("templates[%d]", i))
+	}
+
+	for i, role := range t.Roles {
+		role.setSources(source.child(fmt.Sprintf("roles[%d]", i)))
+	}
+}
+
+// setSources records where the Role, and each of its parts, came from.
+func (r *Role) setSources(source *configSource) {
+	r.source = source
+
+	for i, realm := range r.Realms {
+		realm.source = source.child(fmt.Sprintf("realms[%d]", i))
+	}
+
+	for i, secret := range r.Secrets {
+		secret.source = source.child(fmt.Sprintf("secrets[%d]", i))
+	}
+}
+
+// yamlConfigError turns the errors of the yaml decoder into ConfigErrors, with the line numbers they mention.  Given the document, unknown fields are reported with their field path.
+func yamlConfigError(file string, root *yaml.Node, err error) (configErrs ConfigErrors) {
+	messages := []string{err.Error()}
+
+	typeErr, ok := err.(*yaml.TypeError)
+	if ok {
+		messages = typeErr.Errors
+	}
+
+	for _, message := range messages {
+		configErr := &ConfigError{File: file}
+
+		match := yamlErrorLinePattern.FindStringSubmatch(message)
+		if match != nil {
+			configErr.Line, _ = strconv.Atoi(match[1])
+			message = strings.Replace(message, match[0], "", 1)
+		}
+
+		message = strings.TrimPrefix(message, "yaml: ")
+
+		unknown := unknownFieldPattern.FindStringSubmatch(message)
+		if unknown != nil {
+			configErr.Field, configErr.Column = locateKey(root, configErr.Line, unknown[1])
+			configErr.Err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_FIELD, unknown[1]))
+			configErrs = append(configErrs, configErr)
+			continue
+		}
+
+		configErr.Err = errors.Wrap(errors.New(message), ERR_TEAM_DATA_LOAD)
+
+		configErrs = append(configErrs, configErr)
+	}
+
+	return configErrs
+}
+
+// locateKey finds the field path and column of a key on a line of a yaml document.
+func locateKey(node *yaml.Node, line int, key string) (path string, column int) {
+	if node == nil {
+		return path, column
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			path, column = locateKey(child, line, key)
+			if path != "" {
+				return path, column
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i]
+			if name.Line == line && name.Value == key {
+				return name.Value, name.Column
+			}
+
+			below, column := locateKey(node.Content[i+1], line, key)
+			if below != "" {
+				if strings.HasPrefix(below, "[") {
+					return name.Value + below, column
+				}
+
+				return name.Value + "." + below, column
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			below, column := locateKey(child, line, key)
+			if below != "" {
+				if strings.HasPrefix(below, "[") {
+					return fmt.Sprintf("[%d]%s", i, below), column
+				}
+
+				return fmt.Sprintf("[%d].%s", i, below), column
+			}
+		}
+	}
+
+	return path, column
+}
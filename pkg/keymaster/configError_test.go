@@ -0,0 +1,202 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var configErrorsTeam = `---
+name: mistakes
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+  - name: bar
+  - name: baz
+    environments:
+      - prod
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: gcp
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+      - name: fooo
+  - name: app2
+    secrets:
+      - name: foo
+environments:
+  - production
+`
+
+func TestConfigErrors(t *testing.T) {
+	inputs := []struct {
+		name   string
+		in     string
+		errs   []string
+		fields []string
+		lines  []int
+	}{
+		{
+			"every-problem",
+			configErrorsTeam,
+			[]string{ERR_MISSING_GENERATOR, ERR_SECRET_ENVIRONMENT_NOT_IN_TEAM, ERR_UNSUPPORTED_REALM, ERR_MISSING_SECRET, ERR_REALMLESS_ROLE},
+			[]string{"secrets[1].generator", "secrets[2].environments[0]", "roles[0].realms[1].type", "roles[0].secrets[1].name", "roles[1].realms"},
+			[]int{8, 11, 23, 31, 32},
+		},
+		{
+			"bad-yaml",
+			"---\nname: broken\nsecrets:\n  - name: foo\n   generator: {\n",
+			[]string{ERR_TEAM_DATA_LOAD},
+			[]string{""},
+			[]int{3},
+		},
+		{
+			"wrong-types",
+			"---\nname: broken\nsecrets:\n  - name: foo\n    environments: production\n",
+			[]string{ERR_TEAM_DATA_LOAD},
+			[]string{""},
+			[]int{5},
+		},
+		{
+			"unknown-fields",
+			strings.Replace(strings.Replace(configErrorsTeam, "principals:\n          - app1\n        environment: production\n      - type: gcp", "principal:\n          - app1\n        environment: production\n      - type: gcp", 1), "  - name: bar\n", "  - name: bar\n    descripton: oops\n", 1),
+			[]string{ERR_UNKNOWN_FIELD + ": descripton", ERR_UNKNOWN_FIELD + ": principal"},
+			[]string{"secrets[1].descripton", "roles[0].realms[0].principal"},
+			[]int{9, 21},
+		},
+		{
+			"unknown-generator-option",
+			"---\nname: typos\nsecrets:\n  - name: foo\n    generator:\n      type: alpha\n      length: 8\n      lenght: 8\nenvironments:\n  - production\n",
+			[]string{ERR_UNKNOWN_GENERATOR_OPTION + ": lenght"},
+			[]string{"secrets[0].generator.lenght"},
+			[]int{8},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeAndPrepare(fmt.Sprintf("%s.yml", tc.name), []byte(tc.in))
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, fmt.Sprintf("%s.yml", tc.name), configErr.File, "error names the file")
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the field")
+				assert.Equal(t, tc.lines[i], configErr.Line, "error gives the line of %s", tc.fields[i])
+			}
+		})
+	}
+}
+
+func decodeAndPrepare(file string, data []byte) (team *Team, err error) {
+	team, err = decodeTeam(file, data)
+	if err != nil {
+		return team, err
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	err = km.PrepareTeam(team, false)
+
+	return team, err
+}
+
+func TestConfigErrorLocation(t *testing.T) {
+	team, err := decodeTeam("team.yml", []byte(configErrorsTeam))
+	if err != nil {
+		log.Printf("Error decoding team: %s", err)
+		t.Fail()
+		return
+	}
+
+	configErr := team.Roles[0].Realms[0].source.errorAt("environment", fmt.Errorf("oops"))
+	assert.Equal(t, "oops (team.yml:22:22 roles[0].realms[0].environment)", configErr.Error(), "errors read with their location")
+
+	configErr = team.Roles[1].source.errorAt("realms", fmt.Errorf("oops"))
+	assert.Equal(t, "oops (team.yml:32:5 roles[1].realms)", configErr.Error(), "missing fields are located at what encloses them")
+
+	var source *configSource
+	configErr = source.errorAt("name", fmt.Errorf("oops"))
+	assert.Equal(t, "oops (name)", configErr.Error(), "errors without a source still name the field")
+}
+
+func TestLoadOrgCollectsEveryError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"a-mistakes.yml": configErrorsTeam,
+		"b-broken.yml":   "---\nname: broken\nsecrets:\n  - name: foo\n   generator: {\n",
+		"c-owner.yml":    orgOwnerTeam,
+	} {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Printf("Failed writing %s: %s", name, err)
+			t.Fail()
+			return
+		}
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	_, err = km.LoadOrg([]string{dir}, false)
+
+	orgErr, ok := err.(*OrgError)
+	if !ok {
+		log.Printf("Expected an org error, got %v", err)
+		t.Fail()
+		return
+	}
+
+	files := make(map[string]int)
+	for _, problem := range orgErr.Problems {
+		configErr, ok := problem.(*ConfigError)
+		if !ok {
+			log.Printf("Expected a config error, got %v", problem)
+			t.Fail()
+			continue
+		}
+
+		files[strings.TrimPrefix(configErr.File, dir+"/")]++
+	}
+
+	assert.Equal(t, map[string]int{"a-mistakes.yml": 5, "b-broken.yml": 1}, files, "every problem of every team is reported")
+}
@@ -0,0 +1,247 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// a second certificate, distinct from testPemBlock
+var otherPemBlock = strings.Replace(testPemBlock, "MIIB", "MIIC", 1)
+
+func testConfig(extra string) string {
+	indented := strings.Replace(testPemBlock, "\n", "\n      ", -1)
+
+	return fmt.Sprintf(`---
+version: 1
+vault:
+  address: https://vault.example.com:8200
+secrets:
+  mount_template: "secrets"
+  path_template: "{{.Team}}/{{.Name}}/{{.Env}}"
+  kv_versions:
+    legacy: 1
+pki:
+  mount: internal-pki
+  role: issuer
+  ttl: 720h
+tls_auth:
+  ip_restrict: true
+  ca_cert: |
+    %s
+  ca_certs:
+    production: |
+      %s
+k8s_auth:
+  ip_restrict: true
+clusters:
+  - name: alpha
+    apiserver: https://kubernetes-alpha:6443
+    environment: production
+    bound_cidrs:
+      - 10.0.0.0/16
+      - 1.2.3.4
+  - name: bravo
+    apiserver: https://kubernetes-bravo:6443
+    environment: staging
+%s`, strings.Replace(otherPemBlock, "\n", "\n    ", -1), indented, extra)
+}
+
+func TestNewConfig(t *testing.T) {
+	inputs := []struct {
+		name   string
+		in     string
+		errs   []string
+		fields []string
+	}{
+		{
+			"good",
+			testConfig(""),
+			nil,
+			nil,
+		},
+		{
+			"bad-version",
+			strings.Replace(testConfig(""), "version: 1", "version: 2", 1),
+			[]string{ERR_CONFIG_VERSION},
+			[]string{"version"},
+		},
+		{
+			"unknown-field",
+			strings.Replace(testConfig(""), "ip_restrict: true\nclusters", "ip_restrcit: true\nclusters", 1),
+			[]string{ERR_UNKNOWN_FIELD + ": ip_restrcit"},
+			[]string{"k8s_auth.ip_restrcit"},
+		},
+		{
+			"bad-settings",
+			strings.Replace(strings.Replace(strings.Replace(testConfig(`  - name: alpha
+    bound_cidrs:
+      - 10.0.0.0/33
+  - apiserver: https://kubernetes-charlie:6443
+`), "legacy: 1", "legacy: 3", 1), "ttl: 720h", "ttl: a month", 1), `path_template: "{{.Team}}`, `path_template: "{{.Team`, 1),
+			[]string{ERR_BAD_SECRET_PATH_TEMPLATE, ERR_BAD_KV_VERSION, ERR_BAD_PKI_TTL, ERR_DUPLICATE_CLUSTER, ERR_BAD_BOUND_CIDR, ERR_NAMELESS_CLUSTER},
+			[]string{"secrets.path_template", "secrets.kv_versions.legacy", "pki.ttl", "clusters[2].name", "clusters[2].bound_cidrs[0]", "clusters[3].name"},
+		},
+		{
+			"bad-ca-cert",
+			strings.Replace(testConfig(""), "production: |\n      -----BEGIN CERTIFICATE-----", "production: |\n      -----BEGIN PUBLIC KEY-----", 1),
+			[]string{ERR_BAD_CA_CERT},
+			[]string{"tls_auth.ca_certs.production"},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewConfig("keymaster.yml", []byte(tc.in))
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error loading config: %s", err)
+					t.Fail()
+				}
+
+				return
+			}
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the setting")
+				assert.True(t, configErr.Line > 0, "error gives the line")
+			}
+		})
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	file := fmt.Sprintf("%s/keymaster.yml", dir)
+
+	err = ioutil.WriteFile(file, []byte(testConfig("")), 0644)
+	if err != nil {
+		log.Printf("Failed writing %s: %s", file, err)
+		t.Fail()
+		return
+	}
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		log.Printf("Error loading config: %s", err)
+		t.Fail()
+		return
+	}
+
+	km, err := NewKeyMasterFromConfig(config)
+	if err != nil {
+		log.Printf("Error creating keymaster: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "https://vault.example.com:8200", km.VaultClient.Address(), "vault address is set")
+
+	location, err := km.SecretLocation("team1", "foo", "production")
+	if err != nil {
+		log.Printf("Error getting secret location: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "secrets", location.Mount, "mount template is set")
+	assert.Equal(t, "team1/foo/production", location.Path, "path template is set")
+
+	version, err := km.KvVersion("legacy")
+	if err != nil {
+		log.Printf("Error getting kv version: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, KV_V1, version, "kv versions are set")
+
+	assert.True(t, km.IpRestrictTlsAuth, "tls auth ip restriction is set")
+	assert.True(t, km.IpRestrictK8sAuth, "k8s auth ip restriction is set")
+	assert.Equal(t, testPemBlock+"\n", km.TlsAuthCaCertFor("production"), "production has its own ca cert")
+	assert.Equal(t, otherPemBlock+"\n", km.TlsAuthCaCertFor("staging"), "other environments use the default ca cert")
+
+	cluster, ok := km.K8sClustersByName["alpha"]
+	assert.True(t, ok, "clusters are set")
+	if ok {
+		assert.Equal(t, []string{"10.0.0.0/16", "1.2.3.4"}, cluster.BoundCidrs, "clusters have their bound cidrs")
+		assert.Equal(t, "production", cluster.Environment, "clusters have their environment")
+	}
+
+	generator, err := km.NewGenerator(GeneratorData{"type": "tls", "cn": "foo.scribd.com"})
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	tlsGenerator := generator.(TLSGenerator)
+	assert.Equal(t, "internal-pki", tlsGenerator.CA, "tls generators default to the configured pki mount")
+	assert.Equal(t, "issuer", tlsGenerator.Role, "tls generators default to the configured pki role")
+	assert.Equal(t, "720h", tlsGenerator.TTL, "tls generators default to the configured ttl")
+
+	options := GeneratorData{"type": "tls", "cn": "foo.scribd.com", "ca": "service"}
+
+	generator, err = km.NewGenerator(options)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "service", generator.(TLSGenerator).CA, "generators can still choose their own pki mount")
+	assert.Equal(t, 3, len(options), "defaults aren't written into the secret's generator data")
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	os.Setenv("VAULT_ADDR", "https://vault.override.com:8200")
+	os.Setenv("VAULT_TOKEN", "s.override")
+
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	config, err := NewConfig("keymaster.yml", []byte(testConfig("")))
+	if err != nil {
+		log.Printf("Error loading config: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "https://vault.override.com:8200", config.Vault.Address, "VAULT_ADDR overrides the file")
+	assert.Equal(t, "s.override", config.Vault.Token, "VAULT_TOKEN sets the token")
+
+	client, err := config.VaultClient()
+	if err != nil {
+		log.Printf("Error creating vault client: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "s.override", client.Token(), "client uses the token")
+}
@@ -0,0 +1,326 @@
+/*
+	These functions manage the catalog of Environments an organization has.
+
+	Without a catalog, Environments are just the names Teams give them.  With one, in the keymaster config, each Environment is defined once for everybody:
+
+	environments:
+	  - name: production
+	    tier: prod                    # prod or non-prod
+	    cidrs:                        # the networks its clients are in
+	      - 10.0.0.0/16
+	    realms:                       # the realm types allowed in it.  Defaults to all of them
+	      - k8s
+	      - iam
+	    aliases:                      # other names Teams can use for it
+	      - prod
+
+	Teams then have to use Environments from the catalog, so a typo is an error rather than a new set of buckets.  Aliases are replaced with the Environment's name when a Team is loaded.
+
+	The CIDRs of an Environment bind the auth roles in it when auth is IP restricted, and let clients work out which Environment they're in from their own address.
+
+	A Secret with a tier only exists in Environments of that tier, e.g. so production credentials can't end up in a non-prod bucket.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+)
+
+const TIER_PROD = "prod"
+const TIER_NON_PROD = "non-prod"
+
+const ERR_NAMELESS_ENVIRONMENT = "nameless environments are not supported"
+const ERR_DUPLICATE_ENVIRONMENT = "environment name or alias is used more than once"
+const ERR_UNKNOWN_TIER = "tiers must be prod or non-prod"
+const ERR_BAD_ENVIRONMENT_CIDR = "environment cidrs must be ip addresses or cidr blocks"
+const ERR_DUPLICATE_ENVIRONMENT_CIDR = "cidr is in more than one environment"
+const ERR_UNKNOWN_ENVIRONMENT = "environment is not in the environment catalog"
+const ERR_REALM_NOT_ALLOWED_IN_ENVIRONMENT = "realm type is not allowed in the environment"
+const ERR_SECRET_TIER_WITHOUT_CATALOG = "secret tiers need an environment catalog"
+const ERR_SECRET_TIER_MISMATCH = "secret environment is not of the secret's tier"
+const ERR_NO_ENVIRONMENT_FOR_IP = "no environment has a cidr containing the address"
+const ERR_ADDRESS_OUTSIDE_ENVIRONMENT = "address is outside the cidrs of its environment"
+
+var EnvironmentTiers = []string{
+	TIER_PROD,
+	TIER_NON_PROD,
+}
+
+// Environment An Environment of the organization, as defined in the environment catalog.
+type Environment struct {
+	Name    string   `yaml:"name"`
+	Tier    string   `yaml:"tier"`    // prod or non-prod
+	Cidrs   []string `yaml:"cidrs"`   // the networks the Environment's clients are in
+	Realms  []string `yaml:"realms"`  // the realm types allowed in the Environment.  Empty allows them all
+	Aliases []string `yaml:"aliases"` // other names Teams can use for the Environment
+}
+
+// SetEnvironments sets the environment catalog.  Teams loaded afterwards have to use its Environments.
+func (km *KeyMaster) SetEnvironments(environments []*Environment) {
+	km.Environments = environments
+
+	km.EnvironmentsByName = make(map[string]*Environment)
+	for _, env := range environments {
+		km.EnvironmentsByName[env.Name] = env
+
+		for _, alias := range env.Aliases {
+			km.EnvironmentsByName[alias] = env
+		}
+	}
+}
+
+// LookupEnvironment finds an Environment in the catalog by its name or one of its aliases.
+func (km *KeyMaster) LookupEnvironment(name string) (env *Environment, ok bool) {
+	env, ok = km.EnvironmentsByName[name]
+
+	return env, ok
+}
+
+// EnvironmentName returns the name of the Environment a name or alias refers to.  Names that aren't in the catalog are returned as they are.
+func (km *KeyMaster) EnvironmentName(name string) string {
+	env, ok := km.LookupEnvironment(name)
+	if ok {
+		return env.Name
+	}
+
+	return name
+}
+
+// EnvironmentCidrs returns the CIDRs of an Environment, if it's in the catalog.
+func (km *KeyMaster) EnvironmentCidrs(name string) (cidrs []string) {
+	env, ok := km.LookupEnvironment(name)
+	if ok {
+		return env.Cidrs
+	}
+
+	return cidrs
+}
+
+// EnvironmentForIp returns the Environment an IP address is in.  If the CIDRs of more than one Environment contain it, the most specific wins.
+func (km *KeyMaster) EnvironmentForIp(address string) (env *Environment, err error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_NO_ENVIRONMENT_FOR_IP, address))
+		return env, err
+	}
+
+	best := -1
+
+	for _, candidate := range km.Environments {
+		for _, cidr := range candidate.Cidrs {
+			network, err := parseCidr(cidr)
+			if err != nil {
+				continue
+			}
+
+			size, _ := network.Mask.Size()
+			if network.Contains(ip) && size > best {
+				env = candidate
+				best = size
+			}
+		}
+	}
+
+	if env == nil {
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_NO_ENVIRONMENT_FOR_IP, address))
+		return env, err
+	}
+
+	return env, err
+}
+
+// cidrsContain returns true if one of the CIDRs contains the address.
+func cidrsContain(cidrs []string, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		network, err := parseCidr(cidr)
+		if err != nil {
+			continue
+		}
+
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateEnvironments checks the Environments of a catalog make sense, returning every problem found.
+func validateEnvironments(environments []*Environment, source *configSource) (problems ConfigErrors) {
+	names := make([]string, 0)
+	cidrs := make(map[string]string)
+
+	for i, env := range environments {
+		envSource := source.child(fmt.Sprintf("environments[%d]", i))
+
+		if env.Name == "" {
+			problems = append(problems, envSource.errorAt("name", errors.New(ERR_NAMELESS_ENVIRONMENT)))
+		} else if stringInSlice(env.Name, names) {
+			problems = append(problems, envSource.errorAt("name", errors.New(fmt.Sprintf("%s: %s", ERR_DUPLICATE_ENVIRONMENT, env.Name))))
+		}
+
+		names = append(names, env.Name)
+
+		for j, alias := range env.Aliases {
+			if stringInSlice(alias, names) {
+				problems = append(problems, envSource.errorAt(fmt.Sprintf("aliases[%d]", j), errors.New(fmt.Sprintf("%s: %s", ERR_DUPLICATE_ENVIRONMENT, alias))))
+			}
+
+			names = append(names, alias)
+		}
+
+		if !stringInSlice(env.Tier, EnvironmentTiers) {
+			problems = append(problems, envSource.errorAt("tier", errors.New(fmt.Sprintf("%s: %q", ERR_UNKNOWN_TIER, env.Tier))))
+		}
+
+		for j, cidr := range env.Cidrs {
+			network, err := parseCidr(cidr)
+			if err != nil {
+				problems = append(problems, envSource.errorAt(fmt.Sprintf("cidrs[%d]", j), errors.New(fmt.Sprintf("%s: %s", ERR_BAD_ENVIRONMENT_CIDR, cidr))))
+				continue
+			}
+
+			other, ok := cidrs[network.String()]
+			if ok && other != env.Name {
+				problems = append(problems, envSource.errorAt(fmt.Sprintf("cidrs[%d]", j), errors.New(fmt.Sprintf("%s: %s is also in %s", ERR_DUPLICATE_ENVIRONMENT_CIDR, cidr, other))))
+			}
+
+			cidrs[network.String()] = env.Name
+		}
+
+		for j, realmType := range env.Realms {
+			if !stringInSlice(realmType, RealmTypes) {
+				problems = append(problems, envSource.errorAt(fmt.Sprintf("realms[%d]", j), errors.New(fmt.Sprintf("%s: %s", ERR_UNSUPPORTED_REALM, realmType))))
+			}
+		}
+	}
+
+	return problems
+}
+
+// resolveEnvironments checks a Team's Environments are in the catalog, and replaces aliases with the names of the Environments they refer to.  Without a catalog, there's nothing to check.
+func (km *KeyMaster) resolveEnvironments(team *Team) (problems ConfigErrors) {
+	if km.EnvironmentsByName == nil {
+		return problems
+	}
+
+	resolved := make([]string, 0)
+
+	for i, name := range team.Environments {
+		env, ok := km.LookupEnvironment(name)
+		if !ok {
+			problems = append(problems, team.source.errorAt(fmt.Sprintf("environments[%d]", i), errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_ENVIRONMENT, name))))
+			resolved = append(resolved, name)
+			continue
+		}
+
+		// a name and its alias are the same Environment
+		if !stringInSlice(env.Name, resolved) {
+			resolved = append(resolved, env.Name)
+		}
+	}
+
+	team.Environments = resolved
+
+	// anything else naming an Environment has to be one of the Team's, which is checked later
+	for _, secret := range team.Secrets {
+		km.resolveEnvironmentNames(secret.Environments)
+
+		for _, grant := range secret.SharedWith {
+			km.resolveEnvironmentNames(grant.Environments)
+		}
+	}
+
+	for _, role := range team.Roles {
+		for _, realm := range role.Realms {
+			realm.Environment = km.EnvironmentName(realm.Environment)
+		}
+	}
+
+	return problems
+}
+
+// resolveEnvironmentNames replaces aliases in a list of Environments, in place.
+func (km *KeyMaster) resolveEnvironmentNames(names []string) {
+	for i, name := range names {
+		names[i] = km.EnvironmentName(name)
+	}
+}
+
+// validateSecretTier checks the tier of a Secret, and that the Environments it lists are of that tier.
+func (km *KeyMaster) validateSecretTier(secret *Secret) (problems ConfigErrors) {
+	if secret.Tier == "" {
+		return problems
+	}
+
+	if !stringInSlice(secret.Tier, EnvironmentTiers) {
+		problems = append(problems, secret.source.errorAt("tier", errors.New(fmt.Sprintf("%s: %q", ERR_UNKNOWN_TIER, secret.Tier))))
+		return problems
+	}
+
+	if km.EnvironmentsByName == nil {
+		problems = append(problems, secret.source.errorAt("tier", errors.New(fmt.Sprintf("%s: %s", ERR_SECRET_TIER_WITHOUT_CATALOG, secret.Name))))
+		return problems
+	}
+
+	for i, name := range secret.Environments {
+		env, ok := km.LookupEnvironment(name)
+		if ok && env.Tier != secret.Tier {
+			problems = append(problems, secret.source.errorAt(fmt.Sprintf("environments[%d]", i), errors.New(fmt.Sprintf("%s: %s is %s", ERR_SECRET_TIER_MISMATCH, name, env.Tier))))
+		}
+	}
+
+	return problems
+}
+
+// environmentsOfTier returns the Environments of a tier, from a list of them.  An empty tier matches every Environment, and so does one that can't be checked, so Roles using the Secret don't get errors of their own.
+func (km *KeyMaster) environmentsOfTier(names []string, tier string) (matching []string) {
+	if tier == "" || !stringInSlice(tier, EnvironmentTiers) || km.EnvironmentsByName == nil {
+		return names
+	}
+
+	matching = make([]string, 0)
+
+	for _, name := range names {
+		env, ok := km.LookupEnvironment(name)
+		if ok && env.Tier == tier {
+			matching = append(matching, name)
+		}
+	}
+
+	return matching
+}
+
+// parseCidr parses a CIDR block.  A bare IP address is a block of one.
+func parseCidr(cidr string) (network *net.IPNet, err error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			err = errors.New(fmt.Sprintf("invalid ip address: %s", cidr))
+			return network, err
+		}
+
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+
+		return network, err
+	}
+
+	_, network, err = net.ParseCIDR(cidr)
+
+	return network, err
+}
@@ -0,0 +1,607 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func testEnvironments() []*Environment {
+	return []*Environment{
+		{
+			Name:    "production",
+			Tier:    TIER_PROD,
+			Cidrs:   []string{"10.0.0.0/16", "10.0.5.0/24"},
+			Realms:  []string{K8S, IAM},
+			Aliases: []string{"prod"},
+		},
+		{
+			Name:  "staging",
+			Tier:  TIER_NON_PROD,
+			Cidrs: []string{"10.1.0.0/16"},
+		},
+		{
+			Name:  "development",
+			Tier:  TIER_NON_PROD,
+			Cidrs: []string{"10.0.5.7", "192.168.0.0/16"},
+		},
+	}
+}
+
+func TestEnvironmentCatalog(t *testing.T) {
+	inputs := []struct {
+		name      string
+		in        string
+		caCertEnv string
+		errs      []string
+		fields    []string
+	}{
+		{
+			"good",
+			`environments:
+  - name: production
+    tier: prod
+    cidrs:
+      - 10.0.0.0/16
+    realms:
+      - k8s
+    aliases:
+      - prod
+  - name: staging
+    tier: non-prod
+`,
+			"prod",
+			nil,
+			nil,
+		},
+		{
+			"bad-environments",
+			`environments:
+  - name: production
+    tier: production
+    cidrs:
+      - 10.0.0.0/16
+      - 10.0.0.0/33
+    realms:
+      - k8
+    aliases:
+      - prod
+  - name: prod
+    tier: prod
+    cidrs:
+      - 10.0.0.0/16
+  - tier: non-prod
+  - name: staging
+    tier: non-prod
+`,
+			"prod",
+			[]string{ERR_UNKNOWN_TIER, ERR_BAD_ENVIRONMENT_CIDR, ERR_UNSUPPORTED_REALM, ERR_DUPLICATE_ENVIRONMENT, ERR_DUPLICATE_ENVIRONMENT_CIDR, ERR_NAMELESS_ENVIRONMENT},
+			[]string{"environments[0].tier", "environments[0].cidrs[1]", "environments[0].realms[0]", "environments[1].name", "environments[1].cidrs[0]", "environments[2].name"},
+		},
+		{
+			"unknown-environments",
+			`environments:
+  - name: production
+    tier: prod
+    aliases:
+      - prod
+`,
+			"staging",
+			[]string{ERR_UNKNOWN_ENVIRONMENT + ": staging", ERR_UNKNOWN_ENVIRONMENT + ": staging"},
+			[]string{"tls_auth.ca_certs.staging", "clusters[1].environment"},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			config := strings.Replace(testConfig(tc.in), "ca_certs:\n    production:", fmt.Sprintf("ca_certs:\n    %s:", tc.caCertEnv), 1)
+
+			_, err := NewConfig("keymaster.yml", []byte(config))
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error loading config: %s", err)
+					t.Fail()
+				}
+
+				return
+			}
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the setting")
+				assert.True(t, configErr.Line > 0, "error gives the line")
+			}
+		})
+	}
+}
+
+func TestApplyEnvironmentCatalog(t *testing.T) {
+	config, err := NewConfig("keymaster.yml", []byte(strings.Replace(testConfig(`environments:
+  - name: production
+    tier: prod
+    aliases:
+      - prod
+  - name: staging
+    tier: non-prod
+`), "ca_certs:\n    production:", "ca_certs:\n    prod:", 1)))
+	if err != nil {
+		log.Printf("Error loading config: %s", err)
+		t.Fail()
+		return
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	err = km.ApplyConfig(config)
+	if err != nil {
+		log.Printf("Error applying config: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, 2, len(km.Environments), "catalog is set")
+	assert.Equal(t, testPemBlock+"\n", km.TlsAuthCaCertFor("production"), "ca certs can be given for an alias")
+	assert.Equal(t, "production", km.K8sClustersByName["alpha"].Environment, "cluster environments are resolved")
+
+	km = NewKeyMaster(kmClient)
+
+	config, err = NewConfig("keymaster.yml", []byte(testConfig("")))
+	if err != nil {
+		log.Printf("Error loading config: %s", err)
+		t.Fail()
+		return
+	}
+
+	err = km.ApplyConfig(config)
+	if err != nil {
+		log.Printf("Error applying config: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.True(t, km.EnvironmentsByName == nil, "configs without environments don't set a catalog")
+}
+
+func TestTeamEnvironments(t *testing.T) {
+	inputs := []struct {
+		name    string
+		in      string
+		catalog bool
+		errs    []string
+		fields  []string
+	}{
+		{
+			"aliases",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+    environments:
+      - prod
+    shared_with:
+      - team: other
+        environments:
+          - prod
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			true,
+			nil,
+			nil,
+		},
+		{
+			"unknown-environment",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - prdouction
+  - development
+`,
+			true,
+			[]string{ERR_UNKNOWN_ENVIRONMENT + ": prdouction"},
+			[]string{"environments[2]"},
+		},
+		{
+			"realm-not-allowed",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: tls
+        principals:
+          - app1.scribd.com
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			true,
+			[]string{ERR_REALM_NOT_ALLOWED_IN_ENVIRONMENT + ": tls in production"},
+			[]string{"roles[0].realms[0].type"},
+		},
+		{
+			"secret-tier",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+    tier: non-prod
+    environments:
+      - staging
+      - prod
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			true,
+			[]string{ERR_SECRET_TIER_MISMATCH + ": production is prod"},
+			[]string{"secrets[0].environments[1]"},
+		},
+		{
+			"bad-tier",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+    tier: production
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			true,
+			[]string{ERR_UNKNOWN_TIER},
+			[]string{"secrets[0].tier"},
+		},
+		{
+			"tier-without-catalog",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+    tier: prod
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			false,
+			[]string{ERR_SECRET_TIER_WITHOUT_CATALOG},
+			[]string{"secrets[0].tier"},
+		},
+		{
+			"no-catalog",
+			`---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`,
+			false,
+			nil,
+			nil,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			km := NewKeyMaster(kmClient)
+			if tc.catalog {
+				km.SetEnvironments(testEnvironments())
+			}
+
+			_, err := km.NewTeam([]byte(tc.in), false)
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error creating team: %s", err)
+					t.Fail()
+				}
+
+				return
+			}
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the field")
+			}
+		})
+	}
+}
+
+func TestTeamEnvironmentsResolved(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetEnvironments(testEnvironments())
+
+	data := `---
+name: envs
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    tier: prod
+    generator:
+      type: uuid
+  - name: baz
+    generator:
+      type: uuid
+    environments:
+      - prod
+    shared_with:
+      - team: other
+        environments:
+          - prod
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - prod
+  - staging
+  - production
+  - development
+`
+
+	team, err := km.NewTeam([]byte(data), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"production", "staging", "development"}, team.Environments, "aliases are replaced, and duplicates dropped")
+	assert.Equal(t, "production", team.Roles[0].Realms[0].Environment, "realm aliases are replaced")
+	assert.Equal(t, []string{"production"}, team.SecretsMap["bar"].Environments, "secrets with a tier default to the team's environments of that tier")
+	assert.Equal(t, []string{"production"}, team.SecretsMap["baz"].Environments, "secret aliases are replaced")
+	assert.Equal(t, []string{"production"}, team.SecretsMap["baz"].SharedWith[0].Environments, "share grant aliases are replaced")
+	assert.Equal(t, []string{"production", "staging", "development"}, team.SecretsMap["foo"].Environments, "secrets without a tier default to every environment")
+}
+
+func TestEnvironmentForIp(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetEnvironments(testEnvironments())
+
+	inputs := []struct {
+		name    string
+		address string
+		env     string
+	}{
+		{"production", "10.0.1.1", "production"},
+		{"more-specific", "10.0.5.1", "production"},
+		{"single-address", "10.0.5.7", "development"},
+		{"staging", "10.1.200.3", "staging"},
+		{"nowhere", "172.16.0.1", ""},
+		{"not-an-ip", "localhost", ""},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			env, err := km.EnvironmentForIp(tc.address)
+			if tc.env == "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_NO_ENVIRONMENT_FOR_IP), "expected no environment, got %v", env)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error finding environment: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.env, env.Name, "address is in the right environment")
+		})
+	}
+}
+
+func TestK8sAuthEnvironmentCidrs(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetEnvironments(testEnvironments())
+	km.SetIpRestrictK8sAuth(true)
+
+	cluster := &Cluster{Name: "alpha", Environment: "production"}
+	km.SetK8sClusters([]*Cluster{cluster})
+
+	role := &Role{
+		Name:   "app1",
+		Team:   "envs",
+		Realms: []*Realm{{Type: K8S, Identifiers: []string{"alpha"}, Principals: []string{"app1"}, Environment: "production"}},
+	}
+
+	err := km.WriteK8sAuth(cluster, role, role.Realms[0], []string{"default"})
+	if err != nil {
+		log.Printf("Failed writing auth: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer km.DeleteK8sAuth(cluster, role)
+
+	authData, err := km.ReadK8sAuth(cluster, role)
+	if err != nil {
+		log.Printf("Failed reading auth: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, AnonymizeStringArray([]string{"10.0.0.0/16", "10.0.5.0/24"}), authData["token_bound_cidrs"], "clusters without bound cidrs use their environment's")
+}
+
+func TestTlsAuthEnvironmentCidrs(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetEnvironments(testEnvironments())
+	km.SetIpRestrictTlsAuth(true)
+	km.SetTlsAuthCaCert(planAuthCA)
+
+	inputs := []struct {
+		name      string
+		principal string
+		env       string
+		cidrs     string
+		err       string
+	}{
+		{"in-environment", "10.1.2.3", "staging", "10.1.2.3", ""},
+		{"outside-environment", "10.1.2.3", "production", "", ERR_ADDRESS_OUTSIDE_ENVIRONMENT},
+		{"no-cidrs", "172.16.0.1", "qa", "172.16.0.1", ""},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			role := &Role{
+				Name:   "app1",
+				Team:   "envs",
+				Realms: []*Realm{{Type: TLS, Principals: []string{tc.principal}, Environment: tc.env}},
+			}
+
+			data, err := km.tlsAuthData(role, tc.env, []string{"default"})
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Failed building auth: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.cidrs, data["bound_cidrs"], "logins are bound to the principal's addresses, not the environment's cidrs")
+		})
+	}
+}
@@ -0,0 +1,414 @@
+/*
+	These functions read Team files written in JSON or TOML, as well as yaml.
+
+	Some Teams generate their definitions from code, and it's easier to emit JSON.  Others just prefer TOML:
+
+	name = "team1"
+	environments = ["production", "development"]
+
+	[[secrets]]
+	name = "foo"
+	generator = { type = "alpha", length = 32 }
+
+	[[roles]]
+	name = "app1"
+
+	[[roles.realms]]
+	type = "k8s"
+	identifiers = ["bravo"]
+	principals = ["app1"]
+	environment = "production"
+
+	[[roles.secrets]]
+	name = "foo"
+
+	The format of a file is decided by its extension: .yml or .yaml, .json, or .toml.  Data without a file name is yaml, unless another format is asked for.
+
+	Every format is read into the same yaml nodes, with the lines and columns of the file they came from, and decoded from there.  So Teams are checked the same way whatever they're written in, and problems are located in the file as it was written.
+
+	TOML positions are approximate: go-toml only reports where keys are, so values are placed after their key, and inline tables are located at their key.
+
+*/
+package keymaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const FORMAT_YAML = "yaml"
+const FORMAT_JSON = "json"
+const FORMAT_TOML = "toml"
+
+const ERR_UNKNOWN_FORMAT = "unknown team file format"
+
+var tomlErrorPositionPattern = regexp.MustCompile(`^\((\d+), (\d+)\): `)
+
+var TeamFormats = []string{
+	FORMAT_YAML,
+	FORMAT_JSON,
+	FORMAT_TOML,
+}
+
+// formatExtensions the format of Team files with each extension.
+var formatExtensions = map[string]string{
+	".yml":  FORMAT_YAML,
+	".yaml": FORMAT_YAML,
+	".json": FORMAT_JSON,
+	".toml": FORMAT_TOML,
+}
+
+// FormatForFile returns the format of a Team file, from its extension.  Ok is false if the extension isn't one of a Team file.
+func FormatForFile(path string) (format string, ok bool) {
+	format, ok = formatExtensions[strings.ToLower(filepath.Ext(path))]
+
+	return format, ok
+}
+
+// NewTeamInFormat is NewTeam(), for data in a format other than yaml.
+func (km *KeyMaster) NewTeamInFormat(data []byte, format string, verbose bool) (team *Team, err error) {
+	team, err = decodeTeamAs("", data, format)
+	if err != nil {
+		return team, err
+	}
+
+	err = km.PrepareTeam(team, verbose)
+
+	return team, err
+}
+
+// documentDecoder decodes one document after another, rejecting unknown fields.
+type documentDecoder interface {
+	Decode(v interface{}) error
+}
+
+// readDocuments reads the documents of a Team file into yaml nodes, and gives a strict decoder that goes through them in the same order.
+func readDocuments(file string, data []byte, format string) (documents []*yaml.Node, strict documentDecoder, err error) {
+	documents = make([]*yaml.Node, 0)
+
+	switch format {
+	case FORMAT_TOML:
+		return tomlDocuments(file, data)
+
+	case FORMAT_JSON:
+		err = checkJson(file, data)
+		if err != nil {
+			return documents, strict, err
+		}
+
+		data = jsonAsYaml(data)
+
+	case FORMAT_YAML:
+		// JSON is yaml, except that yaml won't have tabs
+		if json.Valid(data) {
+			data = jsonAsYaml(data)
+		}
+
+	default:
+		err = ConfigErrors{&ConfigError{File: file, Err: errors.New(fmt.Sprintf("%s: %q.  Use one of %s", ERR_UNKNOWN_FORMAT, format, strings.Join(TeamFormats, ", ")))}}
+		return documents, strict, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+
+	for {
+		var root yaml.Node
+
+		err = decoder.Decode(&root)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return documents, strict, yamlConfigError(file, nil, err)
+		}
+
+		documents = append(documents, &root)
+	}
+
+	// decoded again, as nodes can't reject unknown fields
+	yamlStrict := yaml.NewDecoder(bytes.NewReader(data))
+	yamlStrict.KnownFields(true)
+
+	return documents, yamlStrict, nil
+}
+
+// checkJson checks data is JSON, rather than yaml that isn't, locating the problem if it's not.
+func checkJson(file string, data []byte) (err error) {
+	var anything interface{}
+
+	err = json.Unmarshal(data, &anything)
+	if err == nil {
+		return err
+	}
+
+	configErr := &ConfigError{File: file, Err: errors.Wrap(err, ERR_TEAM_DATA_LOAD)}
+
+	syntaxErr, ok := err.(*json.SyntaxError)
+	if ok {
+		configErr.Line, configErr.Column = offsetPosition(data, int(syntaxErr.Offset))
+	}
+
+	return ConfigErrors{configErr}
+}
+
+// jsonAsYaml returns JSON that yaml can read.  Tabs can only be whitespace in JSON, as they're escaped in strings, so they're swapped for spaces, which keeps every line and column where it was.
+func jsonAsYaml(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\t"), []byte(" "))
+}
+
+// offsetPosition returns the line and column of a byte offset in data.
+func offsetPosition(data []byte, offset int) (line int, column int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+
+	lead := data[:offset]
+
+	return bytes.Count(lead, []byte("\n")) + 1, len(lead) - bytes.LastIndex(lead, []byte("\n"))
+}
+
+// tomlDecoder decodes TOML that's been re-encoded as yaml, strictly.  The lines in its errors are mapped back to the TOML.
+type tomlDecoder struct {
+	decoder *yaml.Decoder
+	lines   map[int]int
+}
+
+// Decode decodes the next document.
+func (d *tomlDecoder) Decode(v interface{}) (err error) {
+	err = d.decoder.Decode(v)
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	messages := []string{err.Error()}
+
+	typeErr, ok := err.(*yaml.TypeError)
+	if ok {
+		messages = typeErr.Errors
+	}
+
+	mapped := make([]string, 0)
+	for _, message := range messages {
+		mapped = append(mapped, yamlErrorLinePattern.ReplaceAllStringFunc(message, func(match string) string {
+			line, _ := strconv.Atoi(yamlErrorLinePattern.FindStringSubmatch(match)[1])
+			return fmt.Sprintf("line %d: ", d.lines[line])
+		}))
+	}
+
+	return &yaml.TypeError{Errors: mapped}
+}
+
+// tomlDocuments reads TOML into a yaml document, with the lines and columns of the TOML, and gives a strict decoder for it.  There's no document if the TOML is empty.
+//
+// The TOML is read with go-toml, then re-encoded as yaml for the yaml decoder, which alone can reject unknown fields.  go-toml only knows where keys are, so values are placed after their key, and the keys of inline tables at the key of the table.
+func tomlDocuments(file string, data []byte) (documents []*yaml.Node, strict documentDecoder, err error) {
+	documents = make([]*yaml.Node, 0)
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		configErr := &ConfigError{File: file}
+
+		message := err.Error()
+		match := tomlErrorPositionPattern.FindStringSubmatch(message)
+		if match != nil {
+			configErr.Line, _ = strconv.Atoi(match[1])
+			configErr.Column, _ = strconv.Atoi(match[2])
+			message = strings.Replace(message, match[0], "", 1)
+		}
+
+		configErr.Err = errors.Wrap(errors.New(message), ERR_TEAM_DATA_LOAD)
+
+		return documents, strict, ConfigErrors{configErr}
+	}
+
+	nodes := &tomlNodes{lines: strings.Split(string(data), "\n")}
+
+	root := nodes.table(tree, 1, 1)
+	if len(root.Content) == 0 {
+		return documents, yaml.NewDecoder(bytes.NewReader(nil)), err
+	}
+
+	document := &yaml.Node{Kind: yaml.DocumentNode, Line: 1, Column: 1, Content: []*yaml.Node{root}}
+	documents = append(documents, document)
+
+	encoded, err := yaml.Marshal(document)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to re-encode %s as yaml", file)
+		return documents, strict, err
+	}
+
+	var reread yaml.Node
+	err = yaml.Unmarshal(encoded, &reread)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to re-read %s as yaml", file)
+		return documents, strict, err
+	}
+
+	lines := make(map[int]int)
+	mapLines(&reread, document, lines)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(encoded))
+	decoder.KnownFields(true)
+
+	return documents, &tomlDecoder{decoder: decoder, lines: lines}, err
+}
+
+// mapLines maps the lines of a document re-encoded as yaml to the lines of the one it was encoded from.
+func mapLines(encoded *yaml.Node, original *yaml.Node, lines map[int]int) {
+	if _, ok := lines[encoded.Line]; !ok {
+		lines[encoded.Line] = original.Line
+	}
+
+	for i := 0; i < len(encoded.Content) && i < len(original.Content); i++ {
+		mapLines(encoded.Content[i], original.Content[i], lines)
+	}
+}
+
+// tomlNodes turns the tables and values go-toml reads into yaml nodes.
+type tomlNodes struct {
+	lines []string
+}
+
+// table returns a TOML table as a yaml mapping, with its keys in the order they're written.
+func (n *tomlNodes) table(tree *toml.Tree, line int, column int) (node *yaml.Node) {
+	node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: line, Column: column}
+
+	// the keys of inline tables are positioned within the table, not the file
+	inline := tree.Position().Line == 0
+
+	keys := tree.Keys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		a := tree.GetPositionPath([]string{keys[i]})
+		b := tree.GetPositionPath([]string{keys[j]})
+
+		return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+	})
+
+	for _, key := range keys {
+		keyLine, keyColumn := line, column
+
+		position := tree.GetPositionPath([]string{key})
+		if !inline && position.Line > 0 {
+			keyLine, keyColumn = position.Line, position.Col
+		}
+
+		valueLine, valueColumn := keyLine, keyColumn
+		if !inline && position.Line > 0 {
+			valueLine, valueColumn = n.valuePosition(keyLine, keyColumn)
+		}
+
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: keyLine, Column: keyColumn},
+			n.value(tree.GetPath([]string{key}), valueLine, valueColumn))
+	}
+
+	return node
+}
+
+// value returns a TOML value as a yaml node.  Elements of arrays are put where the array is.
+func (n *tomlNodes) value(value interface{}, line int, column int) (node *yaml.Node) {
+	node = &yaml.Node{Kind: yaml.ScalarNode, Line: line, Column: column}
+
+	switch v := value.(type) {
+	case *toml.Tree:
+		return n.table(v, line, column)
+
+	case []*toml.Tree:
+		node.Kind = yaml.SequenceNode
+		node.Tag = "!!seq"
+
+		for _, tree := range v {
+			position := tree.Position()
+			if position.Line > 0 {
+				node.Content = append(node.Content, n.table(tree, position.Line, position.Col))
+				continue
+			}
+
+			node.Content = append(node.Content, n.table(tree, line, column))
+		}
+
+	case []interface{}:
+		node.Kind = yaml.SequenceNode
+		node.Tag = "!!seq"
+
+		for _, element := range v {
+			node.Content = append(node.Content, n.value(element, line, column))
+		}
+
+	case int64:
+		node.Tag = "!!int"
+		node.Value = strconv.FormatInt(v, 10)
+
+	case float64:
+		node.Tag = "!!float"
+		node.Value = tomlFloat(v)
+
+	case bool:
+		node.Tag = "!!bool"
+		node.Value = strconv.FormatBool(v)
+
+	default:
+		// strings, and dates, which Teams don't have
+		node.Tag = "!!str"
+		node.Value = fmt.Sprint(v)
+	}
+
+	return node
+}
+
+// valuePosition returns where the value of a key starts: after the = that follows it, on the same line.  The key's position if it can't be found.
+func (n *tomlNodes) valuePosition(line int, column int) (valueLine int, valueColumn int) {
+	if line > len(n.lines) || column > len(n.lines[line-1]) {
+		return line, column
+	}
+
+	text := n.lines[line-1]
+
+	equals := strings.Index(text[column-1:], "=")
+	if equals < 0 {
+		return line, column
+	}
+
+	start := column - 1 + equals + 1
+	for start < len(text) && (text[start] == ' ' || text[start] == '\t') {
+		start++
+	}
+
+	return line, start + 1
+}
+
+// tomlFloat returns a TOML float as a yaml one.
+func tomlFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return ".nan"
+	case math.IsInf(f, 1):
+		return ".inf"
+	case math.IsInf(f, -1):
+		return "-.inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// fileFormat returns the format of a Team file.  Files whose extension doesn't say are yaml.
+func fileFormat(file string) (format string) {
+	format, ok := FormatForFile(file)
+	if !ok {
+		return FORMAT_YAML
+	}
+
+	return format
+}
@@ -0,0 +1,350 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var formatsYamlTeam = `---
+name: formats
+secrets:
+  - name: foo
+    max_versions: 5
+    generator:
+      type: alpha
+      length: 32
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`
+
+var formatsJsonTeam = `{
+	"name": "formats",
+	"secrets": [
+		{
+			"name": "foo",
+			"max_versions": 5,
+			"generator": {"type": "alpha", "length": 32}
+		}
+	],
+	"roles": [
+		{
+			"name": "app1",
+			"realms": [
+				{
+					"type": "k8s",
+					"identifiers": ["alpha"],
+					"principals": ["app1"],
+					"environment": "production"
+				}
+			],
+			"secrets": [{"name": "foo"}]
+		}
+	],
+	"environments": ["production", "staging"]
+}
+`
+
+var formatsTomlTeam = `name = "formats"
+environments = ["production", "staging"]
+
+[[secrets]]
+name = "foo"
+max_versions = 5
+generator = { type = "alpha", length = 32 }
+
+[[roles]]
+name = "app1"
+
+[[roles.realms]]
+type = "k8s"
+identifiers = ["alpha"]
+principals = ["app1"]
+environment = "production"
+
+[[roles.secrets]]
+name = "foo"
+`
+
+// formatCase a Team in one format, and how to make the same mistakes in it.
+type formatCase struct {
+	format       string
+	team         string
+	badType      []string // max_versions, which is a number, as a string
+	unknownField []string // principal instead of principals
+	badRealm     []string // a realm type that doesn't exist
+}
+
+var formatCases = []formatCase{
+	{
+		FORMAT_YAML,
+		formatsYamlTeam,
+		[]string{"max_versions: 5", "max_versions: lots"},
+		[]string{"principals:", "principal:"},
+		[]string{"type: k8s", "type: gcp"},
+	},
+	{
+		FORMAT_JSON,
+		formatsJsonTeam,
+		[]string{`"max_versions": 5`, `"max_versions": "lots"`},
+		[]string{`"principals"`, `"principal"`},
+		[]string{`"type": "k8s"`, `"type": "gcp"`},
+	},
+	{
+		FORMAT_TOML,
+		formatsTomlTeam,
+		[]string{"max_versions = 5", `max_versions = "lots"`},
+		[]string{"principals =", "principal ="},
+		[]string{`type = "k8s"`, `type = "gcp"`},
+	},
+}
+
+// positionOf returns the line and column something is at in a file.
+func positionOf(text string, what string) (line int, column int) {
+	index := strings.Index(text, what)
+	if index < 0 {
+		return line, column
+	}
+
+	return offsetPosition([]byte(text), index)
+}
+
+func TestTeamFormats(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range formatCases {
+		t.Run(tc.format, func(t *testing.T) {
+			team, err := km.NewTeamInFormat([]byte(tc.team), tc.format, false)
+			if err != nil {
+				log.Printf("Error creating team: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, "formats", team.Name, "team is read")
+			assert.Equal(t, []string{"production", "staging"}, team.Environments, "environments are read")
+			assert.Equal(t, 5, team.SecretsMap["foo"].MaxVersions, "numbers are read")
+			assert.Equal(t, 32, team.SecretsMap["foo"].GeneratorData["length"], "generator options are read")
+			assert.Equal(t, []string{"app1"}, team.RolesMap["app1"].Realms[0].Principals, "nested tables are read")
+			assert.Equal(t, []string{"formats/foo"}, secretNames(team.RolesMap["app1"].SecretsForEnv("production")), "roles get their secrets")
+		})
+	}
+}
+
+func TestTeamFormatErrors(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range formatCases {
+		t.Run(tc.format, func(t *testing.T) {
+			// mistakes the decoder finds
+			data := strings.Replace(strings.Replace(tc.team, tc.badType[0], tc.badType[1], 1), tc.unknownField[0], tc.unknownField[1], 1)
+
+			_, err := km.NewTeamInFormat([]byte(data), tc.format, false)
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok || len(configErrs) != 2 {
+				log.Printf("Expected 2 config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			typeLine, _ := positionOf(data, tc.badType[1])
+			assert.True(t, strings.HasPrefix(configErrs[0].Error(), ERR_TEAM_DATA_LOAD), "wrong types are errors.  got %q", configErrs[0])
+			assert.Equal(t, typeLine, configErrs[0].Line, "wrong types are located")
+
+			fieldLine, fieldColumn := positionOf(data, tc.unknownField[1])
+			assert.True(t, strings.HasPrefix(configErrs[1].Error(), ERR_UNKNOWN_FIELD+": principal"), "unknown fields are errors.  got %q", configErrs[1])
+			assert.Equal(t, "roles[0].realms[0].principal", configErrs[1].Field, "unknown fields are named")
+			assert.Equal(t, fieldLine, configErrs[1].Line, "unknown fields are located")
+			assert.Equal(t, fieldColumn, configErrs[1].Column, "unknown fields are located")
+
+			// mistakes found checking the team
+			data = strings.Replace(tc.team, tc.badRealm[0], tc.badRealm[1], 1)
+
+			_, err = km.NewTeamInFormat([]byte(data), tc.format, false)
+
+			configErrs, ok = err.(ConfigErrors)
+			if !ok || len(configErrs) != 1 {
+				log.Printf("Expected a config error, got %v", err)
+				t.Fail()
+				return
+			}
+
+			realmLine, _ := positionOf(data, "gcp")
+			assert.True(t, strings.HasPrefix(configErrs[0].Error(), ERR_UNSUPPORTED_REALM+": gcp"), "teams are checked.  got %q", configErrs[0])
+			assert.Equal(t, "roles[0].realms[0].type", configErrs[0].Field, "problems are named")
+			assert.Equal(t, realmLine, configErrs[0].Line, "problems are located")
+		})
+	}
+}
+
+func TestTeamFormatSyntax(t *testing.T) {
+	inputs := []struct {
+		name   string
+		format string
+		in     string
+		err    string
+		line   int
+	}{
+		{"json", FORMAT_JSON, "{\n  \"name\": \"formats\",\n  \"environments\": [\"production\",]\n}\n", ERR_TEAM_DATA_LOAD, 3},
+		{"yaml-isnt-json", FORMAT_JSON, "name: formats\n", ERR_TEAM_DATA_LOAD, 1},
+		{"toml", FORMAT_TOML, "name = \"formats\"\nenvironments = [\"production\"\n", ERR_TEAM_DATA_LOAD, 3},
+		{"toml-duplicate", FORMAT_TOML, "name = \"formats\"\n\n[[secrets]]\nname = \"foo\"\nname = \"bar\"\n", ERR_TEAM_DATA_LOAD + ": The following key was defined twice: secrets.name", 5},
+		{"unknown-format", "ini", "name=formats\n", ERR_UNKNOWN_FORMAT + ": \"ini\"", 0},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := km.NewTeamInFormat([]byte(tc.in), tc.format, false)
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok || len(configErrs) != 1 {
+				log.Printf("Expected a config error, got %v", err)
+				t.Fail()
+				return
+			}
+
+			assert.True(t, strings.HasPrefix(configErrs[0].Error(), tc.err), "expected %q, got %q", tc.err, configErrs[0])
+			assert.Equal(t, tc.line, configErrs[0].Line, "error gives the line")
+		})
+	}
+}
+
+func TestFormatForFile(t *testing.T) {
+	inputs := []struct {
+		path   string
+		format string
+	}{
+		{"team1.yml", FORMAT_YAML},
+		{"secrets/team1.YAML", FORMAT_YAML},
+		{"team1.json", FORMAT_JSON},
+		{"team1.toml", FORMAT_TOML},
+		{"team1.yml.bak", ""},
+		{"README.md", ""},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.path, func(t *testing.T) {
+			format, ok := FormatForFile(tc.path)
+			assert.Equal(t, tc.format, format, "format comes from the extension")
+			assert.Equal(t, tc.format != "", ok, "only team files have a format")
+		})
+	}
+}
+
+func TestLoadOrgFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"billing.yml": mergePaymentsFile,
+		"json.json":   strings.Replace(formatsJsonTeam, `"name": "formats"`, `"name": "json"`, 1),
+		"toml.toml":   strings.Replace(formatsTomlTeam, `name = "formats"`, `name = "toml"`, 1),
+		"notes.txt":   "not a team",
+	} {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Printf("Failed writing %s: %s", name, err)
+			t.Fail()
+			return
+		}
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	org, err := km.LoadOrg([]string{dir}, false)
+	if err != nil {
+		log.Printf("Error loading org: %s", err)
+		t.Fail()
+		return
+	}
+
+	names := make([]string, 0)
+	for _, team := range org.Teams {
+		names = append(names, team.Name)
+	}
+
+	assert.ElementsMatch(t, []string{"billing", "json", "toml"}, names, "team files are read in every format, and other files are skipped")
+
+	// problems are located in the file as it was written
+	err = ioutil.WriteFile(fmt.Sprintf("%s/toml.toml", dir), []byte(strings.Replace(formatsTomlTeam, `type = "k8s"`, `type = "gcp"`, 1)), 0644)
+	if err != nil {
+		log.Printf("Failed writing toml.toml: %s", err)
+		t.Fail()
+		return
+	}
+
+	_, err = km.LoadOrg([]string{dir}, false)
+	assert.True(t, err != nil && strings.Contains(err.Error(), fmt.Sprintf("%s: gcp (%s/toml.toml:13:8 roles[0].realms[0].type)", ERR_UNSUPPORTED_REALM, dir)), "toml problems are located.  got %v", err)
+}
+
+func TestLoadSecretYamlsFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"billing.yml": mergePaymentsFile,
+		"json.json":   strings.Replace(formatsJsonTeam, `"name": "formats"`, `"name": "json"`, 1),
+		"toml.toml":   strings.Replace(formatsTomlTeam, `name = "formats"`, `name = "toml"`, 1),
+	} {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Printf("Failed writing %s: %s", name, err)
+			t.Fail()
+			return
+		}
+	}
+
+	configs, err := LoadSecretYamls([]string{dir}, false)
+	if err != nil {
+		log.Printf("Error loading secret yamls: %s", err)
+		t.Fail()
+		return
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	names := make([]string, 0)
+	for _, config := range configs {
+		team, err := km.NewTeam(config, false)
+		if err != nil {
+			log.Printf("Error creating team: %s", err)
+			t.Fail()
+			return
+		}
+
+		names = append(names, team.Name)
+	}
+
+	assert.ElementsMatch(t, []string{"billing", "json"}, names, "yaml and json files are returned for NewTeam, and toml files are skipped")
+}
@@ -178,6 +178,7 @@ type TLSGenerator struct {
 	Sans        []string
 	IPSans      []string
 	CA          string
+	Role        string
 	TTL         string
 	VaultClient *api.Client
 }
@@ -195,7 +196,11 @@ type VaultCert struct {
 
 // Generate Hits Vault to generate TLS certs
 func (g TLSGenerator) Generate() (string, error) {
-	role := "keymaster" // this probably needs it's own role for secrets-backend
+	role := g.Role
+	if role == "" {
+		role = DEFAULT_PKI_ROLE
+	}
+
 	vaultPath := fmt.Sprintf("%s/issue/%s", g.CA, role)
 
 	data := make(map[string]interface{})
@@ -232,8 +237,9 @@ func NewTlsGenerator(vaultClient *api.Client, options GeneratorData) (generator
 		return generator, err
 	}
 
-	ca := "service"
-	ttl := "8760h"
+	ca := DEFAULT_PKI_MOUNT
+	role := DEFAULT_PKI_ROLE
+	ttl := DEFAULT_PKI_TTL
 	sans := make([]string, 0)
 	ipSans := make([]string, 0)
 
@@ -247,6 +253,17 @@ func NewTlsGenerator(vaultClient *api.Client, options GeneratorData) (generator
 		ca = c
 	}
 
+	rawRole, ok := options["role"]
+	if ok {
+		r, ok := rawRole.(string)
+		if !ok {
+			err = errors.New("Bad value for option 'role' in generator")
+			return generator, err
+		}
+
+		role = r
+	}
+
 	rawTtl, ok := options["ttl"]
 	if ok {
 		t, ok := rawTtl.(string)
@@ -300,6 +317,7 @@ func NewTlsGenerator(vaultClient *api.Client, options GeneratorData) (generator
 		Sans:        sans,
 		IPSans:      ipSans,
 		CA:          ca,
+		Role:        role,
 		TTL:         ttl,
 		VaultClient: vaultClient,
 	}
@@ -64,40 +64,20 @@ func (km *KeyMaster) RemovePolicyFromIamRole(role *Role, realm *Realm, policy Va
 
 // GrantedPoliciesForIamRole
 func (km *KeyMaster) GrantedPoliciesForIamRole(role *Role) (policies []string, err error) {
-	policies = make([]string, 0)
-
 	previousData, err := km.ReadIamAuth(role)
 	if err != nil {
 		err = errors.Wrapf(err, "failed to fetch policy data for role %s", role.Name)
 		return policies, err
 	}
 
-	// fetch current policies for this host
-	if previousData != nil {
-		previousPolicies, ok := previousData["policies"].([]interface{})
-		if ok {
-			for _, p := range previousPolicies {
-				pname, ok := p.(string)
-				if ok {
-					policies = append(policies, pname)
-				}
-			}
-		}
-		return policies, err
-	}
-
-	// else return a list with the default policy
-	policies = append(policies, "default")
+	policies = grantedPolicies(previousData)
 
 	return policies, err
 }
 
 // WriteIamAuth writes an AWS IAM auth role to vault
 func (km *KeyMaster) WriteIamAuth(role *Role, realm *Realm, policies []string) (err error) {
-	data := make(map[string]interface{})
-	data["bound_iam_principal_arn"] = strings.Join(realm.Principals, ",")
-	data["policies"] = policies
-	data["auth_type"] = "iam"
+	data := iamAuthData(realm, policies)
 
 	path, err := km.IamAuthPath(role)
 	if err != nil {
@@ -114,6 +94,16 @@ func (km *KeyMaster) WriteIamAuth(role *Role, realm *Realm, policies []string) (
 	return err
 }
 
+// iamAuthData builds the auth role WriteIamAuth writes for a Realm
+func iamAuthData(realm *Realm, policies []string) (data map[string]interface{}) {
+	data = make(map[string]interface{})
+	data["bound_iam_principal_arn"] = strings.Join(realm.Principals, ",")
+	data["policies"] = policies
+	data["auth_type"] = "iam"
+
+	return data
+}
+
 // ReadIamAuth read an IAM role out of vault
 func (km *KeyMaster) ReadIamAuth(role *Role) (data map[string]interface{}, err error) {
 	path, err := km.IamAuthPath(role)
@@ -25,11 +25,11 @@ per cluster (manual):
 const ERR_CLUSTER_DATA_LOAD = "failed to load data in supplied config"
 
 type Cluster struct {
-	Name         string `yaml:"name"`
-	ApiServerUrl string `yaml:"apiserver"`
-	CACert       string `yaml:"ca_cert"`
-	EnvName      string `yaml:"environment"`
-	Environment  string
+	Name         string   `yaml:"name"`
+	ApiServerUrl string   `yaml:"apiserver"`
+	CACert       string   `yaml:"ca_cert"`
+	EnvName      string   `yaml:"environment"`
+	Environment  string   `yaml:"-"`
 	BoundCidrs   []string `yaml:"bound_cidrs"`
 }
 
@@ -94,48 +94,20 @@ func (km *KeyMaster) RemovePolicyFromK8sRole(cluster *Cluster, role *Role, realm
 }
 
 func (km *KeyMaster) GrantedPoliciesForK8sRole(cluster *Cluster, role *Role) (policies []string, err error) {
-	policies = make([]string, 0)
-
 	previousData, err := km.ReadK8sAuth(cluster, role)
 	if err != nil {
 		err = errors.Wrapf(err, "failed to fetch policy data for role %s in cluster %s", role.Name, cluster.Name)
 		return policies, err
 	}
 
-	// fetch current policies for this host
-	if previousData != nil {
-		previousPolicies, ok := previousData["policies"].([]interface{})
-		if ok {
-			for _, p := range previousPolicies {
-				pname, ok := p.(string)
-				if ok {
-					policies = append(policies, pname)
-				}
-			}
-		}
-		return policies, err
-	}
-
-	// else return a list with the default policy
-	policies = append(policies, "default")
+	policies = grantedPolicies(previousData)
 
 	return policies, err
 }
 
 // WriteK8sAuth Writes the Vault Auth definition for the Role.
 func (km *KeyMaster) WriteK8sAuth(cluster *Cluster, role *Role, realm *Realm, policies []string) (err error) {
-
-	data := make(map[string]interface{})
-	data["bound_service_account_names"] = "default"
-	data["bound_service_account_namespaces"] = strings.Join(realm.Principals, ",")
-	data["policies"] = policies
-
-	if km.IpRestrictK8sAuth {
-		boundCidrs := strings.Join(cluster.BoundCidrs, ",")
-		data["bound_cidrs"] = boundCidrs
-	} else {
-		data["bound_cidrs"] = []string{}
-	}
+	data := km.k8sAuthData(cluster, realm, policies)
 
 	path, err := km.K8sAuthPath(cluster, role)
 	if err != nil {
@@ -152,6 +124,29 @@ func (km *KeyMaster) WriteK8sAuth(cluster *Cluster, role *Role, realm *Realm, po
 	return err
 }
 
+// k8sAuthData builds the Vault Auth definition WriteK8sAuth writes for a Realm in a cluster.
+func (km *KeyMaster) k8sAuthData(cluster *Cluster, realm *Realm, policies []string) (data map[string]interface{}) {
+	data = make(map[string]interface{})
+	data["bound_service_account_names"] = "default"
+	data["bound_service_account_namespaces"] = strings.Join(realm.Principals, ",")
+	data["policies"] = policies
+
+	if km.IpRestrictK8sAuth {
+		// clusters without cidrs of their own are bound to their environment's
+		cidrs := cluster.BoundCidrs
+		if len(cidrs) == 0 {
+			cidrs = km.EnvironmentCidrs(cluster.Environment)
+		}
+
+		boundCidrs := strings.Join(cidrs, ",")
+		data["bound_cidrs"] = boundCidrs
+	} else {
+		data["bound_cidrs"] = []string{}
+	}
+
+	return data
+}
+
 // ReadK8sAuth Reach into Vault and get the Auth config for the Role given.
 func (km *KeyMaster) ReadK8sAuth(cluster *Cluster, role *Role) (data map[string]interface{}, err error) {
 	path, err := km.K8sAuthPath(cluster, role)
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/api"
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -24,12 +23,15 @@ const ERR_SLASH_IN_TEAM_NAME = "team names cannot contain slashes"
 const ERR_SLASH_IN_ROLE_NAME = "role names cannot contain slashes"
 const ERR_UNSUPPORTED_REALM = "unsupported realm"
 const ERR_MISSING_ENVIRONMENTS = "no environments list found in config"
+const ERR_SECRET_ENVIRONMENT_NOT_IN_TEAM = "secret environment is not one of the team's environments"
+const ERR_SECRET_NOT_IN_ENVIRONMENT = "role references secret in an environment the secret does not exist in"
 
 type Realm struct {
 	Type        string   `yaml:"type"`        // k8s iam sl
 	Identifiers []string `yaml:"identifiers"` // cluster names for k8s, hostnames for TLS, meaningless for IAM unless account number?
 	Principals  []string `yaml:"principals"`  // namespaces for k8s, ARN's for IAM
 	Environment string   `yaml:"environment"` // Environment the realm occupies
+	source      *configSource
 }
 
 const K8S = "k8s"
@@ -46,12 +48,23 @@ var RealmTypes = []string{
 
 // KeyMaster The KeyMaster Interface
 type KeyMaster struct {
-	VaultClient       *api.Client
-	IpRestrictTlsAuth bool
-	IpRestrictK8sAuth bool
-	TlsAuthCaCert     string
-	K8sClusters       []*Cluster
-	K8sClustersByName map[string]*Cluster
+	VaultClient         *api.Client
+	IpRestrictTlsAuth   bool
+	IpRestrictK8sAuth   bool
+	TlsAuthCaCert       string
+	TlsAuthCaCerts      map[string]string // by Environment, overriding TlsAuthCaCert
+	K8sClusters         []*Cluster
+	K8sClustersByName   map[string]*Cluster
+	StaticSecrets       map[string]*StaticSecrets
+	SecretMountTemplate string
+	SecretPathTemplate  string
+	KvVersions          map[string]int
+	PkiMount            string
+	PkiRole             string
+	PkiTtl              string
+	Environments        []*Environment
+	EnvironmentsByName  map[string]*Environment // by name and alias.  nil if there's no environment catalog
+	RoleTemplates       []*RoleTemplate          // templates every team's roles can extend
 }
 
 // NewKeyMaster Creates a new KeyMaster with the vault client supplied.
@@ -86,21 +99,28 @@ func (km *KeyMaster) SetK8sClusters(clusters []*Cluster) {
 
 // Team  Group of humans who control their own destiny in regard to secrets
 type Team struct {
-	Name         string    `yaml:"name"`
-	Roles        []*Role   `yaml:"roles"`
-	Secrets      []*Secret `yaml:"secrets"`
-	Environments []string  `yaml:"environments"`
-	SecretsMap   map[string]*Secret
-	RolesMap     map[string]*Role
+	Name         string             `yaml:"name"`
+	Roles        []*Role            `yaml:"roles"`
+	Secrets      []*Secret          `yaml:"secrets"`
+	Environments []string           `yaml:"environments"`
+	Templates    []*RoleTemplate    `yaml:"templates"` // templates the team's roles can extend
+	SecretsMap   map[string]*Secret `yaml:"-"`
+	RolesMap     map[string]*Role   `yaml:"-"`
+	Files        []string           `yaml:"-"` // the files the team was loaded from, if known
+	source       *configSource
 }
 
 // Role A named set of Secrets that is instantiated as an Auth endpoint in Vault for each computing realm.
 type Role struct {
-	Name       string    `yaml:"name"`
-	Secrets    []*Secret `yaml:"secrets"`
-	SecretsMap map[string]*Secret
-	Realms     []*Realm `yaml:"realms"`
-	Team       string   `yaml:"team"`
+	Name       string               `yaml:"name"`
+	Secrets    []*Secret            `yaml:"secrets"`
+	SecretsMap map[string]*Secret   `yaml:"-"`
+	Realms     []*Realm             `yaml:"realms"`
+	Team       string               `yaml:"team"`
+	Extends    []string             `yaml:"extends"` // templates whose realms and secrets the block gets
+	Params     map[string]string    `yaml:"params"`  // values for the templates
+	EnvSecrets map[string][]*Secret `yaml:"-"`       // the secrets read in each environment, when blocks of the role are merged
+	source     *configSource
 }
 
 // VaultPolicy Vault Policy that allows a Role access to a Secret
@@ -115,11 +135,24 @@ type GeneratorData map[string]interface{}
 
 // Secret a set of information describing a string value in Vault that is protected from unauthorized access, and varies by business environment.
 type Secret struct {
-	Name          string        `yaml:"name"`
-	Team          string        `yaml:"team"`
-	GeneratorData GeneratorData `yaml:"generator"`
-	Generator     Generator     `yaml:"-"`
-	Environments  []string      `yaml:"-"`
+	Name               string          `yaml:"name"`
+	Team               string          `yaml:"team"`
+	GeneratorData      GeneratorData   `yaml:"generator"`
+	Generator          Generator       `yaml:"-"`
+	Environments       []string        `yaml:"environments"` // defaults to all of the team's environments
+	Description        string          `yaml:"description"`
+	Owner              string          `yaml:"owner"`
+	Tags               []string        `yaml:"tags"`
+	Runbook            string          `yaml:"runbook"`
+	MaxVersions        int             `yaml:"max_versions"`         // 0 leaves the mount default in place
+	CasRequired        *bool           `yaml:"cas_required"`         // unset leaves the mount default in place
+	DeleteVersionAfter string          `yaml:"delete_version_after"` // a duration, e.g. 720h.  Empty leaves the mount default in place
+	Validation         *ValidationRule `yaml:"validation"`           // static secrets only
+	PreviousNames      []string        `yaml:"previous_names"`       // names the secret used to have, whose values are migrated
+	PreviousTeam       string          `yaml:"previous_team"`        // the team the secret used to belong to, if it moved
+	SharedWith         []*ShareGrant   `yaml:"shared_with"`          // other teams whose roles may use the secret
+	Tier               string          `yaml:"tier"`                 // prod or non-prod.  Limits the secret to environments of the tier
+	source             *configSource
 }
 
 // SetGenerator What else?  Set's the generator on the Secret.
@@ -139,30 +172,48 @@ func (r *Role) SetTeam(team string) {
 	r.Team = team
 }
 
-// NewTeam Create a new Team from the data provided.
+// NewTeam Create a new Team from the data provided, which is yaml or JSON.  TOML needs NewTeamInFormat().
 func (km *KeyMaster) NewTeam(data []byte, verbose bool) (team *Team, err error) {
-	err = yaml.Unmarshal(data, &team)
+	team, err = decodeTeam("", data)
 	if err != nil {
-		err = errors.Wrap(err, ERR_TEAM_DATA_LOAD)
 		return team, err
 	}
 
+	err = km.PrepareTeam(team, verbose)
+
+	return team, err
+}
+
+// PrepareTeam validates a Team that has been read from yaml, and fills in its defaults, generators, and lookup maps.  Every problem found is returned, as ConfigErrors.
+func (km *KeyMaster) PrepareTeam(team *Team, verbose bool) (err error) {
+	problems := make(ConfigErrors, 0)
+
 	// Error out if there's a missing team name
-	if team.Name == "" {
-		err = errors.New(ERR_NAMELESS_TEAM)
-		return team, err
+	if team == nil || team.Name == "" {
+		var source *configSource
+		if team != nil {
+			source = team.source
+		}
+
+		problems = append(problems, source.errorAt("name", errors.New(ERR_NAMELESS_TEAM)))
+		return problems
 	}
 
 	if regexp.MustCompile(`/`).MatchString(team.Name) {
-		err = errors.New(ERR_SLASH_IN_TEAM_NAME)
-		return team, err
+		problems = append(problems, team.source.errorAt("name", errors.New(ERR_SLASH_IN_TEAM_NAME)))
 	}
 
+	// everything else is checked against the environments, so there's no point going on without them
 	if len(team.Environments) == 0 {
-		err = errors.New(ERR_MISSING_ENVIRONMENTS)
-		return team, err
+		problems = append(problems, team.source.errorAt("environments", errors.New(ERR_MISSING_ENVIRONMENTS)))
+		return problems
 	}
 
+	// templates are expanded first, so their content is checked like everything else
+	problems = append(problems, km.expandRoleTemplates(team)...)
+
+	problems = append(problems, km.resolveEnvironments(team)...)
+
 	verboseOutput(verbose, "parsing team %s", team.Name)
 
 	// Generate maps for O(1) lookups
@@ -172,106 +223,225 @@ func (km *KeyMaster) NewTeam(data []byte, verbose bool) (team *Team, err error)
 	// If there's no team listed for the secret, it belongs to the team of the file from which it's loaded.
 	for _, secret := range team.Secrets {
 		verboseOutput(verbose, "  parsing secret %s", secret.Name)
-		if secret.Team == "" {
-			secret.SetTeam(team.Name)
-		}
+		problems = append(problems, km.prepareSecret(team, secret)...)
 
-		if len(secret.GeneratorData) == 0 {
-			err = errors.New(ERR_MISSING_GENERATOR)
-			return team, err
+		// secrets with problems are still mapped, so roles that use them don't get errors of their own
+		if secret.Name != "" {
+			team.SecretsMap[secret.Name] = secret
 		}
+	}
+
+	// roles may still use the old names of secrets that have been renamed or moved
+	problems = append(problems, resolvePreviousSecretNames(team, verbose)...)
+
+	for _, role := range team.Roles {
+		verboseOutput(verbose, "  parsing role %s", role.Name)
+		problems = append(problems, km.prepareRole(team, role, verbose)...)
+	}
 
-		if secret.Name == "" {
-			err = errors.New(ERR_NAMELESS_SECRET)
-			return team, err
+	// roles can be given in more than one block
+	roles, mergeProblems := mergeRoleBlocks(team.Roles)
+	problems = append(problems, mergeProblems...)
+	team.Roles = roles
+
+	for _, role := range team.Roles {
+		team.RolesMap[role.Name] = role
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return err
+}
+
+// prepareSecret validates a Secret of a Team, and fills in its defaults and generator.
+func (km *KeyMaster) prepareSecret(team *Team, secret *Secret) (problems ConfigErrors) {
+	if secret.Team == "" {
+		secret.SetTeam(team.Name)
+	}
+
+	if secret.Name == "" {
+		problems = append(problems, secret.source.errorAt("name", errors.New(ERR_NAMELESS_SECRET)))
+	}
+
+	err := secret.ValidateMetadata()
+	if err != nil {
+		problems = append(problems, secret.source.errorAt("", err))
+	}
+
+	err = secret.ValidateVersionSettings()
+	if err != nil {
+		problems = append(problems, secret.source.errorAt("", err))
+	}
+
+	if secret.Validation != nil {
+		if secret.GeneratorData["type"] != "static" {
+			problems = append(problems, secret.source.errorAt("validation", errors.New(ERR_VALIDATION_NOT_STATIC)))
+		} else {
+			err = secret.Validation.Validate()
+			if err != nil {
+				problems = append(problems, secret.source.errorAt("validation", err))
+			}
 		}
+	}
 
+	if len(secret.GeneratorData) == 0 {
+		problems = append(problems, secret.source.errorAt("generator", errors.New(ERR_MISSING_GENERATOR)))
+	} else {
 		generator, err := km.NewGenerator(secret.GeneratorData)
 		if err != nil {
-			err = errors.Wrap(err, ERR_BAD_GENERATOR)
-			return team, err
+			problems = append(problems, secret.source.errorAt("generator", errors.Wrap(err, ERR_BAD_GENERATOR)))
 		}
 
-		secret.SetGenerator(generator)
-		secret.SetEnvironments(team.Environments)
+		for _, option := range ValidateGeneratorOptions(secret.GeneratorData) {
+			problems = append(problems, secret.source.errorAt(fmt.Sprintf("generator.%s", option), errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_GENERATOR_OPTION, option))))
+		}
 
-		verboseOutput(verbose, "  ... success!")
-		team.SecretsMap[secret.Name] = secret
+		secret.SetGenerator(generator)
 	}
 
-	for _, role := range team.Roles {
-		verboseOutput(verbose, "  parsing role %s", role.Name)
-		if role.Name == "" {
-			err = errors.New(ERR_NAMELESS_ROLE)
-			return team, err
-		}
+	problems = append(problems, km.validateSecretTier(secret)...)
 
-		if regexp.MustCompile(`/`).MatchString(role.Name) {
-			err = errors.New(ERR_SLASH_IN_ROLE_NAME)
-			return team, err
+	// Secrets exist in every environment of the team, or of the team's of their tier, unless they say otherwise.
+	if len(secret.Environments) == 0 {
+		secret.SetEnvironments(km.environmentsOfTier(team.Environments, secret.Tier))
+	} else {
+		for i, env := range secret.Environments {
+			if !stringInSlice(env, team.Environments) {
+				problems = append(problems, secret.source.errorAt(fmt.Sprintf("environments[%d]", i), errors.New(fmt.Sprintf("%s: %s", ERR_SECRET_ENVIRONMENT_NOT_IN_TEAM, env))))
+			}
 		}
+	}
 
-		if len(role.Realms) == 0 {
-			err = errors.New(ERR_REALMLESS_ROLE)
-			return team, err
-		}
+	err = secret.ValidateSharing()
+	if err != nil {
+		problems = append(problems, secret.source.errorAt("shared_with", err))
+	}
 
-		for _, realm := range role.Realms {
-			if !stringInSlice(realm.Type, RealmTypes) {
-				err = errors.New(ERR_UNSUPPORTED_REALM)
-				return team, err
-			}
+	return problems
+}
+
+// prepareRole validates a block of a Role, and fills in the Team of it and its Secrets.
+func (km *KeyMaster) prepareRole(team *Team, role *Role, verbose bool) (problems ConfigErrors) {
+	if role.Name == "" {
+		problems = append(problems, role.source.errorAt("name", errors.New(ERR_NAMELESS_ROLE)))
+	}
+
+	if regexp.MustCompile(`/`).MatchString(role.Name) {
+		problems = append(problems, role.source.errorAt("name", errors.New(ERR_SLASH_IN_ROLE_NAME)))
+	}
+
+	if len(role.Realms) == 0 {
+		problems = append(problems, role.source.errorAt("realms", errors.New(ERR_REALMLESS_ROLE)))
+	}
+
+	for _, realm := range role.Realms {
+		if !stringInSlice(realm.Type, RealmTypes) {
+			problems = append(problems, realm.source.errorAt("type", errors.New(fmt.Sprintf("%s: %s", ERR_UNSUPPORTED_REALM, realm.Type))))
+			continue
 		}
 
-		if role.Team == "" {
-			role.SetTeam(team.Name)
+		problems = append(problems, km.validateRealm(team, realm)...)
+	}
+
+	if role.Team == "" {
+		role.SetTeam(team.Name)
+	}
+
+	for _, secret := range role.Secrets {
+		verboseOutput(verbose, "  parsing role secrets %s", secret.Name)
+		if secret.Team == "" {
+			secret.Team = team.Name
 		}
 
-		for _, secret := range role.Secrets {
-			verboseOutput(verbose, "  parsing role secrets %s", secret.Name)
-			if secret.Team == "" {
-				secret.Team = team.Name
-			}
+		if secret.Team != team.Name {
+			continue
+		}
 
-			if secret.Team == team.Name {
-				_, ok := team.SecretsMap[secret.Name]
+		teamSecret, ok := team.SecretsMap[secret.Name]
+		if !ok {
+			problems = append(problems, secret.source.errorAt("name", errors.New(fmt.Sprintf("%s: %s", ERR_MISSING_SECRET, secret.Name))))
+			continue
+		}
 
-				if !ok {
-					err = errors.New(fmt.Sprintf(ERR_MISSING_SECRET))
-					return team, err
-				}
+		for _, realm := range role.Realms {
+			if !stringInSlice(realm.Environment, teamSecret.Environments) {
+				problems = append(problems, realm.source.errorAt("environment", errors.New(fmt.Sprintf("%s: %s in %s", ERR_SECRET_NOT_IN_ENVIRONMENT, secret.Name, realm.Environment))))
 			}
-			verboseOutput(verbose, "  ... done")
 		}
 
-		verboseOutput(verbose, "  ... role successfully loaded")
-		team.RolesMap[role.Name] = role
+		// the type decides where the secret is stored, and so which path the role's policy grants
+		if len(secret.GeneratorData) == 0 {
+			secret.GeneratorData = teamSecret.GeneratorData
+		}
 	}
 
-	return team, err
+	return problems
+}
+
+// ConfigureResult What configuring a Team turned up that needs a human, but didn't stop it.
+type ConfigureResult struct {
+	Team  string
+	Stale      []string // old paths of renamed Secrets that can be destroyed once nothing reads them
+	LostWrites []string // paths another writer filled in first, whose value was kept instead of the one generated
 }
 
 // ConfigureTeam  The grand unified config loader that, after the yaml file is read into memory, applies it to Vault.
-func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (err error) {
+func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (result *ConfigureResult, err error) {
+	result = &ConfigureResult{Team: team.Name}
+
 	verboseOutput(verbose, "--- Configuring team %s ---", team.Name)
 	// populate secrets
 	verboseOutput(verbose, "--- Populating Secrets ---")
 	for _, secret := range team.Secrets {
 		verboseOutput(verbose, "    configuring secret %s", secret.Name)
+		// values of renamed secrets have to be migrated before the new paths get generated values of their own
+		stale, err := km.MigrateSecret(secret, verbose)
+		if err != nil {
+			err = errors.Wrapf(err, "failed migrating secret %s for team %s", secret.Name, secret.Team)
+			return result, err
+		}
+
+		for _, path := range stale {
+			verboseOutput(verbose, "      stale secret path %s can be destroyed once nothing reads it", path)
+		}
+
+		result.Stale = append(result.Stale, stale...)
+
 		err = km.WriteSecretIfBlank(secret, verbose)
+		if lost, ok := err.(LostWrites); ok {
+			result.LostWrites = append(result.LostWrites, lost...)
+			err = nil
+		}
+
 		if err != nil {
 			err = errors.Wrapf(err, "failed writing secret %s for team %s", secret.Name, secret.Team)
-			return err
+			return result, err
+		}
+
+		err = km.WriteSecretMetadata(secret, verbose)
+		if err != nil {
+			err = errors.Wrapf(err, "failed writing metadata for secret %s for team %s", secret.Name, secret.Team)
+			return result, err
 		}
 	}
 	verboseOutput(verbose, "done")
 
+	// bad static values need a human to fix them, so they don't stop the run, but are returned once it's done
+	verboseOutput(verbose, "--- Validating Static Secrets ---")
+	violations, err := km.ValidateStaticSecrets(team, verbose)
+	if err != nil {
+		return result, err
+	}
+	verboseOutput(verbose, "done")
+
 	verboseOutput(verbose, "--- Configuring Roles ---")
 	for _, role := range team.Roles {
 		verboseOutput(verbose, "  configuring role %s", role.Name)
 		if role.Team == "" {
 			err = errors.New("Role without a Team!")
-			return err
+			return result, err
 		}
 
 		verboseOutput(verbose, "  defining realms...")
@@ -285,14 +455,14 @@ func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (err error) {
 			policy, err := km.NewPolicy(role, env)
 			if err != nil {
 				err = errors.Wrapf(err, "failed to create policy")
-				return err
+				return result, err
 			}
 
 			verboseOutput(verbose, "      writing policy to %s ...", policy.Path)
 			err = km.WritePolicyToVault(policy, verbose)
 			if err != nil {
 				err = errors.Wrapf(err, "failed writing policy %q for role %q in env %q", policy.Name, role.Name, env)
-				return err
+				return result, err
 			}
 			verboseOutput(verbose, "      written")
 
@@ -303,10 +473,16 @@ func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (err error) {
 				// TODO AddPolicyToK8sRole doesn't overwrite.  If you change the policy the old policy needs deleting.  Should probably fix this.
 				for _, cluster := range realm.Identifiers {
 					verboseOutput(verbose, "            %s", cluster)
-					err = km.AddPolicyToK8sRole(km.K8sClustersByName[cluster], role, realm, policy)
+					k8sCluster, ok := km.K8sClustersByName[cluster]
+					if !ok {
+						err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_K8S_CLUSTER, cluster))
+						return result, err
+					}
+
+					err = km.AddPolicyToK8sRole(k8sCluster, role, realm, policy)
 					if err != nil {
 						err = errors.Wrapf(err, "failed to add K8S Auth for role:%q policy:%q cluster:%q env:%q", role.Name, policy.Name, cluster, env)
-						return err
+						return result, err
 					}
 				}
 
@@ -316,18 +492,18 @@ func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (err error) {
 				err = km.AddPolicyToTlsRole(role, env, policy)
 				if err != nil {
 					err = errors.Wrapf(err, "failed to add TLS auth for role: %q policy: %q env: %q", role.Name, policy.Name, env)
-					return err
+					return result, err
 				}
 			case IAM:
 				verboseOutput(verbose, "          aws")
 				err = km.AddPolicyToIamRole(role, realm, policy)
 				if err != nil {
 					err = errors.Wrapf(err, "failed to add IAM auth for role: %q policy: %q env: %q", role.Name, policy.Name, env)
-					return err
+					return result, err
 				}
 			default:
-				err = errors.New(fmt.Sprintf("unsupported realm %q", realm))
-				return err
+				err = errors.New(fmt.Sprintf("unsupported realm %q", realm.Type))
+				return result, err
 			}
 		}
 		verboseOutput(verbose, "      done")
@@ -336,11 +512,39 @@ func (km *KeyMaster) ConfigureTeam(team *Team, verbose bool) (err error) {
 
 	verboseOutput(verbose, "done")
 
-	return err
+	if len(violations) > 0 {
+		err = ValidationViolations(violations)
+		return result, err
+	}
+
+	return result, err
 }
 
+// LoadSecretYamls reads Team files, and the Team files in directories.  Only the data is returned, for NewTeam(), which reads yaml and JSON.  TOML files are skipped, as their data can't be told apart.  Use LoadTeamFiles() for them, which keeps the path, and so the format, of each file.
 func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 	data = make([][]byte, 0)
+
+	teamFiles, err := LoadTeamFiles(files, verbose)
+	if err != nil {
+		return data, err
+	}
+
+	for _, teamFile := range teamFiles {
+		format, _ := FormatForFile(teamFile.Path)
+		if format == FORMAT_TOML {
+			verboseOutput(verbose, "  skipping TOML file %q", teamFile.Path)
+			continue
+		}
+
+		data = append(data, teamFile.Data)
+	}
+
+	return data, err
+}
+
+// LoadTeamFiles reads Team files, and the Team files in directories, remembering which file each came from.  Files in directories are Team files if they're yaml, JSON or TOML, by their extension.
+func LoadTeamFiles(files []string, verbose bool) (teamFiles []*TeamFile, err error) {
+	teamFiles = make([]*TeamFile, 0)
 	verboseOutput(verbose, "\nLoading Secret Yamls")
 
 	for _, fileName := range files {
@@ -348,7 +552,7 @@ func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 		fi, err := os.Stat(fileName)
 		if err != nil {
 			err = errors.Wrap(err, fmt.Sprintf("failed to read yaml %s", fileName))
-			return data, err
+			return teamFiles, err
 		}
 
 		switch mode := fi.Mode(); {
@@ -357,11 +561,11 @@ func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 			configBytes, err := ioutil.ReadFile(fileName)
 			if err != nil {
 				err = errors.Wrapf(err, "Error reading yaml %s", fileName)
-				return data, err
+				return teamFiles, err
 			}
 
 			verboseOutput(verbose, "      ... loaded")
-			data = append(data, configBytes)
+			teamFiles = append(teamFiles, &TeamFile{Path: fileName, Data: configBytes})
 
 		case mode.IsDir():
 			verboseOutput(verbose, "      it's a directory")
@@ -373,10 +577,10 @@ func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 				}
 				if !info.IsDir() { // we only care about files
 					verboseOutput(verbose, "        it's a regular file")
-					// and we only care about yaml files
+					// and we only care about team files
 					fileName := filepath.Base(path)
-					pat := regexp.MustCompile(`.+\.ya?ml`)
-					if !pat.MatchString(fileName) {
+					_, ok := FormatForFile(fileName)
+					if !ok {
 						return nil
 					}
 
@@ -387,7 +591,7 @@ func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 					}
 
 					verboseOutput(verbose, "          ... loaded")
-					data = append(data, configBytes)
+					teamFiles = append(teamFiles, &TeamFile{Path: path, Data: configBytes})
 
 					return nil
 				}
@@ -398,12 +602,12 @@ func LoadSecretYamls(files []string, verbose bool) (data [][]byte, err error) {
 
 			if err != nil {
 				err = errors.Wrapf(err, "error walking directory %s", fileName)
-				return data, err
+				return teamFiles, err
 			}
 		}
 	}
 
-	return data, err
+	return teamFiles, err
 }
 
 func verboseOutput(verbose bool, message string, args ...interface{}) {
@@ -79,13 +79,36 @@ func setUp() {
 			}
 		}
 
-		// Create K8s Auth endpoints
+		// Create a legacy KV v1 Secret engine
 		data := map[string]interface{}{
+			"type":        "kv",
+			"description": "Legacy Secrets",
+			"options": map[string]interface{}{
+				"version": "1",
+			},
+		}
+		_, err := client.Logical().Write("sys/mounts/legacy-team1", data)
+		if err != nil {
+			log.Fatalf("Unable to create secret engine %q: %s", "legacy-team1", err)
+		}
+
+		// Create a Secret engine shared by several teams
+		data = map[string]interface{}{
+			"type":        "kv-v2",
+			"description": "Shared Secrets",
+		}
+		_, err = client.Logical().Write("sys/mounts/shared-secrets", data)
+		if err != nil {
+			log.Fatalf("Unable to create secret engine %q: %s", "shared-secrets", err)
+		}
+
+		// Create K8s Auth endpoints
+		data = map[string]interface{}{
 			"type":        "kubernetes",
 			"description": fmt.Sprintf("Kubernetes Cluster Alpha"),
 		}
 
-		_, err := client.Logical().Write("sys/auth/k8s-alpha", data)
+		_, err = client.Logical().Write("sys/auth/k8s-alpha", data)
 		if err != nil {
 			log.Fatalf("Failed to enable k8s auth at %s: k8s-alpha", err)
 		}
@@ -218,6 +241,9 @@ func WriteKeyMasterPolicy(client *api.Client) (err error) {
 		"secret-team2/*",
 		"secret-team3/*",
 		"secret-team4/*",
+		"legacy-team1/*",
+		"shared-secrets/*",
+		"sys/mounts",
 		"sys/policy/*",
 		"auth/cert/certs/*",
 		"service/issue/keymaster",
@@ -430,7 +456,7 @@ roles:
     realms: 
       - type: tls
         principals:
-          - app1
+          - app1.scribd.com
         environment: production
     secrets:
       - name: foo
@@ -674,6 +700,167 @@ environments:
 `,
 			ERR_UNSUPPORTED_REALM,
 		},
+		{
+			"secret-environment-subset",
+			`---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+  - name: live-key
+    environments:
+      - production
+    generator:
+      type: static
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+      - name: live-key
+environments:
+  - production
+  - staging
+  - development
+`,
+			"",
+		},
+		{
+			"secret-environment-not-in-team",
+			`---
+name: team1
+secrets:
+  - name: live-key
+    environments:
+      - prod
+    generator:
+      type: static
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: live-key
+environments:
+  - production
+  - staging
+  - development
+`,
+			ERR_SECRET_ENVIRONMENT_NOT_IN_TEAM,
+		},
+		{
+			"secret-not-in-role-environment",
+			`---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+  - name: live-key
+    environments:
+      - production
+    generator:
+      type: static
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: foo
+      - name: live-key
+environments:
+  - production
+  - staging
+  - development
+`,
+			ERR_SECRET_NOT_IN_ENVIRONMENT,
+		},
+		{
+			"validation-on-static-secret",
+			`---
+name: team1
+secrets:
+  - name: pin
+    generator:
+      type: static
+    validation:
+      regex: ^[0-9]+$
+      min_length: 4
+environments:
+  - production
+`,
+			"",
+		},
+		{
+			"validation-on-generated-secret",
+			`---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+    validation:
+      non_empty: true
+environments:
+  - production
+`,
+			ERR_VALIDATION_NOT_STATIC,
+		},
+		{
+			"bad-validation-regex",
+			`---
+name: team1
+secrets:
+  - name: pin
+    generator:
+      type: static
+    validation:
+      regex: "[0-9"
+environments:
+  - production
+`,
+			ERR_BAD_VALIDATION_REGEX,
+		},
+		{
+			"previous-name-in-use",
+			`---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+  - name: bar
+    previous_names:
+      - foo
+    generator:
+      type: alpha
+      length: 8
+environments:
+  - production
+`,
+			ERR_PREVIOUS_NAME_CONFLICT,
+		},
 	}
 	km := NewKeyMaster(kmClient)
 
@@ -685,6 +872,11 @@ environments:
 			if err != nil {
 				errstr = err.Error()
 			}
+			// every problem is reported, the one the case is about comes first
+			configErrs, ok := err.(ConfigErrors)
+			if ok && len(configErrs) > 0 {
+				errstr = configErrs[0].Error()
+			}
 			if tt.out == "" && errstr != "" {
 				log.Printf("Error on %s expected %q, got %q", tt.name, tt.out, errstr)
 				t.Fail()
@@ -1020,7 +1212,7 @@ Kxq0lynHENJpP/eXjfyC8sLDVJN8YO3n4w==
 			t.Fail()
 			return
 		} else {
-			err = km.ConfigureTeam(team, true)
+			_, err = km.ConfigureTeam(team, true)
 			if err != nil {
 				log.Printf("Failed to configure team: %s", err)
 				t.Fail()
@@ -1032,7 +1224,7 @@ Kxq0lynHENJpP/eXjfyC8sLDVJN8YO3n4w==
 				for _, secret := range team.Secrets {
 					var path string
 					if secret.GeneratorData["type"] == "tls" {
-						path, err = km.SecretPath(secret.Team, secret.Name, env)
+						path, err = km.CertPath(secret.Team, secret.Name, env)
 						if err != nil {
 							log.Printf("Error creating path: %s", err)
 							t.Fail()
@@ -1049,7 +1241,7 @@ Kxq0lynHENJpP/eXjfyC8sLDVJN8YO3n4w==
 						} else {
 							data, ok := s.Data["data"].(map[string]interface{})
 							if ok {
-								cert, ok := data["certificate"].(string)
+								cert, ok := data[TLS_FIELD_CRT].(string)
 								if !ok {
 									log.Printf("Non-string stored as a certificate at %s", path)
 									t.Fail()
@@ -1057,9 +1249,9 @@ Kxq0lynHENJpP/eXjfyC8sLDVJN8YO3n4w==
 
 								assert.True(t, certheader.MatchString(cert))
 
-								key, ok := data["private_key"].(string)
+								key, ok := data[TLS_FIELD_KEY].(string)
 								if !ok {
-									log.Printf("Non-string stored as a private_key at %s", path)
+									log.Printf("Non-string stored as a key at %s", path)
 									t.Fail()
 								}
 
@@ -1153,7 +1345,7 @@ Kxq0lynHENJpP/eXjfyC8sLDVJN8YO3n4w==
 						case IAM:
 							// TODO Add IAM Auth config when implemented
 						default:
-							log.Printf("Unsupported Realm: %s", realm)
+							log.Printf("Unsupported Realm: %s", realm.Type)
 							t.Fail()
 						}
 					}
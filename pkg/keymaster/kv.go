@@ -0,0 +1,359 @@
+/*
+	These functions map Secrets onto KV secrets engines in Vault.
+
+	Where a Secret lives is controlled by two templates on the KeyMaster.  The mount template names the secrets engine, and the path template names the location of the Secret within it.  Both templates are rendered with the Team, Name and Env of the Secret.
+
+	The defaults put each Team in a mount of its own, with paths of <name>/<env>:
+
+		mount: {{.Team}}
+		path:  {{.Name}}/{{.Env}}
+
+	Other layouts are possible, e.g. a shared mount with a team prefix:
+
+		mount: secrets
+		path:  {{.Team}}/{{.Name}}/{{.Env}}
+
+	Both KV v1 and KV v2 engines are supported.  The version of each mount is detected via sys/mounts.  If the mount cannot be found there, it's assumed to be KV v2.
+
+*/
+package keymaster
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const DEFAULT_SECRET_MOUNT_TEMPLATE = "{{.Team}}"
+const DEFAULT_SECRET_PATH_TEMPLATE = "{{.Name}}/{{.Env}}"
+const ERR_BAD_SECRET_PATH_TEMPLATE = "bad secret path template"
+const ERR_KV_V1_METADATA = "kv v1 secrets engines do not support metadata"
+const ERR_CAS_MISMATCH = "secret was changed by another writer"
+const ERR_LOST_WRITE = "generated values were discarded, as another writer filled the secret in first"
+
+// errCasMismatch is the cause of every error from a check-and-set write that lost a race
+var errCasMismatch = errors.New(ERR_CAS_MISMATCH)
+
+const KV_V1 = 1
+const KV_V2 = 2
+
+// SecretPathElements The values available to the secret path templates.
+type SecretPathElements struct {
+	Team string
+	Name string
+	Env  string
+}
+
+// SecretLocation Where a Secret lives in Vault.
+type SecretLocation struct {
+	Mount     string
+	Path      string
+	KvVersion int
+}
+
+// DataPath returns the path at which the Secret's data is read and written.
+func (l SecretLocation) DataPath() string {
+	if l.KvVersion == KV_V1 {
+		return fmt.Sprintf("%s/%s", l.Mount, l.Path)
+	}
+
+	return fmt.Sprintf("%s/data/%s", l.Mount, l.Path)
+}
+
+// MetadataPath returns the path of the Secret's KV v2 metadata.
+func (l SecretLocation) MetadataPath() (path string, err error) {
+	if l.KvVersion == KV_V1 {
+		err = errors.New(ERR_KV_V1_METADATA)
+		return path, err
+	}
+
+	path = fmt.Sprintf("%s/metadata/%s", l.Mount, l.Path)
+
+	return path, err
+}
+
+// SetSecretPathTemplate sets the templates for the mount and path of Secrets.  Empty templates revert to the defaults.
+func (km *KeyMaster) SetSecretPathTemplate(mountTemplate string, pathTemplate string) (err error) {
+	for _, t := range []string{mountTemplate, pathTemplate} {
+		_, err = template.New("path").Option("missingkey=error").Parse(t)
+		if err != nil {
+			err = errors.Wrap(err, ERR_BAD_SECRET_PATH_TEMPLATE)
+			return err
+		}
+	}
+
+	km.SecretMountTemplate = mountTemplate
+	km.SecretPathTemplate = pathTemplate
+
+	return err
+}
+
+// SetKvVersion explicitly sets the KV version of a mount, bypassing detection.
+func (km *KeyMaster) SetKvVersion(mount string, version int) {
+	if km.KvVersions == nil {
+		km.KvVersions = make(map[string]int)
+	}
+
+	km.KvVersions[mount] = version
+}
+
+// KvVersion returns the version of the KV secrets engine at the mount given.
+func (km *KeyMaster) KvVersion(mount string) (version int, err error) {
+	version, ok := km.KvVersions[mount]
+	if ok {
+		return version, err
+	}
+
+	// Mounts we can't see are assumed to be KV v2, as that's what keymaster has always expected.
+	version = KV_V2
+
+	if km.VaultClient != nil {
+		s, err := km.VaultClient.Logical().Read("sys/mounts")
+		if err == nil && s != nil {
+			for path, raw := range s.Data {
+				info, ok := raw.(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				mountType, _ := info["type"].(string)
+				if mountType != "kv" && mountType != "generic" {
+					continue
+				}
+
+				mountVersion := KV_V1
+				options, ok := info["options"].(map[string]interface{})
+				if ok && options["version"] == "2" {
+					mountVersion = KV_V2
+				}
+
+				km.SetKvVersion(strings.TrimSuffix(path, "/"), mountVersion)
+			}
+		}
+	}
+
+	v, ok := km.KvVersions[mount]
+	if ok {
+		version = v
+	}
+
+	km.SetKvVersion(mount, version)
+
+	return version, err
+}
+
+// SecretLocation Given a Name, Team, and Environment, returns where in Vault that secret is stored.
+func (km *KeyMaster) SecretLocation(team string, name string, env string) (location SecretLocation, err error) {
+	if team == "" {
+		err = errors.New("cannot make secret path for nameless team")
+		return location, err
+	}
+
+	elements := SecretPathElements{
+		Team: team,
+		Name: name,
+		Env:  env,
+	}
+
+	mountTemplate := km.SecretMountTemplate
+	if mountTemplate == "" {
+		mountTemplate = DEFAULT_SECRET_MOUNT_TEMPLATE
+	}
+
+	pathTemplate := km.SecretPathTemplate
+	if pathTemplate == "" {
+		pathTemplate = DEFAULT_SECRET_PATH_TEMPLATE
+	}
+
+	mount, err := renderPathTemplate(mountTemplate, elements)
+	if err != nil {
+		return location, err
+	}
+
+	path, err := renderPathTemplate(pathTemplate, elements)
+	if err != nil {
+		return location, err
+	}
+
+	version, err := km.KvVersion(mount)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to determine kv version of %s", mount)
+		return location, err
+	}
+
+	location = SecretLocation{
+		Mount:     mount,
+		Path:      path,
+		KvVersion: version,
+	}
+
+	return location, err
+}
+
+// ReadSecretData reads the data stored at a location.  Data will be nil if there's nothing there.
+func (km *KeyMaster) ReadSecretData(location SecretLocation) (data map[string]interface{}, err error) {
+	path := location.DataPath()
+
+	s, err := km.VaultClient.Logical().Read(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read secret at %s", path)
+		return data, err
+	}
+
+	// s will be nil if the secret does not exist
+	if s == nil {
+		return data, err
+	}
+
+	if location.KvVersion == KV_V1 {
+		data = s.Data
+		return data, err
+	}
+
+	// a deleted kv v2 secret still has metadata, but no data
+	data, _ = s.Data["data"].(map[string]interface{})
+
+	return data, err
+}
+
+// ReadSecretVersion reads the data stored at a location, along with the current KV v2 version of the secret.  The version is 0 for secrets that have never been written, and always 0 on KV v1.
+func (km *KeyMaster) ReadSecretVersion(location SecretLocation) (data map[string]interface{}, version int, err error) {
+	path := location.DataPath()
+
+	s, err := km.VaultClient.Logical().Read(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read secret at %s", path)
+		return data, version, err
+	}
+
+	if location.KvVersion == KV_V1 {
+		if s != nil {
+			data = s.Data
+		}
+
+		return data, version, err
+	}
+
+	if s != nil {
+		data, _ = s.Data["data"].(map[string]interface{})
+		metadata, _ := s.Data["metadata"].(map[string]interface{})
+
+		if data != nil && metadata != nil {
+			version, err = vaultInt(metadata["version"])
+			if err != nil {
+				err = errors.Wrapf(err, "failed to parse version of %s", path)
+			}
+
+			return data, version, err
+		}
+	}
+
+	// deleted secrets still have a current version, which is only visible in the metadata
+	metadata, err := km.ReadSecretMetadata(location)
+	if err != nil {
+		return data, version, err
+	}
+
+	if metadata != nil {
+		version, err = vaultInt(metadata["current_version"])
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse current version of %s", path)
+		}
+	}
+
+	return data, version, err
+}
+
+// WriteSecretDataCas writes data to a location, but only if the secret is still at the version given.  Version 0 means the secret must not exist yet.  KV v1 has no check-and-set, so the write is unconditional there.
+func (km *KeyMaster) WriteSecretDataCas(location SecretLocation, data map[string]interface{}, version int) (err error) {
+	if location.KvVersion == KV_V1 {
+		return km.WriteSecretData(location, data)
+	}
+
+	path := location.DataPath()
+	body := map[string]interface{}{
+		"options": map[string]interface{}{
+			"cas": version,
+		},
+		"data": data,
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, body)
+	if err != nil {
+		// vault refuses a write with a stale cas as a bad request.  If the secret has moved on from the version we had, that's why.
+		respErr, ok := err.(*api.ResponseError)
+		if ok && respErr.StatusCode == http.StatusBadRequest {
+			_, current, readErr := km.ReadSecretVersion(location)
+			if readErr == nil && current != version {
+				err = errors.Wrapf(errCasMismatch, "failed to write secret to %s", path)
+				return err
+			}
+		}
+
+		err = errors.Wrapf(err, "failed to write secret to %s", path)
+		return err
+	}
+
+	return err
+}
+
+// IsCasMismatch returns true if the error is due to a check-and-set write losing a race.
+func IsCasMismatch(err error) bool {
+	return err != nil && errors.Cause(err) == errCasMismatch
+}
+
+// WriteSecretData writes data to a location, wrapping it as the KV version requires.
+func (km *KeyMaster) WriteSecretData(location SecretLocation, data map[string]interface{}) (err error) {
+	path := location.DataPath()
+	body := data
+
+	if location.KvVersion != KV_V1 {
+		body = map[string]interface{}{
+			"data": data,
+		}
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, body)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write secret to %s", path)
+		return err
+	}
+
+	return err
+}
+
+func renderPathTemplate(pathTemplate string, elements SecretPathElements) (path string, err error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(pathTemplate)
+	if err != nil {
+		err = errors.Wrap(err, ERR_BAD_SECRET_PATH_TEMPLATE)
+		return path, err
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = tmpl.Execute(buf, elements)
+	if err != nil {
+		err = errors.Wrap(err, ERR_BAD_SECRET_PATH_TEMPLATE)
+		return path, err
+	}
+
+	path = strings.Trim(buf.String(), "/")
+
+	return path, err
+}
+
+// vaultInt converts a number as returned by the vault api into an int.
+func vaultInt(raw interface{}) (i int, err error) {
+	if raw == nil {
+		return i, err
+	}
+
+	i, err = strconv.Atoi(fmt.Sprint(raw))
+
+	return i, err
+}
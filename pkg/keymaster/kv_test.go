@@ -0,0 +1,367 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+)
+
+func TestSecretLocation(t *testing.T) {
+	inputs := []struct {
+		name          string
+		mountTemplate string
+		pathTemplate  string
+		team          string
+		secretName    string
+		env           string
+		data          string
+		metadata      string
+	}{
+		{
+			"default-layout",
+			"",
+			"",
+			"team1",
+			"foo",
+			"production",
+			"team1/data/foo/production",
+			"team1/metadata/foo/production",
+		},
+		{
+			"env-first",
+			"{{.Team}}",
+			"{{.Env}}/{{.Name}}",
+			"team1",
+			"foo",
+			"production",
+			"team1/data/production/foo",
+			"team1/metadata/production/foo",
+		},
+		{
+			"shared-mount",
+			"shared-secrets",
+			"{{.Team}}/{{.Name}}/{{.Env}}",
+			"team1",
+			"foo",
+			"staging",
+			"shared-secrets/data/team1/foo/staging",
+			"shared-secrets/metadata/team1/foo/staging",
+		},
+		{
+			"kv-v1",
+			"",
+			"",
+			"legacy-team1",
+			"foo",
+			"development",
+			"legacy-team1/foo/development",
+			"",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			km := NewKeyMaster(kmClient)
+
+			err := km.SetSecretPathTemplate(tc.mountTemplate, tc.pathTemplate)
+			if err != nil {
+				log.Printf("error setting templates: %s", err)
+				t.Fail()
+				return
+			}
+
+			path, err := km.SecretPath(tc.team, tc.secretName, tc.env)
+			if err != nil {
+				log.Printf("error creating path: %s", err)
+				t.Fail()
+			}
+
+			assert.Equal(t, tc.data, path, "Created expected data path.")
+
+			metadataPath, err := km.SecretMetadataPath(tc.team, tc.secretName, tc.env)
+			if tc.metadata == "" {
+				assert.True(t, err != nil, "kv v1 has no metadata path")
+				return
+			}
+
+			if err != nil {
+				log.Printf("error creating metadata path: %s", err)
+				t.Fail()
+			}
+
+			assert.Equal(t, tc.metadata, metadataPath, "Created expected metadata path.")
+		})
+	}
+
+	km := NewKeyMaster(kmClient)
+	err := km.SetSecretPathTemplate("{{.Team}", "")
+	assert.True(t, err != nil, "bad templates are rejected")
+}
+
+func TestKvVersion(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	inputs := []struct {
+		mount   string
+		version int
+	}{
+		{"team1", KV_V2},
+		{"legacy-team1", KV_V1},
+		{"no-such-mount", KV_V2},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.mount, func(t *testing.T) {
+			version, err := km.KvVersion(tc.mount)
+			if err != nil {
+				log.Printf("error detecting kv version: %s", err)
+				t.Fail()
+			}
+
+			assert.Equal(t, tc.version, version, "Detected kv version of %s", tc.mount)
+		})
+	}
+}
+
+func TestWriteSecretIfBlankLayouts(t *testing.T) {
+	inputs := []struct {
+		name          string
+		mountTemplate string
+		pathTemplate  string
+		team          string
+	}{
+		{
+			"kv-v1",
+			"",
+			"",
+			"legacy-team1",
+		},
+		{
+			"shared-mount",
+			"shared-secrets",
+			"{{.Team}}/{{.Env}}/{{.Name}}",
+			"team1",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			km := NewKeyMaster(kmClient)
+
+			err := km.SetSecretPathTemplate(tc.mountTemplate, tc.pathTemplate)
+			if err != nil {
+				log.Printf("error setting templates: %s", err)
+				t.Fail()
+				return
+			}
+
+			secret := &Secret{
+				Name: "layout",
+				Team: tc.team,
+				GeneratorData: GeneratorData{
+					"type":   "alpha",
+					"length": 10,
+				},
+				Environments: []string{
+					"production",
+					"staging",
+				},
+			}
+
+			g, err := km.NewGenerator(secret.GeneratorData)
+			if err != nil {
+				log.Printf("Error creating generator: %s", err)
+				t.Fail()
+				return
+			}
+
+			secret.SetGenerator(g)
+
+			err = km.WriteSecretIfBlank(secret, true)
+			if err != nil {
+				log.Printf("Failed to write secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			first := make(map[string]interface{})
+
+			for _, env := range secret.Environments {
+				location, err := km.SecretLocation(secret.Team, secret.Name, env)
+				if err != nil {
+					log.Printf("error creating location: %s", err)
+					t.Fail()
+					return
+				}
+
+				data, err := km.ReadSecretData(location)
+				if err != nil {
+					log.Printf("Failed to read secret: %s", err)
+					t.Fail()
+					return
+				}
+
+				value, ok := data["value"].(string)
+				assert.True(t, ok && len(value) == 10, "Secret written to %s", location.DataPath())
+				first[env] = value
+			}
+
+			// a second pass must not change anything
+			err = km.WriteSecretIfBlank(secret, true)
+			if err != nil {
+				log.Printf("Failed to write secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			for _, env := range secret.Environments {
+				location, err := km.SecretLocation(secret.Team, secret.Name, env)
+				if err != nil {
+					log.Printf("error creating location: %s", err)
+					t.Fail()
+					return
+				}
+
+				data, err := km.ReadSecretData(location)
+				if err != nil {
+					log.Printf("Failed to read secret: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, first[env], data["value"], "Secret at %s was not overwritten", location.DataPath())
+			}
+		})
+	}
+}
+
+func TestWriteSecretDataCas(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	location, err := km.SecretLocation("secret-team4", "contended", "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	data, version, err := km.ReadSecretVersion(location)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.True(t, data == nil, "secret does not exist yet")
+	assert.Equal(t, 0, version, "new secrets are at version 0")
+
+	// the first writer wins
+	err = km.WriteSecretDataCas(location, map[string]interface{}{"value": "first"}, version)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	// the second writer read the same version, and loses
+	err = km.WriteSecretDataCas(location, map[string]interface{}{"value": "second"}, version)
+	assert.True(t, IsCasMismatch(err), "stale write is rejected")
+
+	data, version, err = km.ReadSecretVersion(location)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "first", data["value"], "first value is kept")
+	assert.Equal(t, 1, version, "secret is at version 1")
+
+	// deleted secrets keep their version, so a rewrite must use it
+	_, err = km.VaultClient.Logical().Delete(location.DataPath())
+	if err != nil {
+		log.Printf("Failed to delete secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	data, version, err = km.ReadSecretVersion(location)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.True(t, data == nil, "deleted secret has no data")
+	assert.Equal(t, 1, version, "deleted secret is still at version 1")
+
+	err = km.WriteSecretDataCas(location, map[string]interface{}{"value": "third"}, version)
+	assert.True(t, err == nil, "deleted secret can be rewritten")
+}
+
+func TestWriteSecretIfBlankRace(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	secret := &Secret{
+		Name: "raced",
+		Team: "secret-team4",
+		GeneratorData: GeneratorData{
+			"type":   "alpha",
+			"length": 10,
+		},
+		Environments: []string{"production"},
+	}
+
+	g, err := km.NewGenerator(secret.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	// a generator that lets another writer in between the read and the write
+	secret.SetGenerator(&racingGenerator{
+		Generator: g,
+		race: func() {
+			location, _ := km.SecretLocation(secret.Team, secret.Name, "production")
+			_ = km.WriteSecretData(location, map[string]interface{}{"value": "other-writer"})
+		},
+	})
+
+	err = km.WriteSecretIfBlank(secret, true)
+
+	lost, ok := err.(LostWrites)
+	if !ok {
+		log.Printf("Expected lost writes, got %v", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, LostWrites{"secret-team4/data/raced/production"}, lost, "the caller is told its value was thrown away")
+
+	location, err := km.SecretLocation(secret.Team, secret.Name, "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	data, err := km.ReadSecretData(location)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "other-writer", data["value"], "concurrently written value was not overwritten")
+}
+
+type racingGenerator struct {
+	Generator
+	race func()
+}
+
+func (g *racingGenerator) Generate() (value string, err error) {
+	g.race()
+	return g.Generator.Generate()
+}
@@ -0,0 +1,259 @@
+/*
+	These functions read Teams, Secrets and Roles written as Kubernetes style manifests.
+
+	Besides plain Team yaml, keymaster reads documents with an apiVersion, a kind, metadata and a spec, so the same tooling that manages workloads (kustomize, helm, policy engines) can manage what they're allowed to read:
+
+	---
+	apiVersion: keymaster.scribd.com/v1
+	kind: KeymasterTeam
+	metadata:
+	  name: team1
+	spec:                               # a Team, as in plain Team yaml, without its name
+	  environments:
+	    - production
+	    - development
+	---
+	apiVersion: keymaster.scribd.com/v1
+	kind: KeymasterSecret
+	metadata:
+	  name: foo
+	spec:                               # a Secret, without its name
+	  team: team1                       # the Team it belongs to
+	  generator:
+	    type: alpha
+	    length: 32
+	---
+	apiVersion: keymaster.scribd.com/v1
+	kind: KeymasterRole
+	metadata:
+	  name: app1
+	spec:                               # a Role, without its name
+	  team: team1
+	  realms:
+	    - type: k8s
+	      identifiers:
+	        - bravo
+	      principals:
+	        - app1
+	      environment: production
+	  secrets:
+	    - name: foo
+
+	A file can hold any number of documents, plain or manifests.  Each becomes a Team: the Team of a KeymasterTeam, or one holding just the Secret or Role.  Documents of the same Team are merged, like Team files are.
+
+	The name comes from metadata.  Namespaces, labels and annotations are allowed, for the tools that set them, but keymaster doesn't use them.
+
+	The apiVersion says which version of the format a manifest is written in, so it can change without breaking the manifests that are already out there.  Only v1 exists so far.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+const MANIFEST_API_VERSION = "keymaster.scribd.com/v1"
+
+const KIND_TEAM = "KeymasterTeam"
+const KIND_SECRET = "KeymasterSecret"
+const KIND_ROLE = "KeymasterRole"
+
+const ERR_UNSUPPORTED_API_VERSION = "unsupported manifest apiVersion"
+const ERR_UNKNOWN_KIND = "unknown manifest kind"
+const ERR_NAMELESS_MANIFEST = "manifests need a metadata.name"
+const ERR_NAME_IN_SPEC = "manifests take their name from metadata, not the spec"
+const ERR_MANIFEST_WITHOUT_TEAM = "secret and role manifests need the team they belong to"
+
+var ManifestApiVersions = []string{
+	MANIFEST_API_VERSION,
+}
+
+var ManifestKinds = []string{
+	KIND_TEAM,
+	KIND_SECRET,
+	KIND_ROLE,
+}
+
+// ManifestMetadata The metadata of a manifest.  Only the name means anything to keymaster.
+type ManifestMetadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+type teamManifest struct {
+	ApiVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   ManifestMetadata `yaml:"metadata"`
+	Spec       *Team            `yaml:"spec"`
+}
+
+type secretManifest struct {
+	ApiVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   ManifestMetadata `yaml:"metadata"`
+	Spec       *Secret          `yaml:"spec"`
+}
+
+type roleManifest struct {
+	ApiVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   ManifestMetadata `yaml:"metadata"`
+	Spec       *Role            `yaml:"spec"`
+}
+
+// isManifest tells a manifest from a plain Team document, by whether it has an apiVersion or a kind.
+func isManifest(root *yaml.Node) bool {
+	_, hasApiVersion := manifestField(root, "apiVersion")
+	_, hasKind := manifestField(root, "kind")
+
+	return hasApiVersion || hasKind
+}
+
+// manifestField returns the value of a top level field of a document, if it's there.
+func manifestField(root *yaml.Node, field string) (value string, ok bool) {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return value, ok
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == field {
+			return node.Content[i+1].Value, true
+		}
+	}
+
+	return value, ok
+}
+
+// decodeManifest decodes the next document of a strict decoder as a manifest, and turns it into a Team.  Team is nil if the manifest can't be used.
+func decodeManifest(strict documentDecoder, source *configSource) (team *Team, problems ConfigErrors) {
+	apiVersion, _ := manifestField(source.Root, "apiVersion")
+	kind, _ := manifestField(source.Root, "kind")
+
+	var err error
+
+	switch kind {
+	case KIND_TEAM:
+		var manifest teamManifest
+		err = strict.Decode(&manifest)
+		if err == nil {
+			team, problems = manifest.team(source)
+		}
+	case KIND_SECRET:
+		var manifest secretManifest
+		err = strict.Decode(&manifest)
+		if err == nil {
+			team, problems = manifest.team(source)
+		}
+	case KIND_ROLE:
+		var manifest roleManifest
+		err = strict.Decode(&manifest)
+		if err == nil {
+			team, problems = manifest.team(source)
+		}
+	default:
+		// still decoded, to keep the strict decoder on the same document as the caller
+		var skipped yaml.Node
+		err = strict.Decode(&skipped)
+		if err == nil {
+			problems = append(problems, source.errorAt("kind", errors.New(fmt.Sprintf("%s: %q.  Use one of %s", ERR_UNKNOWN_KIND, kind, strings.Join(ManifestKinds, ", ")))))
+		}
+	}
+
+	if err != nil {
+		problems = append(problems, yamlConfigError(source.File, source.Root, err)...)
+		return nil, problems
+	}
+
+	if !stringInSlice(apiVersion, ManifestApiVersions) {
+		problems = append(problems, source.errorAt("apiVersion", errors.New(fmt.Sprintf("%s: %q.  Use one of %s", ERR_UNSUPPORTED_API_VERSION, apiVersion, strings.Join(ManifestApiVersions, ", ")))))
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return team, problems
+}
+
+// team turns a KeymasterTeam manifest into the Team it describes.
+func (m *teamManifest) team(source *configSource) (team *Team, problems ConfigErrors) {
+	team = m.Spec
+	if team == nil {
+		team = &Team{}
+	}
+
+	spec := source.child("spec")
+	problems = append(problems, checkManifestName(m.Metadata, team.Name, source)...)
+
+	team.Name = m.Metadata.Name
+	team.setSources(spec)
+
+	return team, problems
+}
+
+// team turns a KeymasterSecret manifest into a Team holding just the Secret.
+func (m *secretManifest) team(source *configSource) (team *Team, problems ConfigErrors) {
+	secret := m.Spec
+	if secret == nil {
+		secret = &Secret{}
+	}
+
+	spec := source.child("spec")
+	problems = append(problems, checkManifestName(m.Metadata, secret.Name, source)...)
+
+	if secret.Team == "" {
+		problems = append(problems, spec.errorAt("team", errors.New(fmt.Sprintf("%s: %s", ERR_MANIFEST_WITHOUT_TEAM, m.Metadata.Name))))
+	}
+
+	secret.Name = m.Metadata.Name
+	secret.source = spec
+
+	team = &Team{Name: secret.Team, Secrets: []*Secret{secret}, source: spec}
+
+	return team, problems
+}
+
+// team turns a KeymasterRole manifest into a Team holding just the Role.
+func (m *roleManifest) team(source *configSource) (team *Team, problems ConfigErrors) {
+	role := m.Spec
+	if role == nil {
+		role = &Role{}
+	}
+
+	spec := source.child("spec")
+	problems = append(problems, checkManifestName(m.Metadata, role.Name, source)...)
+
+	if role.Team == "" {
+		problems = append(problems, spec.errorAt("team", errors.New(fmt.Sprintf("%s: %s", ERR_MANIFEST_WITHOUT_TEAM, m.Metadata.Name))))
+	}
+
+	role.Name = m.Metadata.Name
+	role.setSources(spec)
+
+	team = &Team{Name: role.Team, Roles: []*Role{role}, source: spec}
+
+	return team, problems
+}
+
+// checkManifestName checks a manifest is named in its metadata, and only there.
+func checkManifestName(metadata ManifestMetadata, specName string, source *configSource) (problems ConfigErrors) {
+	if metadata.Name == "" {
+		problems = append(problems, source.errorAt("metadata.name", errors.New(ERR_NAMELESS_MANIFEST)))
+	}
+
+	if specName != "" {
+		problems = append(problems, source.errorAt("spec.name", errors.New(fmt.Sprintf("%s: %s", ERR_NAME_IN_SPEC, specName))))
+	}
+
+	return problems
+}
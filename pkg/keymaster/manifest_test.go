@@ -0,0 +1,195 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var manifestTeam = `---
+apiVersion: keymaster.scribd.com/v1
+kind: KeymasterTeam
+metadata:
+  name: manifested
+  labels:
+    app.kubernetes.io/managed-by: kustomize
+spec:
+  environments:
+    - production
+    - staging
+---
+apiVersion: keymaster.scribd.com/v1
+kind: KeymasterSecret
+metadata:
+  name: foo
+spec:
+  team: manifested
+  generator:
+    type: alpha
+    length: 32
+---
+apiVersion: keymaster.scribd.com/v1
+kind: KeymasterRole
+metadata:
+  name: app1
+spec:
+  team: manifested
+  realms:
+    - type: k8s
+      identifiers:
+        - alpha
+      principals:
+        - app1
+      environment: production
+  secrets:
+    - name: foo
+`
+
+func TestManifests(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	team, err := km.NewTeam([]byte(manifestTeam), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "manifested", team.Name, "team is named by its metadata")
+	assert.Equal(t, []string{"production", "staging"}, team.Environments, "team spec is read")
+	assert.Equal(t, 1, len(team.Secrets), "secret manifests are merged into the team")
+	assert.Equal(t, "foo", team.Secrets[0].Name, "secrets are named by their metadata")
+	assert.Equal(t, []string{"production", "staging"}, team.SecretsMap["foo"].Environments, "secrets get the environments of the team")
+	assert.Equal(t, []string{"manifested/foo"}, secretNames(team.RolesMap["app1"].SecretsForEnv("production")), "role manifests are merged into the team")
+}
+
+func TestManifestErrors(t *testing.T) {
+	inputs := []struct {
+		name   string
+		in     string
+		errs   []string
+		fields []string
+	}{
+		{
+			"api-version",
+			strings.Replace(manifestTeam, "keymaster.scribd.com/v1", "keymaster.scribd.com/v2", 1),
+			[]string{ERR_UNSUPPORTED_API_VERSION},
+			[]string{"apiVersion"},
+		},
+		{
+			"kind",
+			strings.Replace(manifestTeam, "KeymasterSecret", "KeymasterSecrets", 1),
+			[]string{ERR_UNKNOWN_KIND},
+			[]string{"kind"},
+		},
+		{
+			"names",
+			strings.Replace(strings.Replace(manifestTeam, "  name: foo\nspec:\n", "  labels: {}\nspec:\n  name: foo\n", 1), "  name: app1\n", "  namespace: default\n", 1),
+			[]string{ERR_NAMELESS_MANIFEST, ERR_NAME_IN_SPEC + ": foo", ERR_NAMELESS_MANIFEST},
+			[]string{"metadata.name", "spec.name", "metadata.name"},
+		},
+		{
+			"team",
+			strings.Replace(manifestTeam, "  team: manifested\n  generator:", "  generator:", 1),
+			[]string{ERR_MANIFEST_WITHOUT_TEAM + ": foo"},
+			[]string{"spec.team"},
+		},
+		{
+			"unknown-field",
+			strings.Replace(manifestTeam, "  team: manifested\n  realms:", "  team: manifested\n  realm:", 1),
+			[]string{ERR_UNKNOWN_FIELD + ": realm"},
+			[]string{"spec.realm"},
+		},
+		{
+			"more-than-one-team",
+			strings.Replace(manifestTeam, "  team: manifested\n  realms:", "  team: other\n  realms:", 1),
+			[]string{ERR_MULTIPLE_TEAMS + ": manifested, other"},
+			[]string{""},
+		},
+		{
+			"checked-where-they-are",
+			strings.Replace(manifestTeam, "        - app1\n", "        - App_1\n", 1),
+			[]string{ERR_INVALID_K8S_PRINCIPAL},
+			[]string{"spec.realms[0].principals[0]"},
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := km.NewTeam([]byte(tc.in), false)
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the field")
+
+				if tc.fields[i] != "" {
+					assert.True(t, configErr.Line > 0, "error gives the line")
+				}
+			}
+		})
+	}
+}
+
+func TestLoadOrgManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	// a plain team file, and manifests adding to it
+	for name, content := range map[string]string{
+		"billing.yml":   mergePaymentsFile,
+		"manifests.yml": strings.ReplaceAll(manifestTeam, "manifested", "billing"),
+	} {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Printf("Failed writing %s: %s", name, err)
+			t.Fail()
+			return
+		}
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	org, err := km.LoadOrg([]string{dir}, false)
+	if err != nil {
+		log.Printf("Error loading org: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(org.Teams) != 1 {
+		log.Printf("Expected 1 team, got %d", len(org.Teams))
+		t.Fail()
+		return
+	}
+
+	team := org.Teams[0]
+
+	assert.ElementsMatch(t, []string{"billing/stripe-key", "billing/shared-salt", "billing/foo"}, secretNames(team.Secrets), "manifests are merged with plain team files")
+	assert.ElementsMatch(t, []string{"production", "staging"}, team.Environments, "environments are merged")
+	assert.Equal(t, 2, len(team.Files), "each file is listed once")
+}
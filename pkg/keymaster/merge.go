@@ -0,0 +1,262 @@
+/*
+	These functions put Teams back together when they're spread across more than one file.
+
+	Large Teams can keep a file per service, each starting with the Team's name:
+
+	# payments.yml                      # invoicing.yml
+	name: billing                       name: billing
+	secrets:                            secrets:
+	  - name: stripe-key                  - name: smtp-password
+	    ...                                 ...
+	roles:                              roles:
+	  - name: payments                    - name: invoicer
+	    ...                                 ...
+	environments:                       environments:
+	  - production                        - production
+
+	Files with the same Team name are merged.  Secrets, Roles and templates are combined.  A Secret or template defined in more than one file has to be defined the same way in each, or it's an error naming both files.  Files that list Environments have to list the same ones, as the Team's Environments are where its Secrets are created.  Files that don't, like manifests of Secrets, get the Team's.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+)
+
+const ERR_CONFLICTING_SECRET = "secret is defined differently in more than one file"
+const ERR_CONFLICTING_TEMPLATE = "template is defined differently in more than one file"
+const ERR_CONFLICTING_ENVIRONMENTS = "environments are listed differently in more than one file"
+
+// TeamFile The contents of a Team yaml file, and where it came from.
+type TeamFile struct {
+	Path string
+	Data []byte
+}
+
+// mergeTeamFiles parses Team files, and merges the ones that belong to the same Team.  Teams come back in the order they first appear, not yet prepared.  Returns every problem found.
+func mergeTeamFiles(teamFiles []*TeamFile, verbose bool) (teams []*Team, problems []error) {
+	merger := newTeamMerger()
+
+	for _, teamFile := range teamFiles {
+		verboseOutput(verbose, "  reading %s", teamFile.Path)
+
+		decoded, err := decodeTeams(teamFile.Path, teamFile.Data)
+		if err != nil {
+			problems = appendProblems(problems, err)
+			continue
+		}
+
+		if len(decoded) == 0 {
+			problems = append(problems, &ConfigError{File: teamFile.Path, Err: errors.New(ERR_NAMELESS_TEAM)})
+			continue
+		}
+
+		for _, team := range decoded {
+			merger.add(team, teamFile.Path, verbose)
+		}
+	}
+
+	problems = appendProblems(problems, merger.problems)
+
+	return merger.teams, problems
+}
+
+// teamMerger merges Teams that are spread across more than one file, or document.
+type teamMerger struct {
+	teams         []*Team
+	teamsMap      map[string]*Team
+	secretSources   map[string]map[string]string // which file each secret of each team was first defined in
+	templateSources map[string]map[string]string // which file each template of each team was first defined in
+	envSources      map[string]string            // which file first listed each team's environments
+	problems        ConfigErrors
+}
+
+func newTeamMerger() (merger *teamMerger) {
+	merger = &teamMerger{
+		teams:         make([]*Team, 0),
+		teamsMap:      make(map[string]*Team),
+		secretSources:   make(map[string]map[string]string),
+		templateSources: make(map[string]map[string]string),
+		envSources:      make(map[string]string),
+		problems:        make(ConfigErrors, 0),
+	}
+
+	return merger
+}
+
+// add merges a Team from a file into the Team of the same name, or adds it if it's the first.
+func (m *teamMerger) add(team *Team, file string, verbose bool) {
+	if team.Name == "" {
+		m.problems = append(m.problems, team.source.errorAt("name", errors.New(ERR_NAMELESS_TEAM)))
+		return
+	}
+
+	existing, ok := m.teamsMap[team.Name]
+	if !ok {
+		team.Files = []string{file}
+		m.teams = append(m.teams, team)
+		m.teamsMap[team.Name] = team
+
+		m.secretSources[team.Name] = make(map[string]string)
+		for _, secret := range team.Secrets {
+			m.secretSources[team.Name][secret.Name] = file
+		}
+
+		// templates defined twice in one document are reported when they're expanded
+		m.templateSources[team.Name] = make(map[string]string)
+		for _, tmpl := range team.Templates {
+			m.templateSources[team.Name][tmpl.Name] = file
+		}
+
+		if len(team.Environments) > 0 {
+			m.envSources[team.Name] = file
+		}
+
+		return
+	}
+
+	verboseOutput(verbose, "    merging into team %s", team.Name)
+
+	// manifests can put a team's documents in the same file
+	if !stringInSlice(file, existing.Files) {
+		existing.Files = append(existing.Files, file)
+	}
+
+	if len(team.Environments) > 0 {
+		source, listed := m.envSources[team.Name]
+		if !listed {
+			m.envSources[team.Name] = file
+			existing.Environments = team.Environments
+		} else if !sameEnvironments(existing.Environments, team.Environments) {
+			m.problems = append(m.problems, team.source.errorAt("environments", errors.New(fmt.Sprintf("%s: %s has %s in %s and %s in %s", ERR_CONFLICTING_ENVIRONMENTS, team.Name, strings.Join(existing.Environments, ", "), source, strings.Join(team.Environments, ", "), file))))
+		}
+	}
+
+	for _, secret := range team.Secrets {
+		source, defined := m.secretSources[team.Name][secret.Name]
+		if !defined {
+			m.secretSources[team.Name][secret.Name] = file
+			existing.Secrets = append(existing.Secrets, secret)
+			continue
+		}
+
+		for _, other := range existing.Secrets {
+			if other.Name == secret.Name && !sameSecretDefinition(other, secret) {
+				m.problems = append(m.problems, secret.source.errorAt("", errors.New(fmt.Sprintf("%s: %s/%s in %s and %s", ERR_CONFLICTING_SECRET, team.Name, secret.Name, source, file))))
+				break
+			}
+		}
+	}
+
+	for _, tmpl := range team.Templates {
+		source, defined := m.templateSources[team.Name][tmpl.Name]
+		if !defined || tmpl.Name == "" {
+			m.templateSources[team.Name][tmpl.Name] = file
+			existing.Templates = append(existing.Templates, tmpl)
+			continue
+		}
+
+		// an identical copy is dropped, so it isn't reported as defined twice when it's expanded
+		for _, other := range existing.Templates {
+			if other.Name == tmpl.Name && !sameTemplateDefinition(other, tmpl) {
+				m.problems = append(m.problems, tmpl.source.errorAt("name", errors.New(fmt.Sprintf("%s: %s/%s in %s and %s", ERR_CONFLICTING_TEMPLATE, team.Name, tmpl.Name, source, file))))
+				break
+			}
+		}
+	}
+
+	existing.Roles = append(existing.Roles, team.Roles...)
+}
+
+// NewOrgFromFiles builds an Org from Team files, merging Teams that are spread across more than one.  Err will be an *OrgError listing every problem found.
+func (km *KeyMaster) NewOrgFromFiles(teamFiles []*TeamFile, verbose bool) (org *Org, err error) {
+	org = &Org{
+		Teams:    make([]*Team, 0),
+		TeamsMap: make(map[string]*Team),
+	}
+
+	teams, problems := mergeTeamFiles(teamFiles, verbose)
+
+	for _, team := range teams {
+		err := km.PrepareTeam(team, verbose)
+		if err != nil {
+			problems = appendProblems(problems, err)
+			continue
+		}
+
+		org.Teams = append(org.Teams, team)
+		org.TeamsMap[team.Name] = team
+	}
+
+	problems = append(problems, org.CheckSecretReferences(verbose)...)
+
+	if len(problems) > 0 {
+		err = &OrgError{Problems: problems}
+		return org, err
+	}
+
+	return org, err
+}
+
+// sameSecretDefinition returns true if two Secrets are defined the same way, wherever they were defined.
+func sameSecretDefinition(a *Secret, b *Secret) bool {
+	aCopy := *a
+	bCopy := *b
+	aCopy.source = nil
+	bCopy.source = nil
+
+	return reflect.DeepEqual(aCopy, bCopy)
+}
+
+// sameTemplateDefinition returns true if two templates are defined the same way, wherever they were defined.
+func sameTemplateDefinition(a *RoleTemplate, b *RoleTemplate) bool {
+	if a.Name != b.Name || !reflect.DeepEqual(a.Extends, b.Extends) || len(a.Realms) != len(b.Realms) || len(a.Secrets) != len(b.Secrets) {
+		return false
+	}
+
+	for i := range a.Realms {
+		if !sameRealm(a.Realms[i], b.Realms[i]) {
+			return false
+		}
+	}
+
+	for i := range a.Secrets {
+		if !sameSecretDefinition(a.Secrets[i], b.Secrets[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameEnvironments returns true if two lists hold the same Environments, in any order.
+func sameEnvironments(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, env := range a {
+		if !stringInSlice(env, b) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// appendProblems adds an error to a list of problems, splitting ConfigErrors into the problems they hold.
+func appendProblems(problems []error, err error) []error {
+	configErrs, ok := err.(ConfigErrors)
+	if !ok {
+		return append(problems, err)
+	}
+
+	for _, configErr := range configErrs {
+		problems = append(problems, configErr)
+	}
+
+	return problems
+}
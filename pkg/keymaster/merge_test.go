@@ -0,0 +1,213 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var mergePaymentsFile = `---
+name: billing
+secrets:
+  - name: stripe-key
+    generator:
+      type: static
+  - name: shared-salt
+    generator:
+      type: hex
+      length: 16
+roles:
+  - name: payments
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - payments
+        environment: production
+    secrets:
+      - name: stripe-key
+      - name: shared-salt
+environments:
+  - staging
+  - production
+`
+
+var mergeTemplate = `templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.Role}}"
+        environment: production
+`
+
+var mergeInvoicingFile = `---
+name: billing
+secrets:
+  - name: smtp-password
+    generator:
+      type: static
+  - name: shared-salt
+    generator:
+      type: hex
+      length: 16
+roles:
+  - name: invoicer
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - invoicer
+        environment: staging
+    secrets:
+      - name: smtp-password
+      - name: shared-salt
+environments:
+  - production
+  - staging
+`
+
+func TestMergeTeamFiles(t *testing.T) {
+	inputs := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			"one-file-per-service",
+			map[string]string{
+				"payments.yml":  mergePaymentsFile,
+				"invoicing.yml": mergeInvoicingFile,
+			},
+			"",
+		},
+		{
+			"conflicting-secret",
+			map[string]string{
+				"invoicing.yml": mergeInvoicingFile,
+				"payments.yml":  strings.Replace(mergePaymentsFile, "length: 16", "length: 32", 1),
+			},
+			ERR_CONFLICTING_SECRET + ": billing/shared-salt in %s/invoicing.yml and %s/payments.yml",
+		},
+		{
+			"conflicting-environments",
+			map[string]string{
+				"invoicing.yml": mergeInvoicingFile,
+				"payments.yml":  strings.Replace(mergePaymentsFile, "  - staging\n", "", 1),
+			},
+			ERR_CONFLICTING_ENVIRONMENTS + ": billing has production, staging in %s/invoicing.yml and production in %s/payments.yml",
+		},
+		{
+			"file-without-environments",
+			map[string]string{
+				"invoicing.yml": mergeInvoicingFile,
+				"payments.yml":  strings.Replace(mergePaymentsFile, "environments:\n  - staging\n  - production\n", "", 1),
+			},
+			"",
+		},
+		{
+			"same-template-in-both-files",
+			map[string]string{
+				"invoicing.yml": mergeInvoicingFile + mergeTemplate,
+				"payments.yml":  mergePaymentsFile + mergeTemplate,
+			},
+			"",
+		},
+		{
+			"conflicting-template",
+			map[string]string{
+				"invoicing.yml": mergeInvoicingFile + mergeTemplate,
+				"payments.yml":  mergePaymentsFile + strings.Replace(mergeTemplate, "alpha", "bravo", 1),
+			},
+			ERR_CONFLICTING_TEMPLATE + ": billing/k8s-service in %s/invoicing.yml and %s/payments.yml",
+		},
+		{
+			"nameless-file",
+			map[string]string{
+				"payments.yml": mergePaymentsFile,
+				"unnamed.yml":  "---\nsecrets: []\n",
+			},
+			ERR_NAMELESS_TEAM + " (%s/unnamed.yml:2:1 name)",
+		},
+		{
+			"missing-secret-names-files",
+			map[string]string{
+				"invoicing.yml": strings.Replace(mergeInvoicingFile, "- name: smtp-password\n    generator", "- name: smtp-passwd\n    generator", 1),
+				"payments.yml":  mergePaymentsFile,
+			},
+			ERR_MISSING_SECRET + ": smtp-password (%s/invoicing.yml:21:15 roles[0].secrets[0].name)",
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "keymaster")
+			if err != nil {
+				log.Printf("Error creating temp dir: %s", err)
+				t.Fail()
+				return
+			}
+
+			defer os.RemoveAll(dir)
+
+			for name, content := range tc.files {
+				err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+				if err != nil {
+					log.Printf("Failed writing %s: %s", name, err)
+					t.Fail()
+					return
+				}
+			}
+
+			org, err := km.LoadOrg([]string{dir}, true)
+			if tc.err != "" {
+				expected := strings.ReplaceAll(tc.err, "%s", dir)
+				assert.True(t, err != nil && strings.Contains(err.Error(), expected), "expected %q, got %v", expected, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error loading org: %s", err)
+				t.Fail()
+				return
+			}
+
+			if len(org.Teams) != 1 {
+				log.Printf("Expected 1 team, got %d", len(org.Teams))
+				t.Fail()
+				return
+			}
+
+			team := org.Teams[0]
+
+			secrets := make([]string, 0)
+			for _, secret := range team.Secrets {
+				secrets = append(secrets, secret.Name)
+			}
+
+			roles := make([]string, 0)
+			for _, role := range team.Roles {
+				roles = append(roles, role.Name)
+			}
+
+			assert.ElementsMatch(t, []string{"stripe-key", "shared-salt", "smtp-password"}, secrets, "secrets are merged")
+			assert.ElementsMatch(t, []string{"payments", "invoicer"}, roles, "roles are merged")
+			assert.ElementsMatch(t, []string{"production", "staging"}, team.Environments, "environments are merged")
+			assert.Equal(t, 2, len(team.Files), "team remembers its files")
+			assert.True(t, len(team.Templates) <= 1, "a template defined the same way in both files is kept once")
+
+			// secrets default to the environments of the whole team, not just their own file
+			assert.ElementsMatch(t, []string{"production", "staging"}, team.SecretsMap["stripe-key"].Environments, "secrets get every environment of the team")
+		})
+	}
+}
@@ -0,0 +1,288 @@
+/*
+	These functions keep the KV v2 metadata of Secrets in sync with the Team yaml.
+
+	Human metadata (description, owner, tags, and runbook) is written as 'custom_metadata' on each environment's path, so that auditors browsing Vault can tell what a bucket is for.  Keys in custom_metadata that keymaster does not manage are left alone.
+
+	Version retention settings (max_versions, cas_required, and delete_version_after) are applied to the same metadata endpoint.  Settings a Secret doesn't declare are left at whatever the mount, or an admin, has set.
+
+	Metadata is written on every run, and never touches the values of Secrets.  KV v1 mounts have no metadata, and are skipped.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Vault refuses custom metadata values longer than this
+const MAX_CUSTOM_METADATA_VALUE_LENGTH = 512
+const ERR_METADATA_TOO_LONG = "secret metadata value exceeds 512 characters"
+const ERR_BAD_MAX_VERSIONS = "max_versions cannot be negative"
+const ERR_BAD_DELETE_VERSION_AFTER = "delete_version_after must be a duration"
+
+const METADATA_DESCRIPTION = "description"
+const METADATA_OWNER = "owner"
+const METADATA_TAGS = "tags"
+const METADATA_RUNBOOK = "runbook"
+
+// ManagedMetadataKeys The keys in custom_metadata that keymaster owns.
+var ManagedMetadataKeys = []string{
+	METADATA_DESCRIPTION,
+	METADATA_OWNER,
+	METADATA_TAGS,
+	METADATA_RUNBOOK,
+}
+
+// CustomMetadata returns the custom_metadata keymaster manages for the Secret.  Unset fields are omitted.
+func (s *Secret) CustomMetadata() (metadata map[string]string) {
+	metadata = make(map[string]string)
+
+	if s.Description != "" {
+		metadata[METADATA_DESCRIPTION] = s.Description
+	}
+
+	if s.Owner != "" {
+		metadata[METADATA_OWNER] = s.Owner
+	}
+
+	if len(s.Tags) > 0 {
+		metadata[METADATA_TAGS] = strings.Join(s.Tags, ",")
+	}
+
+	if s.Runbook != "" {
+		metadata[METADATA_RUNBOOK] = s.Runbook
+	}
+
+	return metadata
+}
+
+// ValidateMetadata checks the Secret's metadata will be accepted by Vault.
+func (s *Secret) ValidateMetadata() (err error) {
+	for _, value := range s.CustomMetadata() {
+		if len(value) > MAX_CUSTOM_METADATA_VALUE_LENGTH {
+			err = errors.New(ERR_METADATA_TOO_LONG)
+			return err
+		}
+	}
+
+	return err
+}
+
+// VersionSettings returns the KV v2 version retention settings declared by the Secret.
+func (s *Secret) VersionSettings() (settings map[string]interface{}) {
+	settings = make(map[string]interface{})
+
+	if s.MaxVersions > 0 {
+		settings["max_versions"] = s.MaxVersions
+	}
+
+	if s.CasRequired != nil {
+		settings["cas_required"] = *s.CasRequired
+	}
+
+	if s.DeleteVersionAfter != "" {
+		settings["delete_version_after"] = s.DeleteVersionAfter
+	}
+
+	return settings
+}
+
+// ValidateVersionSettings checks the Secret's version retention settings will be accepted by Vault.
+func (s *Secret) ValidateVersionSettings() (err error) {
+	if s.MaxVersions < 0 {
+		err = errors.New(ERR_BAD_MAX_VERSIONS)
+		return err
+	}
+
+	if s.DeleteVersionAfter != "" {
+		_, err = parseVaultDuration(s.DeleteVersionAfter)
+		if err != nil {
+			err = errors.New(ERR_BAD_DELETE_VERSION_AFTER)
+			return err
+		}
+	}
+
+	return err
+}
+
+// MergeCustomMetadata overlays the managed metadata on what's already in Vault.  Managed keys that are no longer set are removed.  Everything else is kept.
+func MergeCustomMetadata(existing map[string]interface{}, managed map[string]string) (merged map[string]interface{}) {
+	merged = make(map[string]interface{})
+
+	for k, v := range existing {
+		if !stringInSlice(k, ManagedMetadataKeys) {
+			merged[k] = v
+		}
+	}
+
+	for k, v := range managed {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// ReadSecretMetadata reads the KV v2 metadata for a location.  Metadata will be nil if there's nothing there.
+func (km *KeyMaster) ReadSecretMetadata(location SecretLocation) (metadata map[string]interface{}, err error) {
+	path, err := location.MetadataPath()
+	if err != nil {
+		return metadata, err
+	}
+
+	s, err := km.VaultClient.Logical().Read(path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read metadata at %s", path)
+		return metadata, err
+	}
+
+	if s != nil {
+		metadata = s.Data
+	}
+
+	return metadata, err
+}
+
+// WriteSecretMetadata syncs the metadata of a Secret to each of its environments.
+func (km *KeyMaster) WriteSecretMetadata(secret *Secret, verbose bool) (err error) {
+	verboseOutput(verbose, "syncing metadata for secret %s", secret.Name)
+	for _, env := range secret.Environments {
+		location, err := km.SecretLocationFor(secret, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path")
+			return err
+		}
+
+		if location.KvVersion == KV_V1 {
+			verboseOutput(verbose, "  %s is kv v1.  No metadata to sync.", location.DataPath())
+			continue
+		}
+
+		_, data, err := km.metadataUpdate(secret, location)
+		if err != nil {
+			return err
+		}
+
+		if len(data) == 0 {
+			verboseOutput(verbose, "  metadata for env %s is current", env)
+			continue
+		}
+
+		path, err := location.MetadataPath()
+		if err != nil {
+			return err
+		}
+
+		verboseOutput(verbose, "  writing metadata to %s", path)
+
+		_, err = km.VaultClient.Logical().Write(path, data)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to write metadata to %s", path)
+			return err
+		}
+	}
+
+	return err
+}
+
+// metadataUpdate reads the metadata of a KV v2 location, and works out what has to be written to it for the Secret.  Data is empty if the metadata is current.
+func (km *KeyMaster) metadataUpdate(secret *Secret, location SecretLocation) (current map[string]interface{}, data map[string]interface{}, err error) {
+	current, err = km.ReadSecretMetadata(location)
+	if err != nil {
+		return current, data, err
+	}
+
+	data = make(map[string]interface{})
+
+	existing, _ := current["custom_metadata"].(map[string]interface{})
+	desired := MergeCustomMetadata(existing, secret.CustomMetadata())
+
+	if !(len(existing) == 0 && len(desired) == 0) && !reflect.DeepEqual(existing, desired) {
+		data["custom_metadata"] = desired
+	}
+
+	for k, v := range secret.VersionSettings() {
+		if !metadataSettingMatches(current[k], v) {
+			data[k] = v
+		}
+	}
+
+	return current, data, err
+}
+
+// AddCustomMetadata sets keys in the custom_metadata of a KV v2 location, leaving the other keys as they are.
+func (km *KeyMaster) AddCustomMetadata(location SecretLocation, values map[string]string) (err error) {
+	path, err := location.MetadataPath()
+	if err != nil {
+		return err
+	}
+
+	current, err := km.ReadSecretMetadata(location)
+	if err != nil {
+		return err
+	}
+
+	customMetadata := make(map[string]interface{})
+
+	existing, _ := current["custom_metadata"].(map[string]interface{})
+	for k, v := range existing {
+		customMetadata[k] = v
+	}
+
+	for k, v := range values {
+		customMetadata[k] = v
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, map[string]interface{}{"custom_metadata": customMetadata})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write metadata to %s", path)
+		return err
+	}
+
+	return err
+}
+
+// metadataSettingMatches compares a setting as read from Vault with the value keymaster would write.  Vault hands numbers back as json.Number, and durations in canonical form.
+func metadataSettingMatches(actual interface{}, desired interface{}) bool {
+	if actual == nil {
+		return false
+	}
+
+	switch d := desired.(type) {
+	case string:
+		a, ok := actual.(string)
+		if !ok {
+			return false
+		}
+
+		ad, err := parseVaultDuration(a)
+		if err != nil {
+			return a == d
+		}
+
+		dd, err := parseVaultDuration(d)
+		if err != nil {
+			return false
+		}
+
+		return ad == dd
+
+	default:
+		return fmt.Sprint(actual) == fmt.Sprint(desired)
+	}
+}
+
+// parseVaultDuration parses durations the way Vault does: either a go duration string, or a bare number of seconds.
+func parseVaultDuration(input string) (duration time.Duration, err error) {
+	seconds, err := strconv.Atoi(input)
+	if err == nil {
+		duration = time.Duration(seconds) * time.Second
+		return duration, err
+	}
+
+	return time.ParseDuration(input)
+}
@@ -0,0 +1,320 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeCustomMetadata(t *testing.T) {
+	inputs := []struct {
+		name     string
+		secret   *Secret
+		existing map[string]interface{}
+		out      map[string]interface{}
+	}{
+		{
+			"new",
+			&Secret{
+				Name:        "foo",
+				Description: "API key for the payment provider",
+				Owner:       "payments@scribd.com",
+				Tags:        []string{"pci", "third-party"},
+				Runbook:     "https://wiki.scribd.com/payments/rotate",
+			},
+			nil,
+			map[string]interface{}{
+				"description": "API key for the payment provider",
+				"owner":       "payments@scribd.com",
+				"tags":        "pci,third-party",
+				"runbook":     "https://wiki.scribd.com/payments/rotate",
+			},
+		},
+		{
+			"unmanaged-keys-kept",
+			&Secret{
+				Name:  "foo",
+				Owner: "payments@scribd.com",
+			},
+			map[string]interface{}{
+				"owner":      "someone-else@scribd.com",
+				"rotated_by": "jdoe",
+			},
+			map[string]interface{}{
+				"owner":      "payments@scribd.com",
+				"rotated_by": "jdoe",
+			},
+		},
+		{
+			"removed-fields-removed",
+			&Secret{
+				Name: "foo",
+			},
+			map[string]interface{}{
+				"description": "old description",
+				"tags":        "old",
+			},
+			map[string]interface{}{},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			merged := MergeCustomMetadata(tc.existing, tc.secret.CustomMetadata())
+			assert.True(t, reflect.DeepEqual(tc.out, merged), "merged metadata meets expectations")
+		})
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	secret := &Secret{
+		Name:        "foo",
+		Description: strings.Repeat("a", MAX_CUSTOM_METADATA_VALUE_LENGTH),
+	}
+
+	assert.True(t, secret.ValidateMetadata() == nil, "max length description is valid")
+
+	secret.Description += "a"
+
+	err := secret.ValidateMetadata()
+	assert.True(t, err != nil && err.Error() == ERR_METADATA_TOO_LONG, "overlong description is invalid")
+}
+
+func TestWriteSecretMetadata(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	inputs := []struct {
+		name   string
+		secret *Secret
+	}{
+		{
+			"kv-v2",
+			&Secret{
+				Name: "documented",
+				Team: "secret-team4",
+				GeneratorData: GeneratorData{
+					"type": "uuid",
+				},
+				Environments: []string{"production", "staging"},
+				Description:  "A documented secret",
+				Owner:        "security@scribd.com",
+				Tags:         []string{"audited"},
+			},
+		},
+		{
+			"kv-v1",
+			&Secret{
+				Name: "documented",
+				Team: "legacy-team1",
+				GeneratorData: GeneratorData{
+					"type": "uuid",
+				},
+				Environments: []string{"production", "staging"},
+				Description:  "A documented secret",
+			},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := km.NewGenerator(tc.secret.GeneratorData)
+			if err != nil {
+				log.Printf("Error creating generator: %s", err)
+				t.Fail()
+				return
+			}
+
+			tc.secret.SetGenerator(g)
+
+			err = km.WriteSecretIfBlank(tc.secret, true)
+			if err != nil {
+				log.Printf("Failed to write secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			before := make(map[string]interface{})
+
+			for _, env := range tc.secret.Environments {
+				location, err := km.SecretLocation(tc.secret.Team, tc.secret.Name, env)
+				if err != nil {
+					log.Printf("error creating location: %s", err)
+					t.Fail()
+					return
+				}
+
+				data, err := km.ReadSecretData(location)
+				if err != nil {
+					log.Printf("Failed to read secret: %s", err)
+					t.Fail()
+					return
+				}
+
+				before[env] = data["value"]
+			}
+
+			err = km.WriteSecretMetadata(tc.secret, true)
+			if err != nil {
+				log.Printf("Failed to write metadata: %s", err)
+				t.Fail()
+				return
+			}
+
+			for _, env := range tc.secret.Environments {
+				location, err := km.SecretLocation(tc.secret.Team, tc.secret.Name, env)
+				if err != nil {
+					log.Printf("error creating location: %s", err)
+					t.Fail()
+					return
+				}
+
+				data, err := km.ReadSecretData(location)
+				if err != nil {
+					log.Printf("Failed to read secret: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, before[env], data["value"], "writing metadata does not touch the value in %s", env)
+			}
+		})
+	}
+}
+
+func TestValidateVersionSettings(t *testing.T) {
+	inputs := []struct {
+		name   string
+		secret *Secret
+		out    string
+	}{
+		{
+			"unset",
+			&Secret{Name: "foo"},
+			"",
+		},
+		{
+			"good",
+			&Secret{Name: "foo", MaxVersions: 20, DeleteVersionAfter: "720h"},
+			"",
+		},
+		{
+			"seconds",
+			&Secret{Name: "foo", DeleteVersionAfter: "3600"},
+			"",
+		},
+		{
+			"negative-versions",
+			&Secret{Name: "foo", MaxVersions: -1},
+			ERR_BAD_MAX_VERSIONS,
+		},
+		{
+			"bad-duration",
+			&Secret{Name: "foo", DeleteVersionAfter: "a month"},
+			ERR_BAD_DELETE_VERSION_AFTER,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			errstr := ""
+			err := tc.secret.ValidateVersionSettings()
+			if err != nil {
+				errstr = err.Error()
+			}
+
+			assert.Equal(t, tc.out, errstr, "validation result meets expectations")
+		})
+	}
+}
+
+func TestWriteVersionSettings(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	casRequired := true
+
+	inputs := []struct {
+		name     string
+		secret   *Secret
+		versions string
+		cas      bool
+		after    string
+	}{
+		{
+			"rollback",
+			&Secret{
+				Name:               "rollback",
+				Team:               "secret-team4",
+				MaxVersions:        20,
+				CasRequired:        &casRequired,
+				DeleteVersionAfter: "720h",
+			},
+			"20",
+			true,
+			"720h0m0s",
+		},
+		{
+			"no-history",
+			&Secret{
+				Name:        "no-history",
+				Team:        "secret-team4",
+				MaxVersions: 1,
+			},
+			"1",
+			false,
+			"0s",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.secret.GeneratorData = GeneratorData{"type": "uuid"}
+			tc.secret.Environments = []string{"production", "staging"}
+
+			g, err := km.NewGenerator(tc.secret.GeneratorData)
+			if err != nil {
+				log.Printf("Error creating generator: %s", err)
+				t.Fail()
+				return
+			}
+
+			tc.secret.SetGenerator(g)
+
+			err = km.WriteSecretIfBlank(tc.secret, true)
+			if err != nil {
+				log.Printf("Failed to write secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			err = km.WriteSecretMetadata(tc.secret, true)
+			if err != nil {
+				log.Printf("Failed to write metadata: %s", err)
+				t.Fail()
+				return
+			}
+
+			for _, env := range tc.secret.Environments {
+				location, err := km.SecretLocation(tc.secret.Team, tc.secret.Name, env)
+				if err != nil {
+					log.Printf("error creating location: %s", err)
+					t.Fail()
+					return
+				}
+
+				metadata, err := km.ReadSecretMetadata(location)
+				if err != nil {
+					log.Printf("Failed to read metadata: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, tc.versions, fmt.Sprint(metadata["max_versions"]), "max_versions in %s", env)
+				assert.Equal(t, tc.cas, metadata["cas_required"], "cas_required in %s", env)
+				assert.Equal(t, tc.after, metadata["delete_version_after"], "delete_version_after in %s", env)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+	These functions load every Team of an organization together, so that references between Teams can be checked.
+
+	NewTeam only sees one Team, so it can only check the Secrets a Role uses from its own Team.  A Role that uses a Secret of another Team is taken on trust, and a typo makes a policy for a path that never exists.
+
+	The Org loader parses all the Team files, merging Teams that are spread across more than one (see merge.go), and then checks every cross Team reference against the Team that owns the Secret:
+
+	- the owning Team has to exist
+	- the Secret has to exist in the owning Team
+	- the Secret has to exist in every Environment the Role uses it in
+	- the owning Team has to have shared the Secret with the Role, in every Environment the Role uses it in.  See share.go.
+
+	Every problem found is reported at once, rather than one per run.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const ERR_INVALID_ORG = "invalid org config"
+const ERR_UNKNOWN_SECRET_TEAM = "role references a secret of a team that does not exist"
+const ERR_DANGLING_SECRET_REFERENCE = "role references a secret that does not exist"
+
+// Org Every Team of an organization, loaded together.
+type Org struct {
+	Teams    []*Team
+	TeamsMap map[string]*Team
+}
+
+// OrgError Every problem found loading an Org.
+type OrgError struct {
+	Problems []error
+}
+
+func (e *OrgError) Error() string {
+	lines := make([]string, 0)
+	for _, problem := range e.Problems {
+		lines = append(lines, fmt.Sprintf("  %s", problem))
+	}
+
+	return fmt.Sprintf("%s: %d problem(s)\n%s", ERR_INVALID_ORG, len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// NewOrg parses the config of each Team, and checks the references between them.  Configs for the same Team are merged.  Err will be an *OrgError listing every problem found.
+func (km *KeyMaster) NewOrg(data [][]byte, verbose bool) (org *Org, err error) {
+	teamFiles := make([]*TeamFile, 0)
+	for i, teamData := range data {
+		teamFiles = append(teamFiles, &TeamFile{Path: fmt.Sprintf("config %d", i+1), Data: teamData})
+	}
+
+	return km.NewOrgFromFiles(teamFiles, verbose)
+}
+
+// LoadOrg loads an Org from yaml files, and directories of them.
+func (km *KeyMaster) LoadOrg(files []string, verbose bool) (org *Org, err error) {
+	teamFiles, err := LoadTeamFiles(files, verbose)
+	if err != nil {
+		return org, err
+	}
+
+	return km.NewOrgFromFiles(teamFiles, verbose)
+}
+
+// CheckSecretReferences checks every Secret a Role uses from another Team against the Team that owns it, share grants included.  References to the old names of Secrets are pointed at the current ones, and the type of each Secret is filled in so policies grant the right path.  Returns every problem found.
+func (o *Org) CheckSecretReferences(verbose bool) (problems []error) {
+	renamed := make(map[PreviousSecret]*Secret)
+	for _, team := range o.Teams {
+		for _, secret := range team.Secrets {
+			for _, p := range secret.PreviousSecrets() {
+				renamed[p] = secret
+			}
+		}
+	}
+
+	for _, team := range o.Teams {
+		for _, role := range team.Roles {
+			for _, roleSecret := range role.Secrets {
+				if roleSecret.Team == team.Name {
+					continue
+				}
+
+				verboseOutput(verbose, "  checking role %s/%s secret %s/%s", team.Name, role.Name, roleSecret.Team, roleSecret.Name)
+
+				secret, ok := renamed[PreviousSecret{Team: roleSecret.Team, Name: roleSecret.Name}]
+				if ok {
+					verboseOutput(verbose, "  role %s/%s secret %s/%s is now %s/%s", team.Name, role.Name, roleSecret.Team, roleSecret.Name, secret.Team, secret.Name)
+					roleSecret.Team = secret.Team
+					roleSecret.Name = secret.Name
+				}
+
+				// renames can bring secrets back into the role's own team, which NewTeam has already checked
+				if roleSecret.Team == team.Name {
+					continue
+				}
+
+				owner, ok := o.TeamsMap[roleSecret.Team]
+				if !ok {
+					problems = append(problems, roleSecret.source.errorAt("team", errors.New(fmt.Sprintf("%s: role %s/%s uses %s/%s", ERR_UNKNOWN_SECRET_TEAM, team.Name, role.Name, roleSecret.Team, roleSecret.Name))))
+					continue
+				}
+
+				secret, ok = owner.SecretsMap[roleSecret.Name]
+				if !ok {
+					problems = append(problems, roleSecret.source.errorAt("name", errors.New(fmt.Sprintf("%s: role %s/%s uses %s/%s", ERR_DANGLING_SECRET_REFERENCE, team.Name, role.Name, roleSecret.Team, roleSecret.Name))))
+					continue
+				}
+
+				for _, env := range role.SecretEnvironments(roleSecret) {
+					if !stringInSlice(env, secret.Environments) {
+						problems = append(problems, roleSecret.source.errorAt("name", errors.New(fmt.Sprintf("%s: role %s/%s uses %s/%s in %s", ERR_SECRET_NOT_IN_ENVIRONMENT, team.Name, role.Name, roleSecret.Team, roleSecret.Name, env))))
+						continue
+					}
+
+					if !secret.IsSharedWith(team.Name, role.Name, env) {
+						problems = append(problems, roleSecret.source.errorAt("name", errors.New(fmt.Sprintf("%s: role %s/%s uses %s/%s in %s", ERR_SECRET_NOT_SHARED, team.Name, role.Name, roleSecret.Team, roleSecret.Name, env))))
+					}
+				}
+
+				if len(roleSecret.GeneratorData) == 0 {
+					roleSecret.GeneratorData = secret.GeneratorData
+				}
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,546 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+var orgOwnerTeam = `---
+name: owner
+secrets:
+  - name: shared
+    generator:
+      type: uuid
+    shared_with:
+      - team: consumer
+  - name: staging-only
+    environments:
+      - staging
+    generator:
+      type: uuid
+    shared_with:
+      - team: consumer
+  - name: new-name
+    previous_names:
+      - old-name
+    generator:
+      type: uuid
+    shared_with:
+      - team: consumer
+  - name: cert.scribd.com
+    generator:
+      type: tls
+      cn: cert.scribd.com
+    shared_with:
+      - team: consumer
+  - name: private
+    generator:
+      type: uuid
+  - name: other-role
+    generator:
+      type: uuid
+    shared_with:
+      - team: consumer
+        role: app2
+  - name: production-only-share
+    generator:
+      type: uuid
+    shared_with:
+      - team: consumer
+        role: app1
+        environments:
+          - production
+environments:
+  - production
+  - staging
+`
+
+func TestNewOrg(t *testing.T) {
+	inputs := []struct {
+		name  string
+		teams []string
+		errs  []string
+	}{
+		{
+			"good-org",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: shared
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			nil,
+		},
+		{
+			"unknown-team",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: shared
+        team: nobody
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_UNKNOWN_SECRET_TEAM},
+		},
+		{
+			"dangling-references",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: shraed
+        team: owner
+      - name: missing
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_DANGLING_SECRET_REFERENCE, ERR_DANGLING_SECRET_REFERENCE},
+		},
+		{
+			"secret-not-in-environment",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: staging-only
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_SECRET_NOT_IN_ENVIRONMENT},
+		},
+		{
+			"not-shared",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: private
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_SECRET_NOT_SHARED, ERR_SECRET_NOT_SHARED},
+		},
+		{
+			"shared-with-another-role",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: other-role
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_SECRET_NOT_SHARED, ERR_SECRET_NOT_SHARED},
+		},
+		{
+			"shared-in-another-environment",
+			[]string{
+				orgOwnerTeam,
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: production-only-share
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_SECRET_NOT_SHARED + ": role consumer/app1 uses owner/production-only-share in staging"},
+		},
+		{
+			"conflicting-team",
+			[]string{
+				orgOwnerTeam,
+				strings.Replace(orgOwnerTeam, "type: uuid", "type: hex", 1),
+			},
+			[]string{ERR_CONFLICTING_SECRET + ": owner/shared in config 1 and config 2"},
+		},
+		{
+			"bad-team",
+			[]string{
+				orgOwnerTeam,
+				"---\nname: broken\n",
+				`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: missing
+        team: owner
+environments:
+  - production
+  - staging
+`,
+			},
+			[]string{ERR_MISSING_ENVIRONMENTS, ERR_DANGLING_SECRET_REFERENCE},
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([][]byte, 0)
+			for _, team := range tc.teams {
+				data = append(data, []byte(team))
+			}
+
+			org, err := km.NewOrg(data, true)
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error creating org: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, 2, len(org.Teams), "all teams loaded")
+				return
+			}
+
+			orgErr, ok := err.(*OrgError)
+			if !ok {
+				log.Printf("Expected an org error, got %v", err)
+				t.Fail()
+				return
+			}
+
+			assert.True(t, strings.HasPrefix(orgErr.Error(), ERR_INVALID_ORG), "org errors say what they are")
+
+			if len(orgErr.Problems) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), orgErr)
+				t.Fail()
+				return
+			}
+
+			for i, problem := range orgErr.Problems {
+				assert.True(t, strings.Contains(problem.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], problem)
+			}
+		})
+	}
+}
+
+func TestOrgResolvesReferences(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	data := [][]byte{
+		[]byte(orgOwnerTeam),
+		[]byte(`---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: old-name
+        team: owner
+      - name: cert.scribd.com
+        team: owner
+environments:
+  - production
+  - staging
+`),
+	}
+
+	org, err := km.NewOrg(data, true)
+	if err != nil {
+		log.Printf("Error creating org: %s", err)
+		t.Fail()
+		return
+	}
+
+	role := org.TeamsMap["consumer"].RolesMap["app1"]
+
+	policy, err := km.MakePolicyPayload(role, "production")
+	if err != nil {
+		log.Printf("Error creating policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	paths := policy["path"].(map[string]interface{})
+
+	_, ok := paths["owner/data/new-name/production"]
+	assert.True(t, ok, "renamed secrets of other teams are read at their new path")
+
+	_, ok = paths["owner/data/certs/cert.scribd.com/production"]
+	assert.True(t, ok, "tls secrets of other teams are read at their cert path")
+}
+
+func TestLoadOrg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keymaster")
+	if err != nil {
+		log.Printf("Error creating temp dir: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"owner.yml": orgOwnerTeam,
+		"consumer.yml": `---
+name: consumer
+secrets:
+  - name: local
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: local
+      - name: shared
+        team: owner
+environments:
+  - production
+  - staging
+`,
+	} {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Printf("Failed writing %s: %s", name, err)
+			t.Fail()
+			return
+		}
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	org, err := km.LoadOrg([]string{dir}, true)
+	if err != nil {
+		log.Printf("Error loading org: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, 2, len(org.Teams), "loaded every team in the directory")
+}
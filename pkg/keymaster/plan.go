@@ -0,0 +1,608 @@
+/*
+	These functions plan the configuration of a Team, without touching Vault.
+
+	PlanTeam() reads what's in Vault now: the Secrets' values and metadata, the policies in sys/policy, and the k8s, IAM and TLS auth roles.  It works out what ConfigureTeam() would do to each of them, and says whether it would be created, changed, or left alone, with what each changed field is now, and what it would become.
+
+		Plan for team team1: 2 to create, 1 to change, 3 unchanged
+
+		+ secret team1/data/foo/production
+		~ policy sys/policy/team1-app1-production
+		    path "team1/data/foo/production": (none) -> {"capabilities":["read"]}
+		    path "team1/metadata/foo/production": (none) -> {"capabilities":["read"]}
+		  k8s-auth auth/k8s-alpha/role/team1-app1
+
+	Secret values are never part of a plan.  A Secret only says whether a value would be generated, seeded, or copied from where it used to be.
+
+	ConfigureTeam() leaves auth roles alone once they grant the Role's policy, even if their principals have since changed.  The plan says so: such a role is unchanged, with a note, and the fields that differ from what keymaster would write.
+
+	Plans are also JSON, for tools that want to act on them.
+
+*/
+package keymaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const PLAN_CREATE = "create"
+const PLAN_UPDATE = "update"
+const PLAN_NONE = "none"
+
+const PLAN_KIND_SECRET = "secret"
+const PLAN_KIND_METADATA = "metadata"
+const PLAN_KIND_POLICY = "policy"
+const PLAN_KIND_K8S_AUTH = "k8s-auth"
+const PLAN_KIND_IAM_AUTH = "iam-auth"
+const PLAN_KIND_TLS_AUTH = "tls-auth"
+
+const NOTE_AUTH_DRIFT = "already grants the policy, so it isn't rewritten"
+
+// planSymbols how each action is marked in a human readable plan.
+var planSymbols = map[string]string{
+	PLAN_CREATE: "+",
+	PLAN_UPDATE: "~",
+	PLAN_NONE:   " ",
+}
+
+// Plan What configuring a Team would do to Vault.
+type Plan struct {
+	Team    string        `json:"team"`
+	Changes []*PlanChange `json:"changes"`
+	Stale   []string      `json:"stale,omitempty"` // old paths of renamed Secrets that can be destroyed once nothing reads them
+}
+
+// PlanChange What configuring a Team would do to one thing in Vault.
+type PlanChange struct {
+	Kind   string       `json:"kind"`
+	Path   string       `json:"path"`
+	Action string       `json:"action"`
+	Note   string       `json:"note,omitempty"`
+	Fields []*FieldDiff `json:"fields,omitempty"`
+}
+
+// FieldDiff A field that differs between Vault and what keymaster would write.  Current is nil if Vault doesn't have it, Desired is nil if keymaster would remove it.
+type FieldDiff struct {
+	Field   string      `json:"field"`
+	Current interface{} `json:"current"`
+	Desired interface{} `json:"desired"`
+}
+
+// authPlan tracks an auth role across the Realms that add policies to it, as ConfigureTeam would write it each time.
+type authPlan struct {
+	change  *PlanChange
+	current map[string]interface{}
+	granted []string
+	written bool
+	data    func(policies []string) (data map[string]interface{}, err error)
+}
+
+// PlanTeam works out what ConfigureTeam would do for the Team, by reading Vault.  Nothing is written.
+func (km *KeyMaster) PlanTeam(team *Team, verbose bool) (plan *Plan, err error) {
+	plan = &Plan{Team: team.Name, Changes: make([]*PlanChange, 0)}
+
+	verboseOutput(verbose, "--- Planning team %s ---", team.Name)
+	for _, secret := range team.Secrets {
+		verboseOutput(verbose, "  planning secret %s", secret.Name)
+		err = km.planSecret(plan, secret)
+		if err != nil {
+			err = errors.Wrapf(err, "failed planning secret %s for team %s", secret.Name, secret.Team)
+			return plan, err
+		}
+	}
+
+	policies := make(map[string]bool)
+	auths := make(map[string]*authPlan)
+	authOrder := make([]string, 0)
+
+	// addPolicy plans adding a policy to an auth role, the way the Add*Role functions do it
+	addPolicy := func(kind string, path string, policy VaultPolicy, read func() (map[string]interface{}, error), data func(policies []string) (map[string]interface{}, error)) (err error) {
+		auth, ok := auths[path]
+		if !ok {
+			current, err := read()
+			if err != nil {
+				return err
+			}
+
+			auth = &authPlan{
+				change:  &PlanChange{Kind: kind, Path: path, Action: PLAN_NONE},
+				current: current,
+				granted: grantedPolicies(current),
+				data:    data,
+			}
+
+			auths[path] = auth
+			authOrder = append(authOrder, path)
+		}
+
+		if stringInSlice(policy.Name, auth.granted) {
+			return err
+		}
+
+		auth.granted = append(auth.granted, policy.Name)
+		auth.written = true
+		auth.data = data
+
+		return err
+	}
+
+	for _, role := range team.Roles {
+		verboseOutput(verbose, "  planning role %s", role.Name)
+		if role.Team == "" {
+			err = errors.New("Role without a Team!")
+			return plan, err
+		}
+
+		for _, realm := range role.Realms {
+			role := role
+			realm := realm
+			env := realm.Environment
+
+			policy, err := km.NewPolicy(role, env)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to create policy")
+				return plan, err
+			}
+
+			if !policies[policy.Path] {
+				policies[policy.Path] = true
+
+				change, err := km.planPolicy(policy)
+				if err != nil {
+					err = errors.Wrapf(err, "failed planning policy %q for role %q in env %q", policy.Name, role.Name, env)
+					return plan, err
+				}
+
+				plan.Changes = append(plan.Changes, change)
+			}
+
+			switch realm.Type {
+			case K8S:
+				for _, cluster := range realm.Identifiers {
+					k8sCluster, ok := km.K8sClustersByName[cluster]
+					if !ok {
+						err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_K8S_CLUSTER, cluster))
+						return plan, err
+					}
+
+					path, err := km.K8sAuthPath(k8sCluster, role)
+					if err != nil {
+						err = errors.Wrapf(err, "failed building k8s auth path")
+						return plan, err
+					}
+
+					err = addPolicy(PLAN_KIND_K8S_AUTH, path, policy,
+						func() (map[string]interface{}, error) { return km.ReadK8sAuth(k8sCluster, role) },
+						func(policies []string) (map[string]interface{}, error) {
+							return km.k8sAuthData(k8sCluster, realm, policies), nil
+						})
+					if err != nil {
+						err = errors.Wrapf(err, "failed to plan K8S Auth for role:%q policy:%q cluster:%q env:%q", role.Name, policy.Name, cluster, env)
+						return plan, err
+					}
+				}
+
+			case TLS:
+				path, err := km.TlsAuthPath(role, env)
+				if err != nil {
+					err = errors.Wrapf(err, "failed to create tls auth path")
+					return plan, err
+				}
+
+				err = addPolicy(PLAN_KIND_TLS_AUTH, path, policy,
+					func() (map[string]interface{}, error) { return km.ReadTlsAuth(role, env) },
+					func(policies []string) (map[string]interface{}, error) { return km.tlsAuthData(role, env, policies) })
+				if err != nil {
+					err = errors.Wrapf(err, "failed to plan TLS auth for role: %q policy: %q env: %q", role.Name, policy.Name, env)
+					return plan, err
+				}
+
+			case IAM:
+				path, err := km.IamAuthPath(role)
+				if err != nil {
+					err = errors.Wrapf(err, "failed building iam auth path")
+					return plan, err
+				}
+
+				err = addPolicy(PLAN_KIND_IAM_AUTH, path, policy,
+					func() (map[string]interface{}, error) { return km.ReadIamAuth(role) },
+					func(policies []string) (map[string]interface{}, error) { return iamAuthData(realm, policies), nil })
+				if err != nil {
+					err = errors.Wrapf(err, "failed to plan IAM auth for role: %q policy: %q env: %q", role.Name, policy.Name, env)
+					return plan, err
+				}
+
+			default:
+				err = errors.New(fmt.Sprintf("unsupported realm %q", realm.Type))
+				return plan, err
+			}
+		}
+	}
+
+	for _, path := range authOrder {
+		auth := auths[path]
+
+		desired, err := auth.data(auth.granted)
+		if err != nil {
+			return plan, err
+		}
+
+		auth.change.Fields = authDiffs(auth.current, desired)
+
+		switch {
+		case auth.written && auth.current == nil:
+			auth.change.Action = PLAN_CREATE
+		case auth.written:
+			auth.change.Action = PLAN_UPDATE
+		case len(auth.change.Fields) > 0:
+			auth.change.Note = NOTE_AUTH_DRIFT
+		}
+
+		plan.Changes = append(plan.Changes, auth.change)
+	}
+
+	return plan, err
+}
+
+// planSecret plans the values and metadata of a Secret in each of its Environments, as MigrateSecret, WriteSecretIfBlank and WriteSecretMetadata would write them.
+func (km *KeyMaster) planSecret(plan *Plan, secret *Secret) (err error) {
+	previous := secret.PreviousSecrets()
+
+	for _, env := range secret.Environments {
+		location, err := km.SecretLocationFor(secret, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path")
+			return err
+		}
+
+		data, _, err := km.ReadSecretVersion(location)
+		if err != nil {
+			return err
+		}
+
+		change := &PlanChange{Kind: PLAN_KIND_SECRET, Path: location.DataPath(), Action: PLAN_NONE}
+
+		// renamed secrets are copied from the first old location with a value
+		var migrateFrom string
+		if len(previous) > 0 || secret.IsTls() {
+			oldLocations, err := km.previousLocations(secret, previous, env)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to create secret path")
+				return err
+			}
+
+			for _, oldLocation := range oldLocations {
+				oldData, err := km.ReadSecretData(oldLocation)
+				if err != nil {
+					return err
+				}
+
+				if oldData == nil {
+					continue
+				}
+
+				plan.Stale = append(plan.Stale, oldLocation.DataPath())
+
+				if migrateFrom == "" && !secretDataIsBlank(oldData) {
+					migrateFrom = oldLocation.DataPath()
+				}
+			}
+		}
+
+		switch {
+		case data != nil && !secretDataIsBlank(data):
+			// it has a value already
+		case migrateFrom != "":
+			change.Action = PLAN_CREATE
+			if data != nil {
+				change.Action = PLAN_UPDATE
+			}
+			change.Note = fmt.Sprintf("copied from %s", migrateFrom)
+		case data == nil:
+			// rsa secrets can't be stored yet
+			if secret.GeneratorData["type"] != "rsa" {
+				change.Action = PLAN_CREATE
+				change.Note = "value generated"
+			}
+		case km.StaticSecretIsBlank(secret, env, data):
+			change.Action = PLAN_UPDATE
+			change.Note = "value seeded from static secrets"
+		}
+
+		plan.Changes = append(plan.Changes, change)
+
+		if location.KvVersion == KV_V1 {
+			continue
+		}
+
+		current, update, err := km.metadataUpdate(secret, location)
+		if err != nil {
+			return err
+		}
+
+		if current == nil && len(update) == 0 {
+			continue
+		}
+
+		path, err := location.MetadataPath()
+		if err != nil {
+			return err
+		}
+
+		metadata := &PlanChange{Kind: PLAN_KIND_METADATA, Path: path, Action: PLAN_NONE}
+
+		if len(update) > 0 {
+			metadata.Action = PLAN_UPDATE
+			if current == nil {
+				metadata.Action = PLAN_CREATE
+			}
+		}
+
+		for _, k := range sortedFields(update) {
+			if k == "custom_metadata" {
+				existing, _ := current["custom_metadata"].(map[string]interface{})
+				desired, _ := update[k].(map[string]interface{})
+				metadata.Fields = append(metadata.Fields, mapDiffs("custom_metadata.", existing, desired)...)
+				continue
+			}
+
+			metadata.Fields = append(metadata.Fields, &FieldDiff{Field: k, Current: current[k], Desired: update[k]})
+		}
+
+		plan.Changes = append(plan.Changes, metadata)
+	}
+
+	return err
+}
+
+// planPolicy compares a policy with the one in Vault.
+func (km *KeyMaster) planPolicy(policy VaultPolicy) (change *PlanChange, err error) {
+	change = &PlanChange{Kind: PLAN_KIND_POLICY, Path: policy.Path, Action: PLAN_NONE}
+
+	current, err := km.ReadPolicyFromVault(policy.Path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read policy %s", policy.Path)
+		return change, err
+	}
+
+	// the payload goes through json, so it compares with what's read back
+	jsonBytes, err := json.Marshal(policy.Payload)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal payload for %s", policy.Name)
+		return change, err
+	}
+
+	desired := make(map[string]interface{})
+	err = json.Unmarshal(jsonBytes, &desired)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to unmarshal payload for %s", policy.Name)
+		return change, err
+	}
+
+	if current.Payload == nil {
+		change.Action = PLAN_CREATE
+	} else if !reflect.DeepEqual(current.Payload, desired) {
+		change.Action = PLAN_UPDATE
+	}
+
+	currentPaths, _ := current.Payload["path"].(map[string]interface{})
+	desiredPaths, _ := desired["path"].(map[string]interface{})
+
+	for _, diff := range mapDiffs("", currentPaths, desiredPaths) {
+		diff.Field = fmt.Sprintf("path %q", diff.Field)
+		change.Fields = append(change.Fields, diff)
+	}
+
+	return change, err
+}
+
+// authDiffs compares the fields keymaster writes to an auth role with what Vault has.  Vault reads lists back for comma separated strings, and may name fields with a token_ prefix.
+func authDiffs(current map[string]interface{}, desired map[string]interface{}) (diffs []*FieldDiff) {
+	for _, k := range sortedFields(desired) {
+		want := authValue(desired[k])
+
+		var have interface{}
+		if current != nil {
+			have = current[k]
+			if have == nil {
+				have = current["token_"+k]
+			}
+		}
+
+		if authValueMatches(have, want) {
+			continue
+		}
+
+		diffs = append(diffs, &FieldDiff{Field: k, Current: have, Desired: want})
+	}
+
+	return diffs
+}
+
+// authValue puts a value keymaster writes to an auth role in the form Vault reads it back in.  Comma separated strings are lists.
+func authValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case string:
+		if strings.Contains(v, "\n") || !strings.Contains(v, ",") && v != "" {
+			return v
+		}
+
+		list := make([]string, 0)
+		for _, item := range strings.Split(v, ",") {
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+
+		return list
+	}
+
+	return value
+}
+
+// authValueMatches compares a value read from an auth role with one keymaster would write.  Lists are compared without regard to order, as Vault sorts some of them.
+func authValueMatches(current interface{}, desired interface{}) bool {
+	switch d := desired.(type) {
+	case []string:
+		have := make([]string, 0)
+		switch c := current.(type) {
+		case []interface{}:
+			for _, item := range c {
+				have = append(have, fmt.Sprint(item))
+			}
+		case string:
+			// a single value may come back bare
+			if c != "" {
+				have = append(have, c)
+			}
+		case nil:
+		default:
+			return false
+		}
+
+		want := append([]string{}, d...)
+		sort.Strings(have)
+		sort.Strings(want)
+
+		return len(have) == len(want) && (len(want) == 0 || reflect.DeepEqual(have, want))
+
+	case string:
+		switch c := current.(type) {
+		case string:
+			return strings.TrimSpace(c) == strings.TrimSpace(d)
+		case []interface{}:
+			return len(c) == 1 && fmt.Sprint(c[0]) == d
+		}
+
+		return false
+	}
+
+	return fmt.Sprint(current) == fmt.Sprint(desired)
+}
+
+// mapDiffs lists the keys whose values differ between two maps.
+func mapDiffs(prefix string, current map[string]interface{}, desired map[string]interface{}) (diffs []*FieldDiff) {
+	keys := make(map[string]interface{})
+	for k := range current {
+		keys[k] = true
+	}
+
+	for k := range desired {
+		keys[k] = true
+	}
+
+	for _, k := range sortedFields(keys) {
+		if reflect.DeepEqual(current[k], desired[k]) {
+			continue
+		}
+
+		diffs = append(diffs, &FieldDiff{Field: prefix + k, Current: current[k], Desired: desired[k]})
+	}
+
+	return diffs
+}
+
+// sortedFields returns the keys of a map in order.
+func sortedFields(m map[string]interface{}) (keys []string) {
+	keys = make([]string, 0)
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Counts returns how many things the Plan would create, change, and leave alone.
+func (p *Plan) Counts() (create int, update int, none int) {
+	for _, change := range p.Changes {
+		switch change.Action {
+		case PLAN_CREATE:
+			create++
+		case PLAN_UPDATE:
+			update++
+		default:
+			none++
+		}
+	}
+
+	return create, update, none
+}
+
+// HasChanges returns true if configuring the Team would write anything.
+func (p *Plan) HasChanges() bool {
+	create, update, _ := p.Counts()
+
+	return create+update > 0
+}
+
+// JSON returns the Plan as indented JSON.
+func (p *Plan) JSON() (data []byte, err error) {
+	data, err = json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal plan for team %s", p.Team)
+		return data, err
+	}
+
+	return data, err
+}
+
+// String returns the Plan for a human to read.
+func (p *Plan) String() string {
+	create, update, none := p.Counts()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for team %s: %d to create, %d to change, %d unchanged\n", p.Team, create, update, none)
+
+	if len(p.Changes) > 0 {
+		b.WriteString("\n")
+	}
+
+	for _, change := range p.Changes {
+		fmt.Fprintf(&b, "%s %s %s", planSymbols[change.Action], change.Kind, change.Path)
+		if change.Note != "" {
+			fmt.Fprintf(&b, " (%s)", change.Note)
+		}
+		b.WriteString("\n")
+
+		for _, field := range change.Fields {
+			fmt.Fprintf(&b, "    %s: %s -> %s\n", field.Field, planValue(field.Current), planValue(field.Desired))
+		}
+	}
+
+	if len(p.Stale) > 0 {
+		b.WriteString("\nStale secret paths, that can be destroyed once nothing reads them:\n")
+		for _, path := range p.Stale {
+			fmt.Fprintf(&b, "  %s\n", path)
+		}
+	}
+
+	return b.String()
+}
+
+// planValue shows a field's value on one line.  Long values, like certificates, are cut short.
+func planValue(value interface{}) string {
+	if value == nil {
+		return "(none)"
+	}
+
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	// runes, not bytes, so a long value isn't cut in the middle of a character
+	text := []rune(string(jsonBytes))
+	if len(text) > 60 {
+		return string(text[:57]) + "..."
+	}
+
+	return string(text)
+}
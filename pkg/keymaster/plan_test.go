@@ -0,0 +1,228 @@
+package keymaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var planTeam = `---
+name: team4
+secrets:
+  - name: planned
+    max_versions: 3
+    generator:
+      type: alpha
+      length: 16
+  - name: planned-extra
+    generator:
+      type: hex
+      length: 8
+roles:
+  - name: planner
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - planner
+        environment: production
+      - type: iam
+        principals:
+          - arn:aws:iam::888888888888:role/planner-*
+        environment: production
+      - type: tls
+        principals:
+          - planner.scribd.com
+        environment: production
+    secrets:
+      - name: planned
+environments:
+  - production
+`
+
+// planAuthCA a CA certificate for TLS auth to trust.
+const planAuthCA = "-----BEGIN CERTIFICATE-----\nMIIF/jCCA+agAwIBAgIJALblM1q8ZozAMA0GCSqGSIb3DQEBCwUAMIGZMQswCQYD\nVQQGEwJVUzELMAkGA1UECAwCQ0ExFjAUBgNVBAcMDVNhbiBGcmFuY2lzY28xFDAS\nBgNVBAoMC1NjcmliZCBJbmMuMREwDwYDVQQLDAhPcHMgVGVhbTEdMBsGA1UEAwwU\nU2NyaWJkIEluYy4gUm9vdCBDQSAxHTAbBgkqhkiG9w0BCQEWDm9wc0BzY3JpYmQu\nY29tMB4XDTE4MDYwNzIxNTkyOFoXDTI4MDYwNDIxNTkyOFowezELMAkGA1UEBhMC\nVVMxCzAJBgNVBAgMAkNBMRQwEgYDVQQKDAtTY3JpYmQgSW5jLjERMA8GA1UECwwI\nT3BzIFRlYW0xFzAVBgNVBAMMDlNjcmliZCBIb3N0IENBMR0wGwYJKoZIhvcNAQkB\nFg5vcHNAc2NyaWJkLmNvbTCCAiIwDQYJKoZIhvcNAQEBBQADggIPADCCAgoCggIB\nAKwHZntYHGHLZ1Dzfd13GVJUfZryAicZg97Y5ALkqw87bLwBqY8K5kPmrpq4Vd2K\nwiizUQ0fHNCSZCuwDbUZQSiXIGCjFGISY0E+VVJo3as3fkcUaB6edUkBEzQDa3Jp\nIeRpM00x/jBpoKMAKGq3CZvQ3KIxZNvnFZr2t90ok+u988I89fi0wStco1A5UmE4\nlVyD7gkZGbMdLjUyIeDjtRIR8iGb6vDzljZ44CYd6LctEDZEmRAI7XDnt7/lzv29\nyaOoHaoZwgw7NzRLHC1EFJMnVT9dG9/pdO2Fgf3olAx0tZB0FSuBReTsDQmadSc1\nRXtwNeRJdjdHBTKEXrjepnYtk+fZnP2UEHUY/cHPwGk0slYHHA5pVIDkezD49D82\nO8hc6dLz6eUEBOtthZkeoFNe5+HStRs0ZYXLW/7Euiy9KBzk4NQ8RcJkcdafvCjF\nRvnJORnn2KR1ydVKXscCHplvJL3CR9erAOOQ2zlNxuL9ZAU/FBHy1eYwWz3OFJSQ\n1G5sZljE2G0nXYiPgKwUubR0JZnT3sh7SPps+xjMsOZpdhcgTSrlJuTPZURU2D6y\nyWuAiDONLavBayNel2Xe5U+Se8St4+86okh4E5kM2gnOfI6h2oRlZ+ClDwcnNyV2\nZzvWrPvTR+mPEN7KTh6kTzbDLEcWYmPUN5K+N9sHnKlRAgMBAAGjZjBkMB0GA1Ud\nDgQWBBSw8n2IHR4S2SmNm03l2x0ZyU8pkzAfBgNVHSMEGDAWgBRxanincb6eDh6h\nVLfN7zzjS/8GXTASBgNVHRMBAf8ECDAGAQH/AgEAMA4GA1UdDwEB/wQEAwIBhjAN\nBgkqhkiG9w0BAQsFAAOCAgEAJf3/rif8W3YQLOtR5MTcskxcv9WLj7EgDjT+AvQ3\n8POHE+fUz8u4TQ6811CqGHgfm12OXaoC/oWWY6T382WVguUxgBEOES4H5BnCY2ts\n+WY5OCE7vttVS3Q7A9W0XrMtnUN2KdhLplpPxcchzb8+Ulv4ysEvvzr9qy9UUpVd\nuLZAWL55WI1rF5rdPjkxDd/Zg3MTrqyNHvXYUjBFGfbU9+WJ0t1C8vWSIAX471ij\nOJyysNESz83ZBSZbifwEOmMU3IQHixjGhmS3gYX9qZrjd/i5R/8N5qcLdYDOFMoG\nn2M23HwADdZfVGMQX9nZEqV5y07Q2JoD1CRpbTePPB2RPSFbUGKMFQZj5KJQSW0r\n2shuAVUjjEbR6NA1iMrFBN8fxXHh7oMe+8aA51sX3RtDnzr9+TGpdEoDAdPdKVvu\nSka7woQCqBDfrZ4FFBFCApoicoZeozCeWcexFgO1USOYm/v1/gp2ikstHSSEm1j+\nPDpCMveI+puZxQhgUvc8OCHrfcBEHkUMEzZ18Q2w9ekTNbqBeQt3nuUdi2D7JOuI\nD3DrzKG87DxZjnjOqvhp2Alq84UParOejEk4+iS1hgLApVf8nMeThoXRKUEOF7KY\nHzMKYQXmTRJV3jB1uD/1ibA9MpMVEbNN3yjPvY6wmCE3ydOBC3/XQgcooez8af7w\n8no=\n-----END CERTIFICATE-----"
+
+// planActions maps the kind and path of each change in a Plan to its action.
+func planActions(plan *Plan) (actions map[string]string) {
+	actions = make(map[string]string)
+	for _, change := range plan.Changes {
+		actions[fmt.Sprintf("%s %s", change.Kind, change.Path)] = change.Action
+	}
+
+	return actions
+}
+
+func TestPlanTeam(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetK8sClusters([]*Cluster{{Name: "alpha", Environment: "production"}})
+	km.SetTlsAuthCaCert(planAuthCA)
+
+	team, err := km.NewTeam([]byte(planTeam), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	// nothing there yet
+	plan, err := km.PlanTeam(team, false)
+	if err != nil {
+		log.Printf("Error planning team: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := map[string]string{
+		"secret team4/data/planned/production":              PLAN_CREATE,
+		"metadata team4/metadata/planned/production":        PLAN_CREATE,
+		"secret team4/data/planned-extra/production":        PLAN_CREATE,
+		"policy sys/policy/team4-planner-production":        PLAN_CREATE,
+		"k8s-auth auth/k8s-alpha/role/team4-planner":        PLAN_CREATE,
+		"iam-auth auth/aws/role/team4-planner":              PLAN_CREATE,
+		"tls-auth auth/cert/certs/team4-planner-production": PLAN_CREATE,
+	}
+
+	assert.Equal(t, expected, planActions(plan), "everything is created")
+	assert.True(t, plan.HasChanges(), "a new team has changes")
+
+	secret, _, err := km.ReadSecretVersion(SecretLocation{Mount: "team4", Path: "planned/production", KvVersion: KV_V2})
+	assert.True(t, err == nil && secret == nil, "planning writes nothing")
+
+	// configured, there's nothing left to do
+	_, err = km.ConfigureTeam(team, false)
+	if err != nil {
+		log.Printf("Error configuring team: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer func() {
+		_ = km.DeleteK8sAuth(km.K8sClustersByName["alpha"], team.RolesMap["planner"])
+		_ = km.DeleteIamAuth(team.RolesMap["planner"])
+		_ = km.DeleteTlsAuth(team.RolesMap["planner"], "production")
+		_ = km.DeletePolicyFromVault("sys/policy/team4-planner-production")
+	}()
+
+	plan, err = km.PlanTeam(team, false)
+	if err != nil {
+		log.Printf("Error planning team: %s", err)
+		t.Fail()
+		return
+	}
+
+	for _, change := range plan.Changes {
+		assert.Equal(t, PLAN_NONE, change.Action, "%s %s is unchanged", change.Kind, change.Path)
+		assert.Empty(t, change.Fields, "%s %s matches vault", change.Kind, change.Path)
+	}
+
+	assert.False(t, plan.HasChanges(), "a configured team has no changes")
+
+	// a role reading another secret changes its policy, and a new principal drifts from the auth role that already grants it
+	changed := strings.Replace(strings.Replace(planTeam, "      - name: planned\n", "      - name: planned\n      - name: planned-extra\n", 1), "          - planner\n", "          - planner\n          - planner-canary\n", 1)
+
+	team, err = km.NewTeam([]byte(changed), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	plan, err = km.PlanTeam(team, false)
+	if err != nil {
+		log.Printf("Error planning team: %s", err)
+		t.Fail()
+		return
+	}
+
+	changes := make(map[string]*PlanChange)
+	for _, change := range plan.Changes {
+		changes[change.Path] = change
+	}
+
+	policy := changes["sys/policy/team4-planner-production"]
+	if assert.NotNil(t, policy, "policy is planned") {
+		assert.Equal(t, PLAN_UPDATE, policy.Action, "policy changes")
+		if assert.Equal(t, 2, len(policy.Fields), "the secret's data and metadata paths are added") {
+			assert.Equal(t, `path "team4/data/planned-extra/production"`, policy.Fields[0].Field, "the new path is named")
+			assert.Nil(t, policy.Fields[0].Current, "the path isn't granted now")
+			assert.Equal(t, `path "team4/metadata/planned-extra/production"`, policy.Fields[1].Field, "the new path is named")
+		}
+	}
+
+	auth := changes["auth/k8s-alpha/role/team4-planner"]
+	if assert.NotNil(t, auth, "k8s auth is planned") {
+		assert.Equal(t, PLAN_NONE, auth.Action, "an auth role that grants the policy isn't rewritten")
+		assert.Equal(t, NOTE_AUTH_DRIFT, auth.Note, "drift is noted")
+		if assert.Equal(t, 1, len(auth.Fields), "principals drift") {
+			assert.Equal(t, "bound_service_account_namespaces", auth.Fields[0].Field, "drifted field is named")
+			assert.Equal(t, []string{"planner", "planner-canary"}, auth.Fields[0].Desired, "drift shows what keymaster would write")
+		}
+	}
+
+	text := plan.String()
+	assert.True(t, strings.HasPrefix(text, "Plan for team team4: 0 to create, 1 to change, 7 unchanged\n"), "plan is summarised.  got %q", text)
+	assert.Contains(t, text, "~ policy sys/policy/team4-planner-production\n    path \"team4/data/planned-extra/production\": (none) -> {\"capabilities\":[\"read\"]}\n", "changes are shown")
+
+	jsonBytes, err := plan.JSON()
+	if err != nil {
+		log.Printf("Error marshalling plan: %s", err)
+		t.Fail()
+		return
+	}
+
+	var decoded Plan
+	err = json.Unmarshal(jsonBytes, &decoded)
+	assert.Nil(t, err, "plan is json")
+	assert.Equal(t, len(plan.Changes), len(decoded.Changes), "json has every change")
+}
+
+func TestAuthValueMatches(t *testing.T) {
+	inputs := []struct {
+		name    string
+		current interface{}
+		desired interface{}
+		match   bool
+	}{
+		{"comma-list", []interface{}{"b", "a"}, "a,b", true},
+		{"single", []interface{}{"default"}, "default", true},
+		{"empty-list", []interface{}{}, []string{}, true},
+		{"empty-string", nil, "", true},
+		{"missing", nil, "a", false},
+		{"different", []interface{}{"a"}, "a,b", false},
+		{"policies", []interface{}{"default", "team-app"}, []string{"team-app", "default"}, true},
+		{"certificate", "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n", "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----", true},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.match, authValueMatches(tc.current, authValue(tc.desired)), "values compare")
+		})
+	}
+}
+
+func TestPlanValue(t *testing.T) {
+	inputs := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"nil", nil, "(none)"},
+		{"short", "foo", `"foo"`},
+		{"long", strings.Repeat("a", 70), `"` + strings.Repeat("a", 56) + "..."},
+		{"multibyte", strings.Repeat("é", 70), `"` + strings.Repeat("é", 56) + "..."},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			got := planValue(tc.value)
+			assert.Equal(t, tc.want, got, "value is shown")
+			assert.True(t, utf8.ValidString(got), "value is cut between characters")
+		})
+	}
+}
@@ -73,7 +73,7 @@ func (km *KeyMaster) NewPolicy(role *Role, env string) (policy VaultPolicy, err
 	return policy, err
 }
 
-// MakePolicyPayload is the access policy to a specific secret path.  Policy Payloads give access to a single path, wildcards are not supported.
+// MakePolicyPayload is the access policy to a specific secret path.  Policy Payloads give access to a single path, wildcards are not supported.  Secrets on KV v2 mounts get read access to their metadata path as well.
 /* example policy:  We will only ever set 'read'.
 {
   "path": {  # alphabetical by key
@@ -89,16 +89,31 @@ func (km *KeyMaster) MakePolicyPayload(role *Role, env string) (policy map[strin
 	policy = make(map[string]interface{})
 	pathElem := make(map[string]interface{})
 
-	for _, secret := range role.Secrets {
-		secretPath, err := km.SecretPath(secret.Team, secret.Name, env)
+	for _, secret := range role.SecretsForEnv(env) {
+		locations, err := km.roleSecretLocations(role, secret, env)
 		if err != nil {
 			err = errors.Wrapf(err, "failed to create secret path for %s role %s", secret.Name, role.Name)
 			return policy, err
 		}
 
-		caps := []interface{}{"read"}
-		pathPolicy := map[string]interface{}{"capabilities": caps}
-		pathElem[secretPath] = pathPolicy
+		for _, location := range locations {
+			caps := []interface{}{"read"}
+			pathPolicy := map[string]interface{}{"capabilities": caps}
+			pathElem[location.DataPath()] = pathPolicy
+
+			// kv v2 clients need to read the metadata to find versions of the secret
+			if location.KvVersion == KV_V2 {
+				metadataPath, err := location.MetadataPath()
+				if err != nil {
+					err = errors.Wrapf(err, "failed to create metadata path for %s role %s", secret.Name, role.Name)
+					return policy, err
+				}
+
+				caps := []interface{}{"read"}
+				pathPolicy := map[string]interface{}{"capabilities": caps}
+				pathElem[metadataPath] = pathPolicy
+			}
+		}
 	}
 
 	// add ability to read own policy
@@ -116,6 +131,38 @@ func (km *KeyMaster) MakePolicyPayload(role *Role, env string) (policy map[strin
 	return policy, err
 }
 
+// roleSecretLocations returns where a Secret the Role reads is stored.  The type of another Team's Secret is only known if the Role says what it is, or the Teams were loaded together with NewOrg().  Otherwise it could be at either the cert or the plain path, so both are returned.
+func (km *KeyMaster) roleSecretLocations(role *Role, secret *Secret, env string) (locations []SecretLocation, err error) {
+	locations = make([]SecretLocation, 0)
+
+	if secret.Team == role.Team || len(secret.GeneratorData) > 0 {
+		location, err := km.SecretLocationFor(secret, env)
+		if err != nil {
+			return locations, err
+		}
+
+		locations = append(locations, location)
+		return locations, err
+	}
+
+	// the cert path first, as a migrated TLS Secret leaves its old data at the plain path
+	location, err := km.CertLocation(secret.Team, secret.Name, env)
+	if err != nil {
+		return locations, err
+	}
+
+	locations = append(locations, location)
+
+	location, err = km.SecretLocation(secret.Team, secret.Name, env)
+	if err != nil {
+		return locations, err
+	}
+
+	locations = append(locations, location)
+
+	return locations, err
+}
+
 // WritePolicyToVault does just that.  It takes a vault client and the policy and takes care of the asshattery that is the vault api for policies.
 func (km *KeyMaster) WritePolicyToVault(policy VaultPolicy, verbose bool) (err error) {
 	verboseOutput(verbose, "----------------------------------------------------------------------------------------------------------------")
@@ -227,4 +274,28 @@ func (km *KeyMaster) DeletePolicyFromVault(path string) (err error) {
 	return err
 }
 
+// grantedPolicies returns the policies an auth role, as read from Vault, grants.  A role that doesn't exist yet grants just the default policy.
+func grantedPolicies(data map[string]interface{}) (policies []string) {
+	policies = make([]string, 0)
+
+	// fetch current policies for this host
+	if data != nil {
+		previousPolicies, ok := data["policies"].([]interface{})
+		if ok {
+			for _, p := range previousPolicies {
+				pname, ok := p.(string)
+				if ok {
+					policies = append(policies, pname)
+				}
+			}
+		}
+		return policies
+	}
+
+	// else return a list with the default policy
+	policies = append(policies, "default")
+
+	return policies
+}
+
 // TODO how to grant universal access to development?
@@ -121,6 +121,30 @@ func TestPolicyPayload(t *testing.T) {
 		t.Fail()
 	}
 
+	metadataPath1, err := km.SecretMetadataPath("core-services", "foo", "development")
+	if err != nil {
+		log.Printf("Failed to create path: %s", err)
+		t.Fail()
+	}
+
+	metadataPath2, err := km.SecretMetadataPath("core-platform", "foo", "development")
+	if err != nil {
+		log.Printf("Failed to create path: %s", err)
+		t.Fail()
+	}
+
+	metadataPath3, err := km.SecretMetadataPath("core-platform", "bar", "development")
+	if err != nil {
+		log.Printf("Failed to create path: %s", err)
+		t.Fail()
+	}
+
+	legacyPath, err := km.SecretPath("legacy-team1", "foo", "development")
+	if err != nil {
+		log.Printf("Failed to create path: %s", err)
+		t.Fail()
+	}
+
 	inputs := []struct {
 		name string
 		in   *Role
@@ -149,6 +173,11 @@ func TestPolicyPayload(t *testing.T) {
 							"read",
 						},
 					},
+					metadataPath1: map[string]interface{}{
+						"capabilities": []interface{}{
+							"read",
+						},
+					},
 					"sys/policy/core-services-app1-development": map[string]interface{}{
 						"capabilities": []interface{}{
 							"read",
@@ -192,6 +221,16 @@ func TestPolicyPayload(t *testing.T) {
 							"read",
 						},
 					},
+					metadataPath2: map[string]interface{}{
+						"capabilities": []interface{}{
+							"read",
+						},
+					},
+					metadataPath3: map[string]interface{}{
+						"capabilities": []interface{}{
+							"read",
+						},
+					},
 					"sys/policy/core-platform-app2-development": map[string]interface{}{
 						"capabilities": []interface{}{
 							"read",
@@ -200,6 +239,37 @@ func TestPolicyPayload(t *testing.T) {
 				},
 			},
 		},
+		{
+			"kv-v1",
+			&Role{
+				Name: "app3",
+				Secrets: []*Secret{
+					{
+						Name: "foo",
+						Team: "legacy-team1",
+						Generator: AlphaGenerator{
+							Type:   "alpha",
+							Length: 10,
+						},
+					},
+				},
+				Team: "legacy-team1",
+			},
+			map[string]interface{}{
+				"path": map[string]interface{}{
+					legacyPath: map[string]interface{}{
+						"capabilities": []interface{}{
+							"read",
+						},
+					},
+					"sys/policy/legacy-team1-app3-development": map[string]interface{}{
+						"capabilities": []interface{}{
+							"read",
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, tc := range inputs {
@@ -0,0 +1,121 @@
+/*
+	These functions copy the values of Secrets from one Environment to another, e.g. promoting a static value from staging to production once it's been proven.
+
+	Values that already exist in the target Environment are left alone unless the copy is forced.  Blank Static Secret buckets don't count as values.
+
+	On KV v2 mounts, the target records where its value came from in custom_metadata:
+
+		copied_from_env:     staging
+		copied_from_version: 3
+
+	keymaster does not manage these keys, so syncing the metadata from the Team yaml leaves them in place.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const ERR_COPY_ENVIRONMENT = "secret does not exist in environment"
+const ERR_COPY_SAME_ENVIRONMENT = "cannot copy a secret onto itself"
+const ERR_COPY_SOURCE_EMPTY = "secret has no value to copy"
+
+const METADATA_COPIED_FROM_ENV = "copied_from_env"
+const METADATA_COPIED_FROM_VERSION = "copied_from_version"
+
+// CopySecret copies the current value of a Secret from one Environment to another.  Existing values in the target are kept unless force is set.  Copied will be false if the target was left alone.
+func (km *KeyMaster) CopySecret(secret *Secret, fromEnv string, toEnv string, force bool, verbose bool) (copied bool, err error) {
+	if fromEnv == toEnv {
+		err = errors.New(ERR_COPY_SAME_ENVIRONMENT)
+		return copied, err
+	}
+
+	for _, env := range []string{fromEnv, toEnv} {
+		if !stringInSlice(env, secret.Environments) {
+			err = errors.Wrapf(errors.New(ERR_COPY_ENVIRONMENT), "secret %s env %s", secret.Name, env)
+			return copied, err
+		}
+	}
+
+	verboseOutput(verbose, "copying secret %s from %s to %s", secret.Name, fromEnv, toEnv)
+
+	from, err := km.SecretLocationFor(secret, fromEnv)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create secret path")
+		return copied, err
+	}
+
+	to, err := km.SecretLocationFor(secret, toEnv)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create secret path")
+		return copied, err
+	}
+
+	data, fromVersion, err := km.ReadSecretVersion(from)
+	if err != nil {
+		return copied, err
+	}
+
+	if data == nil || secretDataIsBlank(data) {
+		err = errors.Wrapf(errors.New(ERR_COPY_SOURCE_EMPTY), "secret %s env %s", secret.Name, fromEnv)
+		return copied, err
+	}
+
+	existing, toVersion, err := km.ReadSecretVersion(to)
+	if err != nil {
+		return copied, err
+	}
+
+	if existing != nil && !secretDataIsBlank(existing) && !force {
+		verboseOutput(verbose, "  %s already has a value.  Not copying.", to.DataPath())
+		return copied, err
+	}
+
+	verboseOutput(verbose, "  writing %s", to.DataPath())
+
+	err = km.WriteSecretDataCas(to, data, toVersion)
+	if err != nil {
+		return copied, err
+	}
+
+	copied = true
+
+	if to.KvVersion == KV_V1 {
+		return copied, err
+	}
+
+	err = km.AddCustomMetadata(to, map[string]string{
+		METADATA_COPIED_FROM_ENV:     fromEnv,
+		METADATA_COPIED_FROM_VERSION: fmt.Sprintf("%d", fromVersion),
+	})
+
+	return copied, err
+}
+
+// CopyStaticSecrets copies every Static Secret of a Team from one Environment to another.  Secrets that don't exist in both Environments are skipped.  Returns the names of the Secrets that were copied.
+func (km *KeyMaster) CopyStaticSecrets(team *Team, fromEnv string, toEnv string, force bool, verbose bool) (copied []string, err error) {
+	for _, secret := range team.Secrets {
+		if secret.GeneratorData["type"] != "static" {
+			continue
+		}
+
+		if !stringInSlice(fromEnv, secret.Environments) || !stringInSlice(toEnv, secret.Environments) {
+			verboseOutput(verbose, "secret %s is not in both %s and %s.  Skipping.", secret.Name, fromEnv, toEnv)
+			continue
+		}
+
+		ok, err := km.CopySecret(secret, fromEnv, toEnv, force, verbose)
+		if err != nil {
+			err = errors.Wrapf(err, "failed copying secret %s for team %s", secret.Name, secret.Team)
+			return copied, err
+		}
+
+		if ok {
+			copied = append(copied, secret.Name)
+		}
+	}
+
+	return copied, err
+}
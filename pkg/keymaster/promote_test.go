@@ -0,0 +1,272 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestCopySecret(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	secret := &Secret{
+		Name: "promoted",
+		Team: "secret-team4",
+		GeneratorData: GeneratorData{
+			"type": "static",
+		},
+		Environments: []string{"production", "staging", "development"},
+		Description:  "A promoted secret",
+	}
+
+	g, err := km.NewGenerator(secret.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	secret.SetGenerator(g)
+
+	// empty buckets everywhere
+	err = km.WriteSecretIfBlank(secret, true)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	values := map[string]string{
+		"staging":     "staging-value",
+		"development": "development-value",
+	}
+
+	for env, value := range values {
+		location, err := km.SecretLocation(secret.Team, secret.Name, env)
+		if err != nil {
+			log.Printf("error creating location: %s", err)
+			t.Fail()
+			return
+		}
+
+		err = km.WriteSecretData(location, map[string]interface{}{"value": value})
+		if err != nil {
+			log.Printf("Failed to write secret: %s", err)
+			t.Fail()
+			return
+		}
+	}
+
+	inputs := []struct {
+		name     string
+		from     string
+		to       string
+		force    bool
+		copied   bool
+		expected string
+		source   string
+		errOut   string
+	}{
+		{
+			"blank-target",
+			"staging",
+			"production",
+			false,
+			true,
+			"staging-value",
+			"staging",
+			"",
+		},
+		{
+			"existing-target",
+			"development",
+			"production",
+			false,
+			false,
+			"staging-value",
+			"staging",
+			"",
+		},
+		{
+			"forced",
+			"development",
+			"production",
+			true,
+			true,
+			"development-value",
+			"development",
+			"",
+		},
+		{
+			"same-env",
+			"production",
+			"production",
+			false,
+			false,
+			"",
+			"",
+			ERR_COPY_SAME_ENVIRONMENT,
+		},
+		{
+			"unknown-env",
+			"staging",
+			"qa",
+			false,
+			false,
+			"",
+			"",
+			ERR_COPY_ENVIRONMENT,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			copied, err := km.CopySecret(secret, tc.from, tc.to, tc.force, true)
+			if tc.errOut != "" {
+				assert.True(t, err != nil && strings.Contains(err.Error(), tc.errOut), "expected %q, got %v", tc.errOut, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Failed to copy secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.copied, copied, "copied meets expectations")
+
+			location, err := km.SecretLocation(secret.Team, secret.Name, tc.to)
+			if err != nil {
+				log.Printf("error creating location: %s", err)
+				t.Fail()
+				return
+			}
+
+			data, err := km.ReadSecretData(location)
+			if err != nil {
+				log.Printf("Failed to read secret: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.expected, data["value"], "value in %s meets expectations", tc.to)
+
+			metadata, err := km.ReadSecretMetadata(location)
+			if err != nil {
+				log.Printf("Failed to read metadata: %s", err)
+				t.Fail()
+				return
+			}
+
+			// custom_metadata needs Vault 1.9 or later
+			customMetadata, ok := metadata["custom_metadata"].(map[string]interface{})
+			if ok {
+				assert.Equal(t, tc.source, customMetadata[METADATA_COPIED_FROM_ENV], "source env recorded")
+				assert.Equal(t, "2", customMetadata[METADATA_COPIED_FROM_VERSION], "source version recorded")
+			}
+		})
+	}
+
+	// syncing metadata from the yaml keeps the copy record
+	err = km.WriteSecretMetadata(secret, true)
+	if err != nil {
+		log.Printf("Failed to write metadata: %s", err)
+		t.Fail()
+		return
+	}
+
+	location, err := km.SecretLocation(secret.Team, secret.Name, "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	metadata, err := km.ReadSecretMetadata(location)
+	if err != nil {
+		log.Printf("Failed to read metadata: %s", err)
+		t.Fail()
+		return
+	}
+
+	customMetadata, ok := metadata["custom_metadata"].(map[string]interface{})
+	if ok {
+		assert.Equal(t, "development", customMetadata[METADATA_COPIED_FROM_ENV], "copy record survives metadata sync")
+		assert.Equal(t, "A promoted secret", customMetadata[METADATA_DESCRIPTION], "managed metadata written")
+	}
+
+	// nothing to copy from a blank bucket
+	secret.Environments = append(secret.Environments, "qa")
+	_, err = km.CopySecret(secret, "qa", "production", true, true)
+	assert.True(t, err != nil && strings.Contains(err.Error(), ERR_COPY_SOURCE_EMPTY), "empty sources are refused")
+}
+
+func TestCopyStaticSecrets(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	team := &Team{
+		Name: "secret-team4",
+		Secrets: []*Secret{
+			{
+				Name:          "bulk-static",
+				Team:          "secret-team4",
+				GeneratorData: GeneratorData{"type": "static"},
+				Environments:  []string{"production", "staging"},
+			},
+			{
+				Name:          "bulk-generated",
+				Team:          "secret-team4",
+				GeneratorData: GeneratorData{"type": "uuid"},
+				Environments:  []string{"production", "staging"},
+			},
+			{
+				Name:          "bulk-staging-only",
+				Team:          "secret-team4",
+				GeneratorData: GeneratorData{"type": "static"},
+				Environments:  []string{"staging"},
+			},
+		},
+	}
+
+	for _, secret := range team.Secrets {
+		g, err := km.NewGenerator(secret.GeneratorData)
+		if err != nil {
+			log.Printf("Error creating generator: %s", err)
+			t.Fail()
+			return
+		}
+
+		secret.SetGenerator(g)
+
+		err = km.WriteSecretIfBlank(secret, true)
+		if err != nil {
+			log.Printf("Failed to write secret: %s", err)
+			t.Fail()
+			return
+		}
+	}
+
+	location, err := km.SecretLocation("secret-team4", "bulk-static", "staging")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	err = km.WriteSecretData(location, map[string]interface{}{"value": "bulk-value"})
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	copied, err := km.CopyStaticSecrets(team, "staging", "production", false, true)
+	if err != nil {
+		log.Printf("Failed to copy secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"bulk-static"}, copied, "only static secrets in both environments are copied")
+}
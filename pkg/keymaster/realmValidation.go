@@ -0,0 +1,113 @@
+/*
+	These functions check that Realms describe something that can exist.
+
+	A Realm has to be in one of its Team's Environments, and of a type the Environment allows, if it's in the environment catalog.  Its principals have to look like what its type of auth backend binds to:
+
+		k8s	namespace names, e.g. 'app1', or '*' for every namespace
+		iam	IAM role or user ARNs, e.g. 'arn:aws:iam::123456789012:role/app1', or STS assumed role ARNs
+		tls	hostnames, e.g. 'app1.scribd.com', optionally with a leading '*.'
+
+	k8s Realms name the clusters they run in as their identifiers.  Once the clusters are known, from the keymaster config or SetK8sClusters(), each has to be one of them.  A KeyMaster without any clusters, e.g. one that's only checking Team files, can't tell a good cluster from a bad one, so doesn't check them.  PlanTeam() and ConfigureTeam() still refuse clusters they don't know, as they can't write auth configs for them.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+const ERR_REALM_ENVIRONMENT_NOT_IN_TEAM = "realm environment is not one of the team's environments"
+const ERR_UNKNOWN_K8S_CLUSTER = "unknown k8s cluster"
+const ERR_INVALID_K8S_PRINCIPAL = "k8s principals must be namespace names"
+const ERR_INVALID_IAM_PRINCIPAL = "iam principals must be IAM role or user ARNs"
+const ERR_INVALID_TLS_PRINCIPAL = "tls principals must be fully qualified domain names"
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+var iamArnPattern = regexp.MustCompile(`^arn:aws(-[a-z]+)*:(iam::\d{12}:(role|user)/[\w+=,.@/*-]+|sts::\d{12}:assumed-role/[\w+=,.@/*-]+)$`)
+var hostnameLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
+
+// validateRealm checks a Realm is in the Team's Environments, uses known clusters, and has principals its type of auth can bind to.  Clusters are only checked if there are any.
+func (km *KeyMaster) validateRealm(team *Team, realm *Realm) (problems ConfigErrors) {
+	if !stringInSlice(realm.Environment, team.Environments) {
+		problems = append(problems, realm.source.errorAt("environment", errors.New(fmt.Sprintf("%s: %s", ERR_REALM_ENVIRONMENT_NOT_IN_TEAM, realm.Environment))))
+	}
+
+	env, ok := km.LookupEnvironment(realm.Environment)
+	if ok && len(env.Realms) > 0 && !stringInSlice(realm.Type, env.Realms) {
+		problems = append(problems, realm.source.errorAt("type", errors.New(fmt.Sprintf("%s: %s in %s", ERR_REALM_NOT_ALLOWED_IN_ENVIRONMENT, realm.Type, env.Name))))
+	}
+
+	var validPrincipal func(string) bool
+	var invalid string
+
+	switch realm.Type {
+	case K8S:
+		validPrincipal = ValidK8sNamespace
+		invalid = ERR_INVALID_K8S_PRINCIPAL
+
+		// clusters can only be checked once they're known.  PlanTeam and ConfigureTeam refuse unknown ones when they get to the auth configs.
+		if km.K8sClustersByName != nil {
+			for i, cluster := range realm.Identifiers {
+				_, ok := km.K8sClustersByName[cluster]
+				if !ok {
+					problems = append(problems, realm.source.errorAt(fmt.Sprintf("identifiers[%d]", i), errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_K8S_CLUSTER, cluster))))
+				}
+			}
+		}
+	case IAM:
+		validPrincipal = ValidIamPrincipal
+		invalid = ERR_INVALID_IAM_PRINCIPAL
+	case TLS:
+		validPrincipal = ValidFqdn
+		invalid = ERR_INVALID_TLS_PRINCIPAL
+	default:
+		return problems
+	}
+
+	for i, principal := range realm.Principals {
+		if !validPrincipal(principal) {
+			problems = append(problems, realm.source.errorAt(fmt.Sprintf("principals[%d]", i), errors.New(fmt.Sprintf("%s: %q", invalid, principal))))
+		}
+	}
+
+	return problems
+}
+
+// ValidK8sNamespace returns true if the string is a valid k8s namespace name, or '*' for any namespace.
+func ValidK8sNamespace(namespace string) bool {
+	return namespace == "*" || namespacePattern.MatchString(namespace)
+}
+
+// ValidIamPrincipal returns true if the string is an ARN that Vault's aws auth can bind to.
+func ValidIamPrincipal(arn string) bool {
+	return iamArnPattern.MatchString(arn)
+}
+
+// ValidFqdn returns true if the string is a fully qualified domain name.  The first label can be '*'.
+func ValidFqdn(hostname string) bool {
+	hostname = strings.TrimSuffix(hostname, ".")
+
+	if len(hostname) > 253 {
+		return false
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for i, label := range labels {
+		if i == 0 && label == "*" {
+			continue
+		}
+
+		if !hostnameLabelPattern.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
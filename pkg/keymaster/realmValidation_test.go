@@ -0,0 +1,270 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestValidateRealms(t *testing.T) {
+	inputs := []struct {
+		name   string
+		in     string
+		errs   []string
+		fields []string
+	}{
+		{
+			"valid",
+			`---
+name: realms
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+          - "*"
+        environment: production
+      - type: iam
+        principals:
+          - "arn:aws:iam::111111111111:role/app1"
+          - "arn:aws:iam::111111111111:role/app1-*"
+          - "arn:aws:iam::111111111111:user/deploy"
+          - "arn:aws:sts::111111111111:assumed-role/app1/*"
+        environment: staging
+      - type: tls
+        principals:
+          - app1.scribd.com
+          - "*.app1.scribd.com"
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			nil,
+			nil,
+		},
+		{
+			"environment-not-in-team",
+			`---
+name: realms
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: prod
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_REALM_ENVIRONMENT_NOT_IN_TEAM + ": prod", ERR_SECRET_NOT_IN_ENVIRONMENT},
+			[]string{"roles[0].realms[0].environment", "roles[0].realms[0].environment"},
+		},
+		{
+			"unknown-cluster",
+			`---
+name: realms
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+          - aplha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_UNKNOWN_K8S_CLUSTER + ": aplha"},
+			[]string{"roles[0].realms[0].identifiers[1]"},
+		},
+		{
+			"bad-principals",
+			`---
+name: realms
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - App_1
+        environment: production
+      - type: iam
+        principals:
+          - "arn:aws:iam::1111:role/app1"
+          - "app1"
+        environment: staging
+      - type: tls
+        principals:
+          - app1
+          - "app_1.scribd.com"
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_INVALID_K8S_PRINCIPAL, ERR_INVALID_IAM_PRINCIPAL, ERR_INVALID_IAM_PRINCIPAL, ERR_INVALID_TLS_PRINCIPAL, ERR_INVALID_TLS_PRINCIPAL},
+			[]string{"roles[0].realms[0].principals[0]", "roles[0].realms[1].principals[0]", "roles[0].realms[1].principals[1]", "roles[0].realms[2].principals[0]", "roles[0].realms[2].principals[1]"},
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+	km.SetK8sClusters([]*Cluster{{Name: "alpha"}})
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := km.NewTeam([]byte(tc.in), false)
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error creating team: %s", err)
+					t.Fail()
+				}
+
+				return
+			}
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the field")
+				assert.True(t, configErr.Line > 0, "error gives the line")
+			}
+		})
+	}
+}
+
+func TestRealmClustersNeedConfiguring(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	// configuring needs a team with a secrets engine
+	data := `---
+name: team4
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - aplha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`
+
+	// without any clusters there's nothing to check the identifiers against, so they're let through
+	assert.True(t, km.K8sClustersByName == nil, "a new KeyMaster has no clusters")
+
+	team, err := km.NewTeam([]byte(data), false)
+	if err != nil {
+		log.Printf("Clusters were checked before they were known: %s", err)
+		t.Fail()
+		return
+	}
+
+	km.SetK8sClusters([]*Cluster{{Name: "alpha"}})
+
+	// once they're known, loading refuses the typo
+	_, err = km.NewTeam([]byte(data), false)
+	assert.True(t, err != nil && strings.Contains(err.Error(), ERR_UNKNOWN_K8S_CLUSTER), "loading an unknown cluster is an error once clusters are known.  got %v", err)
+
+	// and a Team loaded before then is still refused when it's planned or configured
+	_, err = km.PlanTeam(team, false)
+	assert.True(t, err != nil && strings.Contains(err.Error(), ERR_UNKNOWN_K8S_CLUSTER), "planning an unknown cluster is an error.  got %v", err)
+
+	_, err = km.ConfigureTeam(team, false)
+	assert.True(t, err != nil && strings.Contains(err.Error(), ERR_UNKNOWN_K8S_CLUSTER), "configuring an unknown cluster is an error, not a panic.  got %v", err)
+}
+
+func TestPrincipalValidators(t *testing.T) {
+	inputs := []struct {
+		name  string
+		check func(string) bool
+		value string
+		valid bool
+	}{
+		{"namespace", ValidK8sNamespace, "app1", true},
+		{"namespace-hyphen", ValidK8sNamespace, "app-1", true},
+		{"namespace-wildcard", ValidK8sNamespace, "*", true},
+		{"namespace-upper", ValidK8sNamespace, "App1", false},
+		{"namespace-underscore", ValidK8sNamespace, "app_1", false},
+		{"namespace-trailing-hyphen", ValidK8sNamespace, "app1-", false},
+		{"namespace-too-long", ValidK8sNamespace, strings.Repeat("a", 64), false},
+		{"arn-role", ValidIamPrincipal, "arn:aws:iam::123456789012:role/app1", true},
+		{"arn-role-path", ValidIamPrincipal, "arn:aws:iam::123456789012:role/service/app1", true},
+		{"arn-user", ValidIamPrincipal, "arn:aws:iam::123456789012:user/deploy", true},
+		{"arn-assumed-role", ValidIamPrincipal, "arn:aws:sts::123456789012:assumed-role/app1/*", true},
+		{"arn-govcloud", ValidIamPrincipal, "arn:aws-us-gov:iam::123456789012:role/app1", true},
+		{"arn-short-account", ValidIamPrincipal, "arn:aws:iam::1234:role/app1", false},
+		{"arn-not-iam", ValidIamPrincipal, "arn:aws:s3:::bucket", false},
+		{"arn-placeholder", ValidIamPrincipal, "arn:aws:iam::<account>:role/app1", false},
+		{"fqdn", ValidFqdn, "app1.scribd.com", true},
+		{"fqdn-trailing-dot", ValidFqdn, "app1.scribd.com.", true},
+		{"fqdn-wildcard", ValidFqdn, "*.scribd.com", true},
+		{"fqdn-single-label", ValidFqdn, "app1", false},
+		{"fqdn-underscore", ValidFqdn, "app_1.scribd.com", false},
+		{"fqdn-empty-label", ValidFqdn, "app1..scribd.com", false},
+		{"fqdn-inner-wildcard", ValidFqdn, "app1.*.com", false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.valid, tc.check(tc.value), "%q", tc.value)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+/*
+	These functions handle Secrets that have been renamed, or moved from one Team to another.
+
+	A Secret lists the names it used to have, and optionally the Team it used to belong to:
+
+	- name: payment-provider-key
+	  previous_names:
+	    - stripe-key
+	  previous_team: billing
+	  generator:
+	    type: static
+
+	When the Team is configured, values are copied from the old locations into the new ones, so long as the new ones are blank.  Roles that still refer to a Secret by an old name are pointed at the new one, so the policies they get read the new path.
+
+	Old paths are never removed.  They're returned as stale by ConfigureTeam(), in its result, and listed in the Plan from PlanTeam(), so a human can destroy them once nothing reads them any more.
+
+	TLS Secrets are migrated the same way from the legacy layout, where they were stored at the plain secret path.  See tlsSecret.go.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const ERR_PREVIOUS_NAME_CONFLICT = "previous secret name is in use"
+const METADATA_MIGRATED_FROM = "migrated_from"
+
+// PreviousSecret A Team and Name a Secret used to be known by.
+type PreviousSecret struct {
+	Team string
+	Name string
+}
+
+// PreviousSecrets returns every Team and Name the Secret used to be known by.  A Secret that moved Teams was also known by its current Name in the old Team.
+func (s *Secret) PreviousSecrets() (previous []PreviousSecret) {
+	team := s.Team
+	if s.PreviousTeam != "" {
+		team = s.PreviousTeam
+		previous = append(previous, PreviousSecret{Team: team, Name: s.Name})
+	}
+
+	for _, name := range s.PreviousNames {
+		previous = append(previous, PreviousSecret{Team: team, Name: name})
+	}
+
+	return previous
+}
+
+// MigrateSecret copies values from the old locations of a renamed or moved Secret into the new ones, where the new ones are blank.  TLS Secrets written in the legacy layout are converted on the way.  Returns the old paths that still hold data, so they can be cleaned up.
+func (km *KeyMaster) MigrateSecret(secret *Secret, verbose bool) (stale []string, err error) {
+	previous := secret.PreviousSecrets()
+	if len(previous) == 0 && !secret.IsTls() {
+		return stale, err
+	}
+
+	verboseOutput(verbose, "migrating secret %s", secret.Name)
+	for _, env := range secret.Environments {
+		location, err := km.SecretLocationFor(secret, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path")
+			return stale, err
+		}
+
+		oldLocations, err := km.previousLocations(secret, previous, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path")
+			return stale, err
+		}
+
+		current, version, err := km.ReadSecretVersion(location)
+		if err != nil {
+			return stale, err
+		}
+
+		migrated := current != nil && !secretDataIsBlank(current)
+
+		for _, oldLocation := range oldLocations {
+			data, err := km.ReadSecretData(oldLocation)
+			if err != nil {
+				return stale, err
+			}
+
+			if data == nil {
+				continue
+			}
+
+			stale = append(stale, oldLocation.DataPath())
+
+			if migrated || secretDataIsBlank(data) {
+				continue
+			}
+
+			if secret.IsTls() && IsLegacyTlsData(data) {
+				data, err = ConvertLegacyTlsData(data)
+				if err != nil {
+					err = errors.Wrapf(err, "failed to convert %s", oldLocation.DataPath())
+					return stale, err
+				}
+			}
+
+			verboseOutput(verbose, "  copying %s to %s", oldLocation.DataPath(), location.DataPath())
+
+			err = km.WriteSecretDataCas(location, data, version)
+			if err != nil {
+				return stale, err
+			}
+
+			migrated = true
+
+			if location.KvVersion == KV_V2 {
+				err = km.AddCustomMetadata(location, map[string]string{METADATA_MIGRATED_FROM: fmt.Sprintf("%s/%s", oldLocation.Mount, oldLocation.Path)})
+				if err != nil {
+					return stale, err
+				}
+			}
+		}
+	}
+
+	return stale, err
+}
+
+// previousLocations lists where a Secret's value may have been stored before, in the order they're tried.  TLS Secrets may also be in the legacy layout, at the plain secret path.
+func (km *KeyMaster) previousLocations(secret *Secret, previous []PreviousSecret, env string) (locations []SecretLocation, err error) {
+	if secret.IsTls() {
+		location, err := km.SecretLocation(secret.Team, secret.Name, env)
+		if err != nil {
+			return locations, err
+		}
+
+		locations = append(locations, location)
+	}
+
+	for _, p := range previous {
+		if secret.IsTls() {
+			location, err := km.CertLocation(p.Team, p.Name, env)
+			if err != nil {
+				return locations, err
+			}
+
+			locations = append(locations, location)
+		}
+
+		location, err := km.SecretLocation(p.Team, p.Name, env)
+		if err != nil {
+			return locations, err
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, err
+}
+
+// resolvePreviousSecretNames points role secrets that use an old Team or Name at the Secret's current one.
+func resolvePreviousSecretNames(team *Team, verbose bool) (problems ConfigErrors) {
+	current := make(map[PreviousSecret]bool)
+	for _, secret := range team.Secrets {
+		current[PreviousSecret{Team: team.Name, Name: secret.Name}] = true
+	}
+
+	renamed := make(map[PreviousSecret]*Secret)
+	for _, secret := range team.Secrets {
+		for _, p := range secret.PreviousSecrets() {
+			_, taken := renamed[p]
+			if taken || current[p] {
+				problems = append(problems, secret.source.errorAt("previous_names", errors.New(fmt.Sprintf("%s: %s/%s", ERR_PREVIOUS_NAME_CONFLICT, p.Team, p.Name))))
+				continue
+			}
+
+			renamed[p] = secret
+		}
+	}
+
+	for _, role := range team.Roles {
+		for _, roleSecret := range role.Secrets {
+			secretTeam := roleSecret.Team
+			if secretTeam == "" {
+				secretTeam = team.Name
+			}
+
+			secret, ok := renamed[PreviousSecret{Team: secretTeam, Name: roleSecret.Name}]
+			if !ok {
+				continue
+			}
+
+			verboseOutput(verbose, "  role %s secret %s/%s is now %s/%s", role.Name, secretTeam, roleSecret.Name, team.Name, secret.Name)
+			roleSecret.Team = team.Name
+			roleSecret.Name = secret.Name
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,248 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPreviousSecrets(t *testing.T) {
+	inputs := []struct {
+		name   string
+		secret *Secret
+		out    []PreviousSecret
+	}{
+		{
+			"none",
+			&Secret{Name: "foo", Team: "team1"},
+			nil,
+		},
+		{
+			"renamed",
+			&Secret{Name: "foo", Team: "team1", PreviousNames: []string{"bar", "baz"}},
+			[]PreviousSecret{{Team: "team1", Name: "bar"}, {Team: "team1", Name: "baz"}},
+		},
+		{
+			"moved",
+			&Secret{Name: "foo", Team: "team1", PreviousTeam: "team2"},
+			[]PreviousSecret{{Team: "team2", Name: "foo"}},
+		},
+		{
+			"moved-and-renamed",
+			&Secret{Name: "foo", Team: "team1", PreviousTeam: "team2", PreviousNames: []string{"bar"}},
+			[]PreviousSecret{{Team: "team2", Name: "foo"}, {Team: "team2", Name: "bar"}},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.True(t, reflect.DeepEqual(tc.out, tc.secret.PreviousSecrets()), "previous secrets meet expectations")
+		})
+	}
+}
+
+func TestRenamedSecretInRole(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	teamData := `---
+name: team1
+secrets:
+  - name: new-foo
+    previous_names:
+      - foo
+    generator:
+      type: alpha
+      length: 8
+  - name: moved-bar
+    previous_team: team2
+    previous_names:
+      - bar
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - bravo
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+      - name: bar
+        team: team2
+environments:
+  - production
+`
+
+	team, err := km.NewTeam([]byte(teamData), true)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	policy, err := km.MakePolicyPayload(team.Roles[0], "production")
+	if err != nil {
+		log.Printf("Error creating policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	paths := make([]string, 0)
+	for path := range policy["path"].(map[string]interface{}) {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	expected := []string{
+		"sys/policy/team1-app1-production",
+		"team1/data/moved-bar/production",
+		"team1/data/new-foo/production",
+		"team1/metadata/moved-bar/production",
+		"team1/metadata/new-foo/production",
+	}
+
+	assert.Equal(t, expected, paths, "policy reads the new paths")
+}
+
+func TestMigrateSecret(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	secret := &Secret{
+		Name:          "migrated",
+		Team:          "secret-team4",
+		PreviousTeam:  "secret-team3",
+		PreviousNames: []string{"premigration"},
+		GeneratorData: GeneratorData{
+			"type": "static",
+		},
+		Environments: []string{"production", "staging", "development"},
+	}
+
+	g, err := km.NewGenerator(secret.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	secret.SetGenerator(g)
+
+	// production was under the old name in the old team, and staging had already moved to the new team.  Development has nothing anywhere.
+	seeds := []struct {
+		team  string
+		name  string
+		env   string
+		value string
+	}{
+		{"secret-team3", "premigration", "production", "old-production"},
+		{"secret-team3", "premigration", "staging", "old-staging"},
+		{"secret-team4", "migrated", "staging", "new-staging"},
+	}
+
+	for _, seed := range seeds {
+		location, err := km.SecretLocation(seed.team, seed.name, seed.env)
+		if err != nil {
+			log.Printf("error creating location: %s", err)
+			t.Fail()
+			return
+		}
+
+		err = km.WriteSecretData(location, map[string]interface{}{"value": seed.value})
+		if err != nil {
+			log.Printf("Failed to write secret: %s", err)
+			t.Fail()
+			return
+		}
+	}
+
+	stale, err := km.MigrateSecret(secret, true)
+	if err != nil {
+		log.Printf("Failed to migrate secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	expectedStale := []string{
+		"secret-team3/data/premigration/production",
+		"secret-team3/data/premigration/staging",
+	}
+
+	assert.Equal(t, expectedStale, stale, "old paths are flagged for cleanup")
+
+	expected := map[string]interface{}{
+		"production":  "old-production",
+		"staging":     "new-staging",
+		"development": nil,
+	}
+
+	for env, value := range expected {
+		location, err := km.SecretLocation(secret.Team, secret.Name, env)
+		if err != nil {
+			log.Printf("error creating location: %s", err)
+			t.Fail()
+			return
+		}
+
+		data, err := km.ReadSecretData(location)
+		if err != nil {
+			log.Printf("Failed to read secret: %s", err)
+			t.Fail()
+			return
+		}
+
+		assert.Equal(t, value, data["value"], "value in %s meets expectations", env)
+	}
+}
+
+func TestConfigureTeamStale(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	old, err := km.SecretLocation("team4", "before-rename", "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	err = km.WriteSecretData(old, map[string]interface{}{"value": "renamed"})
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	data := `---
+name: team4
+environments:
+  - production
+secrets:
+  - name: after-rename
+    previous_names:
+      - before-rename
+    generator:
+      type: static
+`
+
+	team, err := km.NewTeam([]byte(data), false)
+	if err != nil {
+		log.Printf("Error loading team: %s", err)
+		t.Fail()
+		return
+	}
+
+	result, err := km.ConfigureTeam(team, false)
+	if err != nil {
+		log.Printf("Error configuring team: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"team4/data/before-rename/production"}, result.Stale, "old paths are returned for cleanup")
+}
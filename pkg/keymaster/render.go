@@ -0,0 +1,311 @@
+/*
+	These functions render the Secrets of a Role into the files deploy tooling needs.
+
+	Supported formats are dotenv, JSON, YAML, and a Kubernetes Secret manifest.
+
+	Each Secret becomes one key, named after the Secret.  TLS Secrets become one key per part, e.g. a TLS Secret named 'foo.scribd.com' renders as 'foo.scribd.com.crt', 'foo.scribd.com.key', 'foo.scribd.com.ca', 'foo.scribd.com.chain', 'foo.scribd.com.serial', 'foo.scribd.com.type', and 'foo.scribd.com.expiration'.
+
+	How keys are named is configurable.  'original' keeps the names as they are.  'upper-snake' turns 'foo.scribd.com.crt' into 'FOO_SCRIBD_COM_CRT', as environment variables want.  'lower-snake' gives 'foo_scribd_com_crt'.  A prefix can be added to every key.
+
+	dotenv keys are always valid variable names: any other character becomes '_', whatever the naming.
+
+*/
+package keymaster
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const ERR_UNKNOWN_RENDER_FORMAT = "unknown render format"
+const ERR_UNKNOWN_KEY_NAMING = "unknown key naming convention"
+const ERR_RENDER_KEY_COLLISION = "more than one secret renders to the same key"
+const ERR_BAD_K8S_SECRET_KEY = "key is not valid in a kubernetes secret"
+const ERR_DUPLICATE_SECRET_NAME = "role can read more than one secret with the same name"
+
+const RENDER_FORMAT_DOTENV = "dotenv"
+const RENDER_FORMAT_JSON = "json"
+const RENDER_FORMAT_YAML = "yaml"
+const RENDER_FORMAT_K8S = "k8s"
+
+const KEY_NAMING_ORIGINAL = "original"
+const KEY_NAMING_UPPER_SNAKE = "upper-snake"
+const KEY_NAMING_LOWER_SNAKE = "lower-snake"
+
+var RenderFormats = []string{
+	RENDER_FORMAT_DOTENV,
+	RENDER_FORMAT_JSON,
+	RENDER_FORMAT_YAML,
+	RENDER_FORMAT_K8S,
+}
+
+var snakeSeparatorPattern = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+var k8sSecretKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+var dotenvInvalidPattern = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// RenderOptions How to render Secrets.  The name and namespace are only used by the k8s format.
+type RenderOptions struct {
+	Format    string
+	KeyNaming string // defaults to original
+	Prefix    string
+	Name      string
+	Namespace string
+}
+
+// K8sSecretManifest A Kubernetes Secret, as much of it as keymaster renders.
+type K8sSecretManifest struct {
+	ApiVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   K8sSecretMetadata `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+}
+
+// K8sSecretMetadata The metadata of a Kubernetes Secret.
+type K8sSecretMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+// RoleSecretValues reads the current values of every Secret a Role can read in an Environment, by name.  Secrets that haven't been written yet are left out.  Two Secrets with the same name, from different Teams, are an error, as client.Secrets() finds them to be.
+func (km *KeyMaster) RoleSecretValues(role *Role, env string) (values map[string]*SecretValue, err error) {
+	values = make(map[string]*SecretValue)
+
+	for _, secret := range role.SecretsForEnv(env) {
+		locations, err := km.roleSecretLocations(role, secret, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path for %s role %s", secret.Name, role.Name)
+			return values, err
+		}
+
+		var value *SecretValue
+		for _, location := range locations {
+			value, err = km.ReadSecretValueAt(location, SecretPathElements{Team: secret.Team, Name: secret.Name, Env: env})
+			if err != nil {
+				err = errors.Wrapf(err, "failed to read secret %s for role %s", secret.Name, role.Name)
+				return values, err
+			}
+
+			if value != nil {
+				break
+			}
+		}
+
+		if value == nil {
+			continue
+		}
+
+		// values are keyed by name, so secrets of different teams with the same name can't both be rendered
+		existing, ok := values[secret.Name]
+		if ok {
+			err = errors.New(fmt.Sprintf("%s: %s/%s and %s/%s", ERR_DUPLICATE_SECRET_NAME, existing.Team, existing.Name, secret.Team, secret.Name))
+			return values, err
+		}
+
+		values[secret.Name] = value
+	}
+
+	return values, err
+}
+
+// RenderKeyName applies a naming convention to a key.
+func RenderKeyName(key string, naming string, prefix string) (name string, err error) {
+	switch naming {
+	case "", KEY_NAMING_ORIGINAL:
+		name = key
+	case KEY_NAMING_UPPER_SNAKE:
+		name = strings.ToUpper(strings.Trim(snakeSeparatorPattern.ReplaceAllString(key, "_"), "_"))
+	case KEY_NAMING_LOWER_SNAKE:
+		name = strings.ToLower(strings.Trim(snakeSeparatorPattern.ReplaceAllString(key, "_"), "_"))
+	default:
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_KEY_NAMING, naming))
+		return name, err
+	}
+
+	name = prefix + name
+
+	return name, err
+}
+
+// FlattenSecretValues turns Secrets into keys and values, expanding TLS Secrets into one key per part.
+func FlattenSecretValues(values map[string]*SecretValue, naming string, prefix string) (flat map[string]string, err error) {
+	flat = make(map[string]string)
+	sources := make(map[string]string)
+
+	for name, value := range values {
+		parts := map[string]string{name: value.Value}
+
+		if value.Tls != nil {
+			parts = map[string]string{
+				fmt.Sprintf("%s.crt", name):        value.Tls.Cert,
+				fmt.Sprintf("%s.key", name):        value.Tls.Key,
+				fmt.Sprintf("%s.ca", name):         value.Tls.CA,
+				fmt.Sprintf("%s.chain", name):      strings.Join(value.Tls.Chain, "\n"),
+				fmt.Sprintf("%s.serial", name):     value.Tls.Serial,
+				fmt.Sprintf("%s.type", name):       value.Tls.Type,
+				fmt.Sprintf("%s.expiration", name): fmt.Sprintf("%d", value.Tls.Expiration),
+			}
+		}
+
+		for key, v := range parts {
+			renamed, err := RenderKeyName(key, naming, prefix)
+			if err != nil {
+				return flat, err
+			}
+
+			previous, ok := sources[renamed]
+			if ok {
+				err = errors.New(fmt.Sprintf("%s: %s and %s are both %s", ERR_RENDER_KEY_COLLISION, previous, key, renamed))
+				return flat, err
+			}
+
+			sources[renamed] = key
+			flat[renamed] = v
+		}
+	}
+
+	return flat, err
+}
+
+// RenderSecrets renders Secrets in the format given.
+func RenderSecrets(values map[string]*SecretValue, options RenderOptions) (output []byte, err error) {
+	if !stringInSlice(options.Format, RenderFormats) {
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_RENDER_FORMAT, options.Format))
+		return output, err
+	}
+
+	flat, err := FlattenSecretValues(values, options.KeyNaming, options.Prefix)
+	if err != nil {
+		return output, err
+	}
+
+	switch options.Format {
+	case RENDER_FORMAT_DOTENV:
+		return RenderDotenv(flat)
+	case RENDER_FORMAT_JSON:
+		return RenderJson(flat)
+	case RENDER_FORMAT_YAML:
+		return RenderYaml(flat)
+	default:
+		return RenderK8sSecret(flat, options.Name, options.Namespace)
+	}
+}
+
+// RenderDotenv renders keys and values as a dotenv file.  Values are double quoted, with newlines escaped.  Characters a variable name can't have become '_', so 'foo.scribd.com.crt' is 'foo_scribd_com_crt'.
+func RenderDotenv(flat map[string]string) (output []byte, err error) {
+	buf := new(bytes.Buffer)
+	sources := make(map[string]string)
+
+	for _, key := range sortedKeys(flat) {
+		name := dotenvKeyName(key)
+
+		previous, ok := sources[name]
+		if ok {
+			err = errors.New(fmt.Sprintf("%s: %s and %s are both %s", ERR_RENDER_KEY_COLLISION, previous, key, name))
+			return output, err
+		}
+
+		sources[name] = key
+
+		value := flat[key]
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `"`, `\"`)
+		value = strings.ReplaceAll(value, `$`, `\$`)
+		value = strings.ReplaceAll(value, "\n", `\n`)
+
+		buf.WriteString(fmt.Sprintf("%s=\"%s\"\n", name, value))
+	}
+
+	output = buf.Bytes()
+
+	return output, err
+}
+
+// dotenvKeyName turns a key into a valid variable name.  Names can't start with a digit, so those get a leading '_'.
+func dotenvKeyName(key string) (name string) {
+	name = dotenvInvalidPattern.ReplaceAllString(key, "_")
+
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// RenderJson renders keys and values as a JSON object.
+func RenderJson(flat map[string]string) (output []byte, err error) {
+	output, err = json.MarshalIndent(flat, "", "  ")
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal secrets to json")
+		return output, err
+	}
+
+	output = append(output, '\n')
+
+	return output, err
+}
+
+// RenderYaml renders keys and values as a YAML map.
+func RenderYaml(flat map[string]string) (output []byte, err error) {
+	output, err = yaml.Marshal(flat)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal secrets to yaml")
+		return output, err
+	}
+
+	return output, err
+}
+
+// RenderK8sSecret renders keys and values as a Kubernetes Secret manifest.
+func RenderK8sSecret(flat map[string]string, name string, namespace string) (output []byte, err error) {
+	if name == "" {
+		err = errors.New("kubernetes secrets need a name")
+		return output, err
+	}
+
+	manifest := K8sSecretManifest{
+		ApiVersion: "v1",
+		Kind:       "Secret",
+		Metadata: K8sSecretMetadata{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: "Opaque",
+		Data: make(map[string]string),
+	}
+
+	for key, value := range flat {
+		if !k8sSecretKeyPattern.MatchString(key) {
+			err = errors.New(fmt.Sprintf("%s: %s", ERR_BAD_K8S_SECRET_KEY, key))
+			return output, err
+		}
+
+		manifest.Data[key] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	output, err = yaml.Marshal(manifest)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal kubernetes secret")
+		return output, err
+	}
+
+	return output, err
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	keys = make([]string, 0)
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,270 @@
+package keymaster
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testSecretValues() map[string]*SecretValue {
+	return map[string]*SecretValue{
+		"db-password": {
+			Name:  "db-password",
+			Type:  "alpha",
+			Value: `pa$$"word`,
+		},
+		"foo.scribd.com": {
+			Name: "foo.scribd.com",
+			Type: "tls",
+			Tls: &VaultCert{
+				Cert:       "-----BEGIN CERTIFICATE-----\nCERT\n-----END CERTIFICATE-----",
+				Key:        "KEY",
+				CA:         "CA",
+				Chain:      []string{"CHAIN1", "CHAIN2"},
+				Serial:     "01:02",
+				Type:       "rsa",
+				Expiration: 1234567890,
+			},
+		},
+	}
+}
+
+func TestRenderKeyName(t *testing.T) {
+	inputs := []struct {
+		key    string
+		naming string
+		prefix string
+		out    string
+		err    string
+	}{
+		{"foo.scribd.com.crt", KEY_NAMING_ORIGINAL, "", "foo.scribd.com.crt", ""},
+		{"foo.scribd.com.crt", "", "", "foo.scribd.com.crt", ""},
+		{"foo.scribd.com.crt", KEY_NAMING_UPPER_SNAKE, "", "FOO_SCRIBD_COM_CRT", ""},
+		{"db-password", KEY_NAMING_UPPER_SNAKE, "APP_", "APP_DB_PASSWORD", ""},
+		{"Db-Password", KEY_NAMING_LOWER_SNAKE, "", "db_password", ""},
+		{"foo", "camel", "", "", ERR_UNKNOWN_KEY_NAMING},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.key+"-"+tc.naming, func(t *testing.T) {
+			name, err := RenderKeyName(tc.key, tc.naming, tc.prefix)
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			assert.Equal(t, tc.out, name, "key name meets expectations")
+		})
+	}
+}
+
+func TestFlattenSecretValues(t *testing.T) {
+	flat, err := FlattenSecretValues(testSecretValues(), KEY_NAMING_ORIGINAL, "")
+	if err != nil {
+		log.Printf("Error flattening secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := map[string]string{
+		"db-password":               `pa$$"word`,
+		"foo.scribd.com.crt":        "-----BEGIN CERTIFICATE-----\nCERT\n-----END CERTIFICATE-----",
+		"foo.scribd.com.key":        "KEY",
+		"foo.scribd.com.ca":         "CA",
+		"foo.scribd.com.chain":      "CHAIN1\nCHAIN2",
+		"foo.scribd.com.serial":     "01:02",
+		"foo.scribd.com.type":       "rsa",
+		"foo.scribd.com.expiration": "1234567890",
+	}
+
+	assert.True(t, reflect.DeepEqual(expected, flat), "flattened secrets meet expectations")
+
+	colliding := map[string]*SecretValue{
+		"db-password": {Name: "db-password", Value: "a"},
+		"db.password": {Name: "db.password", Value: "b"},
+	}
+
+	_, err = FlattenSecretValues(colliding, KEY_NAMING_UPPER_SNAKE, "")
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_RENDER_KEY_COLLISION), "colliding keys are refused")
+}
+
+func TestRenderSecrets(t *testing.T) {
+	inputs := []struct {
+		name    string
+		options RenderOptions
+		check   func(t *testing.T, output []byte)
+	}{
+		{
+			"dotenv",
+			RenderOptions{Format: RENDER_FORMAT_DOTENV, KeyNaming: KEY_NAMING_UPPER_SNAKE},
+			func(t *testing.T, output []byte) {
+				lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+				assert.Equal(t, 8, len(lines), "one line per key")
+				assert.Equal(t, `DB_PASSWORD="pa\$\$\"word"`, lines[0], "values are quoted and escaped")
+				assert.Contains(t, lines, `FOO_SCRIBD_COM_CRT="-----BEGIN CERTIFICATE-----\nCERT\n-----END CERTIFICATE-----"`, "newlines are escaped")
+			},
+		},
+		{
+			"json",
+			RenderOptions{Format: RENDER_FORMAT_JSON},
+			func(t *testing.T, output []byte) {
+				var parsed map[string]string
+				err := json.Unmarshal(output, &parsed)
+				if err != nil {
+					log.Printf("Error parsing json: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, `pa$$"word`, parsed["db-password"], "value round trips")
+				assert.Equal(t, "KEY", parsed["foo.scribd.com.key"], "tls part round trips")
+			},
+		},
+		{
+			"yaml",
+			RenderOptions{Format: RENDER_FORMAT_YAML, KeyNaming: KEY_NAMING_LOWER_SNAKE},
+			func(t *testing.T, output []byte) {
+				var parsed map[string]string
+				err := yaml.Unmarshal(output, &parsed)
+				if err != nil {
+					log.Printf("Error parsing yaml: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, `pa$$"word`, parsed["db_password"], "value round trips")
+				assert.Equal(t, "CHAIN1\nCHAIN2", parsed["foo_scribd_com_chain"], "tls part round trips")
+			},
+		},
+		{
+			"k8s",
+			RenderOptions{Format: RENDER_FORMAT_K8S, Name: "app1-secrets", Namespace: "app1"},
+			func(t *testing.T, output []byte) {
+				var manifest K8sSecretManifest
+				err := yaml.Unmarshal(output, &manifest)
+				if err != nil {
+					log.Printf("Error parsing manifest: %s", err)
+					t.Fail()
+					return
+				}
+
+				assert.Equal(t, "Secret", manifest.Kind, "kind is Secret")
+				assert.Equal(t, "app1-secrets", manifest.Metadata.Name, "name is set")
+				assert.Equal(t, "app1", manifest.Metadata.Namespace, "namespace is set")
+				assert.Equal(t, "S0VZ", manifest.Data["foo.scribd.com.key"], "values are base64 encoded")
+			},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := RenderSecrets(testSecretValues(), tc.options)
+			if err != nil {
+				log.Printf("Error rendering secrets: %s", err)
+				t.Fail()
+				return
+			}
+
+			tc.check(t, output)
+		})
+	}
+
+	output, err := RenderSecrets(testSecretValues(), RenderOptions{Format: RENDER_FORMAT_DOTENV})
+	if err != nil {
+		log.Printf("Error rendering secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	assert.Equal(t, `db_password="pa\$\$\"word"`, lines[0], "dashes in dotenv keys become underscores")
+	assert.Contains(t, lines, `foo_scribd_com_key="KEY"`, "dots in dotenv keys become underscores")
+
+	_, err = RenderDotenv(map[string]string{"db-password": "a", "db.password": "b"})
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_RENDER_KEY_COLLISION), "keys that collide in dotenv are refused")
+
+	_, err = RenderSecrets(testSecretValues(), RenderOptions{Format: "toml"})
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_UNKNOWN_RENDER_FORMAT), "unknown formats are refused")
+
+	_, err = RenderSecrets(testSecretValues(), RenderOptions{Format: RENDER_FORMAT_K8S, Prefix: "app/", Name: "app1"})
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_BAD_K8S_SECRET_KEY), "invalid kubernetes keys are refused")
+}
+
+func TestRoleSecretValues(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	secret := &Secret{
+		Name:          "rendered",
+		Team:          "secret-team4",
+		GeneratorData: GeneratorData{"type": "uuid"},
+		Environments:  []string{"production"},
+	}
+
+	g, err := km.NewGenerator(secret.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	secret.SetGenerator(g)
+
+	err = km.WriteSecretIfBlank(secret, true)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	role := &Role{
+		Name: "renderer",
+		Team: "secret-team4",
+		Secrets: []*Secret{
+			{Name: "rendered", Team: "secret-team4"},
+			{Name: "never-written", Team: "secret-team4"},
+		},
+	}
+
+	values, err := km.RoleSecretValues(role, "production")
+	if err != nil {
+		log.Printf("Failed to read secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, 1, len(values), "only written secrets are returned")
+	assert.Equal(t, 36, len(values["rendered"].Value), "value was read")
+	assert.Equal(t, "uuid", values["rendered"].Type, "type was read")
+	// a secret of the same name in another team would lose one of the values
+	other := &Secret{
+		Name:          "rendered",
+		Team:          "secret-team2",
+		GeneratorData: GeneratorData{"type": "uuid"},
+		Environments:  []string{"production"},
+	}
+
+	g, err = km.NewGenerator(other.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	other.SetGenerator(g)
+
+	err = km.WriteSecretIfBlank(other, true)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	role.Secrets = append(role.Secrets, &Secret{Name: "rendered", Team: "secret-team2", GeneratorData: GeneratorData{"type": "uuid"}})
+
+	_, err = km.RoleSecretValues(role, "production")
+	assert.True(t, err != nil && strings.HasPrefix(err.Error(), ERR_DUPLICATE_SECRET_NAME), "secrets with the same name are refused.  got %v", err)
+}
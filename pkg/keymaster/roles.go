@@ -0,0 +1,178 @@
+/*
+	These functions merge repeated blocks for the same Role.
+
+	A Role can be given in more than one block, each with its own Realms and Secrets:
+
+	- name: app1
+	  realms:
+	    - type: k8s
+	      environment: staging
+	      ...
+	  secrets:
+	    - name: foo
+	- name: app1
+	  realms:
+	    - type: iam
+	      environment: production
+	      ...
+	  secrets:
+	    - name: bar
+
+	The blocks become a single Role.  Each block's Secrets are granted in the Environments of that block's Realms, and the Secrets for each Environment are the union of every block that has a Realm there.  In the example, app1 reads foo in staging and bar in production.
+
+	Realms are kept as they are, apart from exact duplicates, which are dropped.  Realms of the same type in the same Environment (and cluster, for k8s) but with different principals contradict each other, as whichever is written last would win.  That's an error.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"sort"
+)
+
+const ERR_CONTRADICTORY_ROLE_BLOCKS = "role has realms for the same auth config with different principals"
+
+// SecretsForEnv returns the Secrets the Role reads in an Environment.  Roles that weren't loaded through NewTeam read all of their Secrets everywhere.
+func (r *Role) SecretsForEnv(env string) (secrets []*Secret) {
+	if r.EnvSecrets == nil {
+		return r.Secrets
+	}
+
+	return r.EnvSecrets[env]
+}
+
+// SecretEnvironments returns the Environments in which the Role reads a Secret.
+func (r *Role) SecretEnvironments(secret *Secret) (envs []string) {
+	envs = make([]string, 0)
+
+	for _, realm := range r.Realms {
+		if stringInSlice(realm.Environment, envs) {
+			continue
+		}
+
+		for _, s := range r.SecretsForEnv(realm.Environment) {
+			if s == secret {
+				envs = append(envs, realm.Environment)
+				break
+			}
+		}
+	}
+
+	return envs
+}
+
+// mergeRoleBlocks merges the blocks of each Role into one, in the order the Roles first appear.  The Team of the blocks and their Secrets has to be filled in already.
+func mergeRoleBlocks(blocks []*Role) (roles []*Role, problems ConfigErrors) {
+	roles = make([]*Role, 0)
+	rolesMap := make(map[string]*Role)
+
+	for _, block := range blocks {
+		role, ok := rolesMap[block.Name]
+		if !ok {
+			role = &Role{
+				Name:       block.Name,
+				Team:       block.Team,
+				Secrets:    make([]*Secret, 0),
+				source:     block.source,
+				Realms:     make([]*Realm, 0),
+				EnvSecrets: make(map[string][]*Secret),
+			}
+
+			roles = append(roles, role)
+			rolesMap[block.Name] = role
+		}
+
+		for _, realm := range block.Realms {
+			duplicate := false
+
+			for _, existing := range role.Realms {
+				if sameRealm(existing, realm) {
+					duplicate = true
+					break
+				}
+
+				if realmsContradict(existing, realm) {
+					problems = append(problems, realm.source.errorAt("principals", errors.New(fmt.Sprintf("%s: role %s realm %s in %s", ERR_CONTRADICTORY_ROLE_BLOCKS, role.Name, realm.Type, realm.Environment))))
+					duplicate = true
+					break
+				}
+			}
+
+			if !duplicate {
+				role.Realms = append(role.Realms, realm)
+			}
+		}
+
+		for _, secret := range block.Secrets {
+			// a secret listed in more than one block is the same secret in each, so it's shared between them
+			canonical := secret
+			for _, existing := range role.Secrets {
+				if existing.Team == secret.Team && existing.Name == secret.Name {
+					canonical = existing
+					break
+				}
+			}
+
+			if canonical == secret {
+				role.Secrets = append(role.Secrets, secret)
+			}
+
+			for _, realm := range block.Realms {
+				env := realm.Environment
+				if !secretInList(canonical, role.EnvSecrets[env]) {
+					role.EnvSecrets[env] = append(role.EnvSecrets[env], canonical)
+				}
+			}
+		}
+	}
+
+	return roles, problems
+}
+
+// sameRealm returns true if two realms are the same, wherever they were defined.
+func sameRealm(a *Realm, b *Realm) bool {
+	return a.Type == b.Type && a.Environment == b.Environment && reflect.DeepEqual(a.Identifiers, b.Identifiers) && reflect.DeepEqual(a.Principals, b.Principals)
+}
+
+// realmsContradict returns true if two realms are for the same type, Environment and cluster, but have different principals.
+func realmsContradict(a *Realm, b *Realm) bool {
+	if a.Type != b.Type || a.Environment != b.Environment {
+		return false
+	}
+
+	if a.Type == K8S {
+		shared := false
+		for _, cluster := range a.Identifiers {
+			if stringInSlice(cluster, b.Identifiers) {
+				shared = true
+				break
+			}
+		}
+
+		if !shared {
+			return false
+		}
+	}
+
+	return !reflect.DeepEqual(sortedCopy(a.Principals), sortedCopy(b.Principals))
+}
+
+func secretInList(secret *Secret, list []*Secret) bool {
+	for _, s := range list {
+		if s == secret {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedCopy(list []string) (sorted []string) {
+	sorted = make([]string, len(list))
+	copy(sorted, list)
+	sort.Strings(sorted)
+
+	return sorted
+}
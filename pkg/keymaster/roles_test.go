@@ -0,0 +1,380 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+// readmeConfigExample returns the team config given as an example in the README, so that it can't go stale.
+func readmeConfigExample() (example string, err error) {
+	readme, err := ioutil.ReadFile("../../README.md")
+	if err != nil {
+		return example, err
+	}
+
+	lines := make([]string, 0)
+	inExample := false
+
+	for _, line := range strings.Split(string(readme), "\n") {
+		if strings.HasPrefix(line, "## Config Example") {
+			inExample = true
+			continue
+		}
+
+		if !inExample {
+			continue
+		}
+
+		if strings.HasPrefix(line, "## ") {
+			break
+		}
+
+		if strings.HasPrefix(line, "    ") || strings.TrimSpace(line) == "" {
+			lines = append(lines, strings.TrimPrefix(line, "    "))
+		}
+	}
+
+	example = strings.Join(lines, "\n")
+
+	return example, err
+}
+
+func secretNames(secrets []*Secret) (names []string) {
+	names = make([]string, 0)
+	for _, secret := range secrets {
+		names = append(names, secret.Team+"/"+secret.Name)
+	}
+
+	return names
+}
+
+func TestReadmeRoleBlocks(t *testing.T) {
+	example, err := readmeConfigExample()
+	if err != nil {
+		log.Printf("Failed to read README: %s", err)
+		t.Fail()
+		return
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	team, err := km.NewTeam([]byte(example), true)
+	if err != nil {
+		log.Printf("Error creating team from README example: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, 1, len(team.Roles), "repeated blocks become one role")
+
+	role := team.RolesMap["app1"]
+	if role == nil {
+		log.Printf("No role app1")
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, 4, len(role.Realms), "realms of every block are kept")
+
+	expected := map[string][]string{
+		"production":  {"test-team1/foo", "test-team1/wip", "test-team2/baz", "test-team1/blah", "test-team1/bloo"},
+		"staging":     {"test-team1/foo", "test-team1/wip", "test-team2/baz"},
+		"development": {"test-team1/foo", "test-team1/wip", "test-team2/baz"},
+	}
+
+	for env, names := range expected {
+		assert.ElementsMatch(t, names, secretNames(role.SecretsForEnv(env)), "secrets in %s meet expectations", env)
+
+		policy, err := km.MakePolicyPayload(role, env)
+		if err != nil {
+			log.Printf("Error creating policy: %s", err)
+			t.Fail()
+			return
+		}
+
+		paths := policy["path"].(map[string]interface{})
+
+		// a data and a metadata path for each secret, plus the role's own policy.  test-team2/baz could be a certificate, so it gets its cert paths too.
+		assert.Equal(t, len(names)*2+3, len(paths), "policy in %s grants just its own secrets", env)
+	}
+
+	// the auth configs the realms write.  Realms that write the same one in the same Environment have to agree on who logs in with it.
+	km.SetK8sClusters([]*Cluster{{Name: "bravo"}})
+	km.SetTlsAuthCaCert(planAuthCA)
+
+	principals := make(map[string]interface{})
+
+	for _, realm := range role.Realms {
+		var path string
+		var data map[string]interface{}
+		var field string
+
+		switch realm.Type {
+		case K8S:
+			cluster := km.K8sClustersByName[realm.Identifiers[0]]
+			path, err = km.K8sAuthPath(cluster, role)
+			data = km.k8sAuthData(cluster, realm, nil)
+			field = "bound_service_account_namespaces"
+		case IAM:
+			path, err = km.IamAuthPath(role)
+			data = iamAuthData(realm, nil)
+			field = "bound_iam_principal_arn"
+		case TLS:
+			path, err = km.TlsAuthPath(role, realm.Environment)
+			if err == nil {
+				data, err = km.tlsAuthData(role, realm.Environment, nil)
+			}
+			field = "allowed_common_names"
+		}
+
+		if err != nil {
+			log.Printf("Error building auth config for %s realm in %s: %s", realm.Type, realm.Environment, err)
+			t.Fail()
+			return
+		}
+
+		key := fmt.Sprintf("%s in %s", path, realm.Environment)
+
+		existing, ok := principals[key]
+		if ok {
+			assert.Equal(t, existing, data[field], "realms writing %s agree on its principals", key)
+		}
+
+		principals[key] = data[field]
+	}
+
+	expectedPrincipals := map[string]interface{}{
+		"auth/k8s-bravo/role/test-team1-app1 in production":          "app1",
+		"auth/aws/role/test-team1-app1 in staging":                   "arn:aws:iam::111111111111:role/foo,arn:aws:iam::111111111111:user/foo,arn:aws:iam::111111111111:role/foo-*,arn:aws:sts::111111111111:assumed-role/foo/*",
+		"auth/aws/role/test-team1-app1 in production":                "arn:aws:iam::222222222222:role/foo",
+		"auth/cert/certs/test-team1-app1-development in development": "foo.scribd.com",
+	}
+
+	assert.Equal(t, expectedPrincipals, principals, "each realm keeps its own principals in its own environment")
+}
+
+func TestMergeRoleBlocks(t *testing.T) {
+	inputs := []struct {
+		name  string
+		roles string
+		err   string
+	}{
+		{
+			"duplicate-realm",
+			`
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: bar
+`,
+			"",
+		},
+		{
+			"contradictory-k8s",
+			`
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app2
+        environment: production
+    secrets:
+      - name: bar
+`,
+			ERR_CONTRADICTORY_ROLE_BLOCKS,
+		},
+		{
+			"k8s-in-other-cluster",
+			`
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - bravo
+        principals:
+          - app2
+        environment: production
+    secrets:
+      - name: bar
+`,
+			"",
+		},
+		{
+			"contradictory-iam",
+			`
+  - name: app1
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::111111111111:role/foo"
+        environment: production
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::222222222222:role/foo"
+        environment: production
+    secrets:
+      - name: bar
+`,
+			ERR_CONTRADICTORY_ROLE_BLOCKS,
+		},
+		{
+			"iam-in-other-environment",
+			`
+  - name: app1
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::111111111111:role/foo"
+        environment: staging
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::222222222222:role/foo"
+        environment: production
+    secrets:
+      - name: foo
+      - name: bar
+`,
+			"",
+		},
+		{
+			"k8s-in-other-environment",
+			`
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app2
+        environment: production
+    secrets:
+      - name: foo
+      - name: bar
+`,
+			"",
+		},
+		{
+			"tls-in-other-environment",
+			`
+  - name: app1
+    realms:
+      - type: tls
+        principals:
+          - foo.scribd.com
+        environment: staging
+    secrets:
+      - name: foo
+  - name: app1
+    realms:
+      - type: tls
+        principals:
+          - bar.scribd.com
+        environment: production
+    secrets:
+      - name: foo
+      - name: bar
+`,
+			"",
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			teamData := `---
+name: team1
+secrets:
+  - name: foo
+    generator:
+      type: alpha
+      length: 8
+  - name: bar
+    generator:
+      type: alpha
+      length: 8
+roles:` + tc.roles + `
+environments:
+  - production
+  - staging
+`
+
+			team, err := km.NewTeam([]byte(teamData), true)
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error creating team: %s", err)
+				t.Fail()
+				return
+			}
+
+			role := team.RolesMap["app1"]
+
+			assert.Equal(t, 1, len(team.Roles), "blocks are merged")
+			assert.ElementsMatch(t, []string{"team1/foo", "team1/bar"}, secretNames(role.SecretsForEnv("production")), "secrets are merged")
+		})
+	}
+}
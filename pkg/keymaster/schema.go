@@ -0,0 +1,258 @@
+/*
+	These functions describe Team yaml as a JSON Schema.
+
+	The schema is generated from the Team, Role, Realm and Secret types, using their yaml tags, so it can't drift from what keymaster actually reads.  Generators take different options depending on their type, so those come from GeneratorOptions.
+
+	The generated schema is checked in at schema/team.schema.json, for editors and pre-commit hooks to validate Team files with.  A test fails if it's out of date.  Regenerate it with:
+
+		go test ./pkg/keymaster -run TestTeamSchemaFile -update-schema
+
+*/
+package keymaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const SCHEMA_ID = "https://github.com/scribd/keymaster/schema/team.schema.json"
+const ERR_UNKNOWN_GENERATOR_OPTION = "unknown option for generator"
+
+// GeneratorOption An option set in a Secret's generator block.
+type GeneratorOption struct {
+	Name        string
+	Type        string // a JSON Schema type.  Arrays are arrays of strings.
+	Required    bool
+	Description string
+}
+
+// GeneratorOptions The options each type of Generator takes, besides its type.
+var GeneratorOptions = map[string][]GeneratorOption{
+	"alpha": {
+		{Name: "length", Type: "integer", Required: true, Description: "number of characters"},
+	},
+	"hex": {
+		{Name: "length", Type: "integer", Required: true, Description: "number of characters"},
+	},
+	"uuid": {},
+	"chbs": {
+		{Name: "words", Type: "integer", Required: true, Description: "number of words"},
+	},
+	"rsa": {
+		{Name: "blocksize", Type: "integer", Description: "size of the key in bits"},
+	},
+	"tls": {
+		{Name: "cn", Type: "string", Required: true, Description: "common name of the certificate"},
+		{Name: "ca", Type: "string", Description: "PKI engine to issue the certificate from.  Defaults to the pki mount of the keymaster config, or 'service'"},
+		{Name: "role", Type: "string", Description: "PKI role to issue the certificate with.  Defaults to the pki role of the keymaster config, or 'keymaster'"},
+		{Name: "ttl", Type: "string", Description: "lifetime of the certificate.  Defaults to the pki ttl of the keymaster config, or '8760h'"},
+		{Name: "sans", Type: "array", Description: "subject alternative names"},
+		{Name: "ip_sans", Type: "array", Description: "IP subject alternative names"},
+	},
+	"static": {},
+}
+
+// schemaRequired the yaml fields that have to be set on each type.
+var schemaRequired = map[string][]string{
+	"Team":         {"name"},
+	"Role":         {"name"},
+	"Secret":       {"name"},
+	"Realm":        {"type", "environment"},
+	"RoleTemplate": {"name"},
+}
+
+// schemaEnums the values allowed for fields that only take a few.
+var schemaEnums = map[string][]string{
+	"Realm.type":            RealmTypes,
+	"Secret.tier":           EnvironmentTiers,
+	"ValidationRule.format": {VALIDATION_FORMAT_PEM_CERTIFICATE, VALIDATION_FORMAT_JSON},
+}
+
+// ValidateGeneratorOptions checks the options of a generator block are all ones its type of Generator takes.  Unknown types are left to NewGenerator().
+func ValidateGeneratorOptions(options GeneratorData) (unknown []string) {
+	unknown = make([]string, 0)
+
+	genType, ok := options["type"].(string)
+	if !ok {
+		return unknown
+	}
+
+	known, ok := GeneratorOptions[genType]
+	if !ok {
+		return unknown
+	}
+
+	for name := range options {
+		if name == "type" {
+			continue
+		}
+
+		found := false
+		for _, option := range known {
+			if option.Name == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// TeamSchema returns the JSON Schema of a Team's yaml.
+func TeamSchema() (schema map[string]interface{}) {
+	definitions := make(map[string]interface{})
+
+	schema = structSchema(reflect.TypeOf(Team{}), definitions)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = SCHEMA_ID
+	schema["title"] = "keymaster team"
+	schema["definitions"] = definitions
+
+	return schema
+}
+
+// TeamSchemaJSON returns the JSON Schema of a Team's yaml, formatted as it's checked in.
+func TeamSchemaJSON() (output []byte, err error) {
+	output, err = json.MarshalIndent(TeamSchema(), "", "  ")
+	if err != nil {
+		return output, err
+	}
+
+	output = append(output, '\n')
+
+	return output, err
+}
+
+// typeSchema returns the schema of a type.  Structs are added to the definitions, and referred to.
+func typeSchema(t reflect.Type, definitions map[string]interface{}) (schema map[string]interface{}) {
+	if t == reflect.TypeOf(GeneratorData{}) {
+		definitions["Generator"] = generatorSchema()
+		return map[string]interface{}{"$ref": "#/definitions/Generator"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Struct:
+		_, ok := definitions[t.Name()]
+		if !ok {
+			// added before it's filled in, in case the type refers to itself
+			definitions[t.Name()] = map[string]interface{}{}
+			definitions[t.Name()] = structSchema(t, definitions)
+		}
+
+		return map[string]interface{}{"$ref": fmt.Sprintf("#/definitions/%s", t.Name())}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), definitions)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	}
+
+	return map[string]interface{}{}
+}
+
+// structSchema returns the schema of a struct, from the yaml tags of its fields.  Fields without a yaml name aren't part of the config.
+func structSchema(t reflect.Type, definitions map[string]interface{}) (schema map[string]interface{}) {
+	properties := make(map[string]interface{})
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+
+		property := typeSchema(field.Type, definitions)
+
+		enum, ok := schemaEnums[fmt.Sprintf("%s.%s", t.Name(), name)]
+		if ok {
+			property["enum"] = enum
+		}
+
+		properties[name] = property
+	}
+
+	schema = map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+
+	required, ok := schemaRequired[t.Name()]
+	if ok {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// generatorSchema returns the schema of a generator block, with the options of each type of Generator.
+func generatorSchema() (schema map[string]interface{}) {
+	genTypes := make([]string, 0)
+	for genType := range GeneratorOptions {
+		genTypes = append(genTypes, genType)
+	}
+
+	sort.Strings(genTypes)
+
+	variants := make([]interface{}, 0)
+
+	for _, genType := range genTypes {
+		properties := map[string]interface{}{
+			"type": map[string]interface{}{"const": genType},
+		}
+
+		required := []string{"type"}
+
+		for _, option := range GeneratorOptions[genType] {
+			property := map[string]interface{}{
+				"type":        option.Type,
+				"description": option.Description,
+			}
+
+			if option.Type == "array" {
+				property["items"] = map[string]interface{}{"type": "string"}
+			}
+
+			properties[option.Name] = property
+
+			if option.Required {
+				required = append(required, option.Name)
+			}
+		}
+
+		variants = append(variants, map[string]interface{}{
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		})
+	}
+
+	schema = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"type"},
+		"properties": map[string]interface{}{
+			"type": map[string]interface{}{"type": "string", "enum": genTypes},
+		},
+		"oneOf": variants,
+	}
+
+	return schema
+}
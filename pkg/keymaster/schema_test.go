@@ -0,0 +1,119 @@
+package keymaster
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+var updateSchema = flag.Bool("update-schema", false, "rewrite schema/team.schema.json")
+
+const schemaFile = "../../schema/team.schema.json"
+
+func TestTeamSchemaFile(t *testing.T) {
+	expected, err := TeamSchemaJSON()
+	if err != nil {
+		log.Printf("Error generating schema: %s", err)
+		t.Fail()
+		return
+	}
+
+	if *updateSchema {
+		err = ioutil.WriteFile(schemaFile, expected, 0644)
+		if err != nil {
+			log.Printf("Error writing %s: %s", schemaFile, err)
+			t.Fail()
+		}
+
+		return
+	}
+
+	actual, err := ioutil.ReadFile(schemaFile)
+	if err != nil {
+		log.Printf("Error reading %s: %s", schemaFile, err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, string(expected), string(actual), "schema/team.schema.json is out of date.  Regenerate it with -update-schema")
+}
+
+func TestTeamSchema(t *testing.T) {
+	schema := TeamSchema()
+
+	definitions := schema["definitions"].(map[string]interface{})
+
+	for _, name := range []string{"Role", "Realm", "Secret", "Generator", "ShareGrant", "ValidationRule"} {
+		_, ok := definitions[name]
+		assert.True(t, ok, "%s is defined", name)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	for _, name := range []string{"name", "roles", "secrets", "environments"} {
+		_, ok := properties[name]
+		assert.True(t, ok, "team has %s", name)
+	}
+
+	for _, name := range []string{"SecretsMap", "RolesMap", "Files", "source"} {
+		_, ok := properties[name]
+		assert.False(t, ok, "team doesn't have %s", name)
+	}
+
+	realm := definitions["Realm"].(map[string]interface{})
+	assert.Equal(t, false, realm["additionalProperties"], "realms can't have unknown fields")
+	assert.Equal(t, []string{"type", "environment"}, realm["required"], "realms need a type and environment")
+
+	realmProperties := realm["properties"].(map[string]interface{})
+	_, ok := realmProperties["principals"]
+	assert.True(t, ok, "realms have principals")
+	assert.Equal(t, RealmTypes, realmProperties["type"].(map[string]interface{})["enum"], "realm types are listed")
+
+	generator := definitions["Generator"].(map[string]interface{})
+	variants := generator["oneOf"].([]interface{})
+	assert.Equal(t, len(GeneratorOptions), len(variants), "each type of generator has its options")
+
+	found := false
+	for _, v := range variants {
+		variant := v.(map[string]interface{})
+		genType := variant["properties"].(map[string]interface{})["type"].(map[string]interface{})["const"]
+		if genType == "tls" {
+			found = true
+			assert.Equal(t, []string{"type", "cn"}, variant["required"], "tls generators need a cn")
+			assert.Equal(t, false, variant["additionalProperties"], "generators can't have unknown options")
+		}
+	}
+
+	assert.True(t, found, "tls generator is described")
+}
+
+func TestGeneratorOptions(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	for genType := range GeneratorOptions {
+		_, err := km.NewGenerator(GeneratorData{"type": genType})
+		if err != nil && strings.HasPrefix(err.Error(), ERR_UNKNOWN_GENERATOR) {
+			log.Printf("Generator options for unknown generator %s", genType)
+			t.Fail()
+		}
+	}
+
+	inputs := []struct {
+		name    string
+		options GeneratorData
+		unknown []string
+	}{
+		{"known", GeneratorData{"type": "tls", "cn": "foo.scribd.com", "ttl": "24h"}, []string{}},
+		{"typo", GeneratorData{"type": "alpha", "lenght": 8}, []string{"lenght"}},
+		{"other-type", GeneratorData{"type": "uuid", "words": 4, "length": 8}, []string{"length", "words"}},
+		{"unknown-type", GeneratorData{"type": "nope", "length": 8}, []string{}},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.unknown, ValidateGeneratorOptions(tc.options), "unknown options are found")
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"strings"
 )
 
 // NewGenerator creates a new generator from the options given
@@ -22,7 +23,7 @@ func (km *KeyMaster) NewGenerator(options GeneratorData) (generator Generator, e
 		case "rsa":
 			return NewRSAGenerator(options)
 		case "tls":
-			return NewTlsGenerator(km.VaultClient, options)
+			return NewTlsGenerator(km.VaultClient, km.tlsGeneratorOptions(options))
 		case "static":
 			return NewStaticGenerator()
 		default:
@@ -38,32 +39,43 @@ func (km *KeyMaster) NewGenerator(options GeneratorData) (generator Generator, e
 
 // SecretPath Given a Name, Team, and Environment, returns the proper path in Vault where that secret is stored.
 func (km *KeyMaster) SecretPath(team string, name string, env string) (path string, err error) {
-	if team == "" {
-		err = errors.New("cannot make secret path for nameless team")
+	location, err := km.SecretLocation(team, name, env)
+	if err != nil {
 		return path, err
 	}
 
-	path = fmt.Sprintf("%s/data/%s/%s", team, name, env)
+	path = location.DataPath()
 
 	return path, err
 }
 
+// SecretMetadataPath Given a Name, Team, and Environment, returns the path of the KV v2 metadata for that secret.
+func (km *KeyMaster) SecretMetadataPath(team string, name string, env string) (path string, err error) {
+	location, err := km.SecretLocation(team, name, env)
+	if err != nil {
+		return path, err
+	}
+
+	return location.MetadataPath()
+}
+
 // CertPath Given a Name, Team, and Environment, returns the proper path in Vault where that Cert Secret is stored.
 func (km *KeyMaster) CertPath(team string, name string, env string) (path string, err error) {
-	if team == "" {
-		err = errors.New("cannot make cert secret path for nameless team")
+	location, err := km.CertLocation(team, name, env)
+	if err != nil {
 		return path, err
 	}
 
-	path = fmt.Sprintf("%s/data/certs/%s/%s", team, name, env)
+	path = location.DataPath()
 
 	return path, err
 }
 
-func (km *KeyMaster) WriteSecretForEnv(secret *Secret, secretPath string, env string) (err error) {
+// GenerateSecretData generates the data to be stored for a Secret in an Environment.  Data will be nil for types that cannot yet be stored.
+func (km *KeyMaster) GenerateSecretData(secret *Secret, env string) (data map[string]interface{}, err error) {
 	if secret.Generator == nil {
 		err = errors.New(fmt.Sprintf("nil generators are not suppported.  secret: %q", secret.Name))
-		return err
+		return data, err
 	}
 
 	switch secret.GeneratorData["type"] {
@@ -71,117 +83,191 @@ func (km *KeyMaster) WriteSecretForEnv(secret *Secret, secretPath string, env st
 		value, err := secret.Generator.Generate()
 		if err != nil {
 			err = errors.Wrapf(err, "failed to generate value for %q", secret.Name)
-			return err
+			return data, err
 		}
 
-		data := make(map[string]interface{})
-		sdata := make(map[string]interface{})
-
-		data["data"] = sdata
-
 		var vcert VaultCert
-		secretPath, err := km.SecretPath(secret.Team, secret.Name, env)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to create cert path")
-			return err
-		}
 
 		// value is a string, due to the signature on Generate(), but in this case it's parts that have to be unmarshalled and converted to interface types for writing.
 		err = json.Unmarshal([]byte(value), &vcert)
 		if err != nil {
 			err = errors.Wrapf(err, "failed to unmarshal cert info returned from generator")
-			return err
+			return data, err
 		}
 
-		sdata["private_key"] = vcert.Key
-		sdata["certificate"] = vcert.Cert
-		sdata["issuing_ca"] = vcert.CA
-		sdata["serial_number"] = vcert.Serial
-		sdata["ca_chain"] = vcert.Chain
-		sdata["private_key_type"] = vcert.Type
-		sdata["expiration"] = vcert.Expiration
-
-		jsonBytes, err := json.Marshal(secret.GeneratorData)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to marshal generator data for %q", secret.Name)
-		}
-
-		sdata["generator_data"] = base64.StdEncoding.EncodeToString(jsonBytes)
-
-		_, err = km.VaultClient.Logical().Write(secretPath, data)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to write secret to %s", secretPath)
-		}
+		data = TlsSecretData(vcert)
 
 	case "rsa":
 		// TODO Implement saving RSA Secrets
+		return data, err
+
 	default:
 		value, err := secret.Generator.Generate()
 		if err != nil {
 			err = errors.Wrapf(err, "failed to generate value for %q", secret.Name)
-			return err
+			return data, err
 		}
 
-		data := make(map[string]interface{})
-		sdata := make(map[string]interface{})
+		// static secrets take their value from the static secrets file, if one was supplied
+		if secret.GeneratorData["type"] == "static" {
+			seed, ok := km.StaticValue(secret.Team, secret.Name, env)
+			if ok {
+				if secret.Validation != nil {
+					problems := secret.Validation.Check(seed)
+					if len(problems) > 0 {
+						err = errors.Wrapf(errors.New(ERR_STATIC_VALUE_INVALID), "seeded value for %q in %s: %s", secret.Name, env, strings.Join(problems, ", "))
+						return data, err
+					}
+				}
+
+				value = seed
+			}
+		}
 
-		data["data"] = sdata
+		data = make(map[string]interface{})
 
-		sdata["value"] = value
+		data["value"] = value
+	}
 
-		jsonBytes, err := json.Marshal(secret.GeneratorData)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to marshal generator data for %q", secret.Name)
-		}
+	jsonBytes, err := json.Marshal(secret.GeneratorData)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal generator data for %q", secret.Name)
+		return data, err
+	}
 
-		sdata["generator_data"] = base64.StdEncoding.EncodeToString(jsonBytes)
+	data["generator_data"] = base64.StdEncoding.EncodeToString(jsonBytes)
 
-		_, err = km.VaultClient.Logical().Write(secretPath, data)
-		if err != nil {
-			err = errors.Wrapf(err, "failed to write secret to %s", secretPath)
-		}
+	return data, err
+}
+
+// WriteSecretForEnv generates a value for the Secret, and writes it to the Environment, regardless of what's already there.
+func (km *KeyMaster) WriteSecretForEnv(secret *Secret, env string) (err error) {
+	location, err := km.SecretLocationFor(secret, env)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create secret path")
+		return err
 	}
 
-	return err
+	data, err := km.GenerateSecretData(secret, env)
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		return err
+	}
+
+	return km.WriteSecretData(location, data)
+}
+
+// LostWrites The paths where a generated value was thrown away, as another writer filled the secret in first.
+type LostWrites []string
+
+func (l LostWrites) Error() string {
+	return fmt.Sprintf("%s: %s", ERR_LOST_WRITE, strings.Join(l, ", "))
 }
 
 // WriteSecretIfBlank writes a secret to each environment, but only if there's not already a value there.
+// On KV v2 mounts, writes use check-and-set against the version that was read.  If another writer gets there first, their value is kept.  Every environment is still written, and then the paths where that happened are returned as a LostWrites error.
 func (km *KeyMaster) WriteSecretIfBlank(secret *Secret, verbose bool) (err error) {
+	lost := make(LostWrites, 0)
+
 	verboseOutput(verbose, "checking secret %s", secret.Name)
 	for _, env := range secret.Environments {
 		verboseOutput(verbose, "  checking env %s", env)
-		secretPath, err := km.SecretPath(secret.Team, secret.Name, env)
+		location, err := km.SecretLocationFor(secret, env)
 		if err != nil {
 			err = errors.Wrapf(err, "failed to create secret path")
 			return err
 		}
+
+		secretPath := location.DataPath()
 		verboseOutput(verbose, "    path: %s", secretPath)
 
 		// check to see if the secret does not exist
-		s, err := km.VaultClient.Logical().Read(secretPath)
+		data, version, err := km.ReadSecretVersion(location)
 		if err != nil {
-			err = errors.Wrapf(err, "failed to read secret at %s", secretPath)
 			return err
 		}
 
-		// s will be nil if the secret does not exist
-		// warning: s will not be nil if there's a warning returned by the read
-		if s == nil {
-			verboseOutput(verbose, "secret is nil")
-			err = km.WriteSecretForEnv(secret, secretPath, env)
-			if err != nil {
+		// data will be nil if the secret does not exist, or if a kv v2 secret has been deleted.
+		if data == nil {
+			verboseOutput(verbose, "secret has no data")
+		} else if km.StaticSecretIsBlank(secret, env, data) {
+			verboseOutput(verbose, "static secret is blank, seeding value")
+		} else {
+			verboseOutput(verbose, "secret exists")
+			continue
+		}
+
+		newData, err := km.GenerateSecretData(secret, env)
+		if err != nil {
+			return err
+		}
+
+		if newData == nil {
+			continue
+		}
+
+		err = km.WriteSecretDataCas(location, newData, version)
+		if err != nil {
+			if !IsCasMismatch(err) {
 				return err
 			}
-		} else if s.Data["data"] == nil {
-			verboseOutput(verbose, "secret has no data element")
-			err = km.WriteSecretForEnv(secret, secretPath, env)
+
+			// someone else wrote the secret between our read and our write.  Theirs stands.
+			_, current, err := km.ReadSecretVersion(location)
 			if err != nil {
 				return err
 			}
+
+			verboseOutput(verbose, "secret at %s was written concurrently (now version %d).  Keeping the existing value.", secretPath, current)
+			lost = append(lost, secretPath)
+			continue
 		}
 
-		verboseOutput(verbose, "secret exists")
+		verboseOutput(verbose, "secret written")
+	}
+
+	if len(lost) > 0 {
+		err = lost
+		return err
 	}
 
 	return err
 }
+
+// StaticSecretIsBlank returns true if the secret is a Static Secret whose bucket holds an empty value, and the KeyMaster has a seeded value to put there.
+func (km *KeyMaster) StaticSecretIsBlank(secret *Secret, env string, data map[string]interface{}) (blank bool) {
+	if secret.GeneratorData["type"] != "static" {
+		return blank
+	}
+
+	_, ok := km.StaticValue(secret.Team, secret.Name, env)
+	if !ok {
+		return blank
+	}
+
+	blank = secretDataIsBlank(data)
+
+	return blank
+}
+
+// secretDataIsBlank returns true if there's no data, or the data is just an empty bucket as created for a Static Secret.
+func secretDataIsBlank(data map[string]interface{}) (blank bool) {
+	value, ok := data["value"].(string)
+	if ok && value != "" {
+		return blank
+	}
+
+	// any other keys in the bucket mean someone has put something here by hand.  Leave it alone.
+	for k := range data {
+		if k != "value" && k != "generator_data" {
+			return blank
+		}
+	}
+
+	blank = true
+
+	return blank
+}
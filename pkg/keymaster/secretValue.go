@@ -0,0 +1,232 @@
+/*
+	These functions turn what's stored in Vault back into Secrets, for the benefit of consumers.
+
+	Consumers only know the paths in their policies.  ParseSecretPath reverses the secret path templates to work out which Team, Secret and Environment a path belongs to, so consumers never need to reimplement the layout themselves.
+
+*/
+package keymaster
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+)
+
+const ERR_UNPARSEABLE_SECRET_PATH = "path is not a secret path"
+
+// placeholders for the template elements when reversing the path templates.  They can't appear in real paths.
+const pathMarkerTeam = "\x00team\x00"
+const pathMarkerName = "\x00name\x00"
+const pathMarkerEnv = "\x00env\x00"
+
+var pathMarkerPattern = regexp.MustCompile("\x00(team|name|env)\x00")
+
+// SecretValue A Secret as read back from Vault.  TLS Secrets have Tls set.  Other Secrets have Value set.
+type SecretValue struct {
+	Team    string
+	Name    string
+	Env     string
+	Type    string                 // the type of the generator that created it, if known
+	Value   string                 // the value of simple Secrets
+	Tls     *VaultCert             // the parts of TLS Secrets
+	Data    map[string]interface{} // everything that was stored, for Secrets put in place by hand
+	Version int                    // the KV v2 version of the value, 0 on KV v1
+}
+
+// NewSecretValue builds a SecretValue from the data stored in Vault.
+func NewSecretValue(elements SecretPathElements, data map[string]interface{}, version int) (value *SecretValue, err error) {
+	value = &SecretValue{
+		Team:    elements.Team,
+		Name:    elements.Name,
+		Env:     elements.Env,
+		Data:    data,
+		Version: version,
+	}
+
+	encoded, ok := data["generator_data"].(string)
+	if ok {
+		jsonBytes, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to decode generator data for %s", elements.Name)
+			return value, err
+		}
+
+		var generatorData GeneratorData
+
+		err = json.Unmarshal(jsonBytes, &generatorData)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to unmarshal generator data for %s", elements.Name)
+			return value, err
+		}
+
+		value.Type, _ = generatorData["type"].(string)
+	}
+
+	cert, err := TlsCertFromData(data)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read tls data for %s", elements.Name)
+		return value, err
+	}
+
+	if value.Type == "tls" || cert != nil {
+		value.Type = "tls"
+
+		if cert == nil {
+			cert = &VaultCert{}
+		}
+
+		value.Tls = cert
+
+		return value, err
+	}
+
+	raw, ok := data["value"]
+	if ok && raw != nil {
+		value.Value = fmt.Sprintf("%v", raw)
+	}
+
+	return value, err
+}
+
+// ReadSecretValue reads a Secret in an Environment from Vault.  The cert path is tried first, as TLS Secrets may also have a stale copy at the plain path in the legacy layout.  Value will be nil if the Secret does not exist.
+func (km *KeyMaster) ReadSecretValue(team string, name string, env string) (value *SecretValue, err error) {
+	elements := SecretPathElements{Team: team, Name: name, Env: env}
+
+	location, err := km.CertLocation(team, name, env)
+	if err != nil {
+		return value, err
+	}
+
+	value, err = km.ReadSecretValueAt(location, elements)
+	if err != nil || value != nil {
+		return value, err
+	}
+
+	location, err = km.SecretLocation(team, name, env)
+	if err != nil {
+		return value, err
+	}
+
+	return km.ReadSecretValueAt(location, elements)
+}
+
+// ReadSecretValueAt reads the Secret stored at a location.  Value will be nil if there's nothing there.
+func (km *KeyMaster) ReadSecretValueAt(location SecretLocation, elements SecretPathElements) (value *SecretValue, err error) {
+	data, version, err := km.ReadSecretVersion(location)
+	if err != nil {
+		return value, err
+	}
+
+	if data == nil {
+		return value, err
+	}
+
+	return NewSecretValue(elements, data, version)
+}
+
+// ParseSecretPath works out the Team, Name, and Environment of the Secret stored at a data path, according to the secret path templates.  Location is where the path points, which for TLS Secrets is under 'certs/'.
+func (km *KeyMaster) ParseSecretPath(path string) (elements SecretPathElements, location SecretLocation, err error) {
+	mountTemplate := km.SecretMountTemplate
+	if mountTemplate == "" {
+		mountTemplate = DEFAULT_SECRET_MOUNT_TEMPLATE
+	}
+
+	pathTemplate := km.SecretPathTemplate
+	if pathTemplate == "" {
+		pathTemplate = DEFAULT_SECRET_PATH_TEMPLATE
+	}
+
+	markers := SecretPathElements{
+		Team: pathMarkerTeam,
+		Name: pathMarkerName,
+		Env:  pathMarkerEnv,
+	}
+
+	mount, err := renderPathTemplate(mountTemplate, markers)
+	if err != nil {
+		return elements, location, err
+	}
+
+	secretPath, err := renderPathTemplate(pathTemplate, markers)
+	if err != nil {
+		return elements, location, err
+	}
+
+	// kv v2 paths have 'data/' after the mount.  kv v1 paths don't.  The version of the mount decides which applies.
+	for _, version := range []int{KV_V2, KV_V1} {
+		for _, prefix := range []string{"", "certs/"} {
+			template := SecretLocation{Mount: mount, Path: prefix + secretPath, KvVersion: version}
+
+			matched, ok := matchPathTemplate(template.DataPath(), path)
+			if !ok {
+				continue
+			}
+
+			actualMount, err := renderPathTemplate(mountTemplate, matched)
+			if err != nil {
+				return elements, location, err
+			}
+
+			actualVersion, err := km.KvVersion(actualMount)
+			if err != nil {
+				return elements, location, err
+			}
+
+			if actualVersion != version {
+				continue
+			}
+
+			actualPath, err := renderPathTemplate(pathTemplate, matched)
+			if err != nil {
+				return elements, location, err
+			}
+
+			elements = matched
+			location = SecretLocation{Mount: actualMount, Path: prefix + actualPath, KvVersion: version}
+
+			return elements, location, err
+		}
+	}
+
+	err = errors.New(fmt.Sprintf("%s: %s", ERR_UNPARSEABLE_SECRET_PATH, path))
+
+	return elements, location, err
+}
+
+// matchPathTemplate matches a path against a rendered template containing the element markers.
+func matchPathTemplate(template string, path string) (elements SecretPathElements, ok bool) {
+	markers := pathMarkerPattern.FindAllStringSubmatch(template, -1)
+
+	pattern := "^" + pathMarkerPattern.ReplaceAllLiteralString(regexp.QuoteMeta(template), "([^/]+)") + "$"
+
+	matches := regexp.MustCompile(pattern).FindStringSubmatch(path)
+	if matches == nil {
+		return elements, ok
+	}
+
+	found := make(map[string]string)
+
+	for i, marker := range markers {
+		value := matches[i+1]
+
+		// elements used more than once in the layout have to agree
+		previous, seen := found[marker[1]]
+		if seen && previous != value {
+			return elements, ok
+		}
+
+		found[marker[1]] = value
+	}
+
+	elements = SecretPathElements{
+		Team: found["team"],
+		Name: found["name"],
+		Env:  found["env"],
+	}
+
+	ok = elements.Team != "" && elements.Name != "" && elements.Env != ""
+
+	return elements, ok
+}
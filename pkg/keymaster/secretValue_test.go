@@ -0,0 +1,250 @@
+package keymaster
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseSecretPath(t *testing.T) {
+	inputs := []struct {
+		name          string
+		mountTemplate string
+		pathTemplate  string
+		path          string
+		out           SecretPathElements
+		cert          bool
+		err           string
+	}{
+		{
+			"default-layout",
+			"",
+			"",
+			"team1/data/foo/production",
+			SecretPathElements{Team: "team1", Name: "foo", Env: "production"},
+			false,
+			"",
+		},
+		{
+			"env-first",
+			"{{.Team}}",
+			"{{.Env}}/{{.Name}}",
+			"team1/data/production/foo",
+			SecretPathElements{Team: "team1", Name: "foo", Env: "production"},
+			false,
+			"",
+		},
+		{
+			"shared-mount",
+			"shared-secrets",
+			"{{.Team}}/{{.Name}}/{{.Env}}",
+			"shared-secrets/data/team1/foo/staging",
+			SecretPathElements{Team: "team1", Name: "foo", Env: "staging"},
+			false,
+			"",
+		},
+		{
+			"cert-path",
+			"",
+			"",
+			"team1/data/certs/foo.scribd.com/production",
+			SecretPathElements{Team: "team1", Name: "foo.scribd.com", Env: "production"},
+			true,
+			"",
+		},
+		{
+			"cert-path-env-first",
+			"{{.Team}}",
+			"{{.Env}}/{{.Name}}",
+			"team1/data/certs/production/foo.scribd.com",
+			SecretPathElements{Team: "team1", Name: "foo.scribd.com", Env: "production"},
+			true,
+			"",
+		},
+		{
+			"kv-v1",
+			"",
+			"",
+			"legacy-team1/foo/development",
+			SecretPathElements{Team: "legacy-team1", Name: "foo", Env: "development"},
+			false,
+			"",
+		},
+		{
+			"kv-v1-path-on-kv-v2-mount",
+			"",
+			"",
+			"team1/foo/development",
+			SecretPathElements{},
+			false,
+			ERR_UNPARSEABLE_SECRET_PATH,
+		},
+		{
+			"too-short",
+			"",
+			"",
+			"team1/data/foo",
+			SecretPathElements{},
+			false,
+			ERR_UNPARSEABLE_SECRET_PATH,
+		},
+		{
+			"metadata-path",
+			"",
+			"",
+			"team1/metadata/foo/production/extra",
+			SecretPathElements{},
+			false,
+			ERR_UNPARSEABLE_SECRET_PATH,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			km := NewKeyMaster(kmClient)
+
+			err := km.SetSecretPathTemplate(tc.mountTemplate, tc.pathTemplate)
+			if err != nil {
+				log.Printf("error setting templates: %s", err)
+				t.Fail()
+				return
+			}
+
+			elements, location, err := km.ParseSecretPath(tc.path)
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("error parsing path: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.out, elements, "parsed path meets expectations")
+			assert.Equal(t, tc.path, location.DataPath(), "location meets expectations")
+
+			// and back again
+			pathFunc := km.SecretPath
+			if tc.cert {
+				pathFunc = km.CertPath
+			}
+
+			path, err := pathFunc(elements.Team, elements.Name, elements.Env)
+			if err != nil {
+				log.Printf("error creating path: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.path, path, "path round trips")
+		})
+	}
+}
+
+const testPemBlock = `-----BEGIN CERTIFICATE-----
+MIIB
+-----END CERTIFICATE-----`
+
+func TestNewSecretValue(t *testing.T) {
+	elements := SecretPathElements{Team: "team1", Name: "foo", Env: "production"}
+
+	inputs := []struct {
+		name      string
+		data      map[string]interface{}
+		valueType string
+		value     string
+		tls       bool
+		chain     []string
+	}{
+		{
+			"generated",
+			map[string]interface{}{
+				"value":          "s3kr1t",
+				"generator_data": base64.StdEncoding.EncodeToString([]byte(`{"type":"alpha","length":6}`)),
+			},
+			"alpha",
+			"s3kr1t",
+			false,
+			nil,
+		},
+		{
+			"hand-entered",
+			map[string]interface{}{
+				"value": "s3kr1t",
+			},
+			"",
+			"s3kr1t",
+			false,
+			nil,
+		},
+		{
+			"tls",
+			map[string]interface{}{
+				"crt":            "CERT",
+				"key":            "KEY",
+				"ca":             "CA",
+				"chain":          testPemBlock + "\n" + testPemBlock,
+				"serial":         "01:02",
+				"type":           "rsa",
+				"expiration":     "1234567890",
+				"generator_data": base64.StdEncoding.EncodeToString([]byte(`{"type":"tls"}`)),
+			},
+			"tls",
+			"",
+			true,
+			[]string{testPemBlock, testPemBlock},
+		},
+		{
+			"tls-legacy",
+			map[string]interface{}{
+				"certificate":      "CERT",
+				"private_key":      "KEY",
+				"issuing_ca":       "CA",
+				"serial_number":    "01:02",
+				"private_key_type": "rsa",
+				"ca_chain":         []interface{}{"CA"},
+				"expiration":       1234567890,
+				"generator_data":   base64.StdEncoding.EncodeToString([]byte(`{"type":"tls"}`)),
+			},
+			"tls",
+			"",
+			true,
+			[]string{"CA"},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := NewSecretValue(elements, tc.data, 3)
+			if err != nil {
+				log.Printf("error creating value: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.valueType, value.Type, "type meets expectations")
+			assert.Equal(t, tc.value, value.Value, "value meets expectations")
+			assert.Equal(t, 3, value.Version, "version meets expectations")
+
+			if !tc.tls {
+				assert.True(t, value.Tls == nil, "not a tls secret")
+				return
+			}
+
+			if value.Tls == nil {
+				log.Printf("no tls parts")
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, "CERT", value.Tls.Cert, "certificate meets expectations")
+			assert.Equal(t, "KEY", value.Tls.Key, "key meets expectations")
+			assert.Equal(t, tc.chain, value.Tls.Chain, "chain meets expectations")
+			assert.Equal(t, 1234567890, value.Tls.Expiration, "expiration meets expectations")
+		})
+	}
+}
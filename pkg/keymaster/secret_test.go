@@ -62,58 +62,47 @@ func TestSecretPath(t *testing.T) {
 	}
 }
 
-//func TestCertPath(t *testing.T) {
-//	inputs := []struct {
-//		name       string
-//		secretName string
-//		team       string
-//		env        Environment
-//		output     string
-//	}{
-//		{
-//			"cert1",
-//			"foo",
-//			"red",
-//			Prod,
-//			"prod/data/certs/red/foo",
-//		},
-//		{
-//			"cert2",
-//			"bar",
-//			"green",
-//			Stage,
-//			"stage/data/certs/green/bar",
-//		},
-//		{
-//			"cert3",
-//			"baz",
-//			"blue",
-//			Dev,
-//			"dev/data/certs/blue/baz",
-//		},
-//		{
-//			"cert4",
-//			"wip",
-//			"team3",
-//			17,
-//			"dev/data/certs/team3/wip",
-//		},
-//	}
-//
-//	km := NewKeyMaster(kmClient)
-//
-//	for _, tc := range inputs {
-//		t.Run(tc.name, func(t *testing.T) {
-//			path, err := km.SecretPath(tc.team, tc.secretName, tc.env)
-//			if err != nil {
-//				log.Printf("error creating path: %s", err)
-//				t.Fail()
-//			}
-//
-//			assert.Equal(t, tc.output, path, "Created expected path.")
-//		})
-//	}
-//}
+func TestCertPath(t *testing.T) {
+	inputs := []struct {
+		name       string
+		secretName string
+		team       string
+		env        string
+		output     string
+	}{
+		{
+			"cert1",
+			"foo.scribd.com",
+			"red",
+			"production",
+			"red/data/certs/foo.scribd.com/production",
+		},
+		{
+			"cert2",
+			"bar.scribd.com",
+			"legacy-team1",
+			"staging",
+			"legacy-team1/certs/bar.scribd.com/staging",
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := km.CertPath(tc.team, tc.secretName, tc.env)
+			if err != nil {
+				log.Printf("error creating path: %s", err)
+				t.Fail()
+			}
+
+			assert.Equal(t, tc.output, path, "Created expected path.")
+		})
+	}
+
+	_, err := km.CertPath("", "foo.scribd.com", "production")
+	assert.True(t, err != nil, "nameless teams have no cert path")
+}
 
 func TestWriteSecretIfBlank(t *testing.T) {
 	inputs := []struct {
@@ -231,7 +220,7 @@ func TestWriteSecretIfBlank(t *testing.T) {
 				for _, env := range secret.Environments {
 					var path string
 					if secret.GeneratorData["type"] == "tls" {
-						path, err = km.SecretPath(secret.Team, secret.Name, env)
+						path, err = km.CertPath(secret.Team, secret.Name, env)
 						if err != nil {
 							log.Printf("error creating path: %s", err)
 							t.Fail()
@@ -257,12 +246,12 @@ func TestWriteSecretIfBlank(t *testing.T) {
 						if ok {
 
 							if secret.GeneratorData["type"] == "tls" {
-								_, ok := secretData["certificate"]
+								_, ok := secretData[TLS_FIELD_CRT]
 								if !ok {
 									fmt.Printf("No Certificate stored for %s\n", secret.Name)
 									t.Fail()
 								}
-								_, ok = secretData["private_key"]
+								_, ok = secretData[TLS_FIELD_KEY]
 								if !ok {
 									fmt.Printf("No key stored for %s\n", secret.Name)
 									t.Fail()
@@ -356,3 +345,60 @@ func TestWriteSecretIfBlank(t *testing.T) {
 		//}
 	}
 }
+
+func TestSecretEnvironmentSubset(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	team, err := km.NewTeam([]byte(`---
+name: secret-team3
+secrets:
+  - name: live-key
+    environments:
+      - production
+    generator:
+      type: alpha
+      length: 10
+roles:
+environments:
+  - production
+  - staging
+  - development
+`), true)
+	if err != nil {
+		log.Printf("Failed to load team: %s", err)
+		t.Fail()
+		return
+	}
+
+	secret := team.SecretsMap["live-key"]
+	assert.Equal(t, []string{"production"}, secret.Environments, "secret only exists in production")
+
+	err = km.WriteSecretIfBlank(secret, true)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	for _, env := range team.Environments {
+		location, err := km.SecretLocation(secret.Team, secret.Name, env)
+		if err != nil {
+			log.Printf("error creating location: %s", err)
+			t.Fail()
+			return
+		}
+
+		data, err := km.ReadSecretData(location)
+		if err != nil {
+			log.Printf("Failed to read secret: %s", err)
+			t.Fail()
+			return
+		}
+
+		if env == "production" {
+			assert.True(t, data != nil, "secret written in %s", env)
+		} else {
+			assert.True(t, data == nil, "no bucket created in %s", env)
+		}
+	}
+}
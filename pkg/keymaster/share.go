@@ -0,0 +1,79 @@
+/*
+	These functions handle the grants by which a Team shares its Secrets with other Teams.
+
+	A Role can only use a Secret of another Team if the owning Team says so in its own yaml:
+
+	- name: payment-provider-key
+	  generator:
+	    type: static
+	  shared_with:
+	    - team: checkout                # every role of the checkout team, in every environment
+	    - team: billing
+	      role: invoicer                # just this role
+	      environments:                 # and only here
+	        - production
+
+	The consent is then in the owner's file, where CODEOWNERS can make the owning Team approve it.  The grants are enforced when the whole Org is loaded.
+
+*/
+package keymaster
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const ERR_SHARE_WITHOUT_TEAM = "shared_with entries need a team"
+const ERR_SHARE_ENVIRONMENT_NOT_IN_SECRET = "shared_with environment is not one of the secret's environments"
+const ERR_SECRET_NOT_SHARED = "role references a secret of another team that is not shared with it"
+
+// ShareGrant Permission for Roles of another Team to use a Secret.  Role and Environments narrow the grant.  Left empty, they allow every Role and every Environment.
+type ShareGrant struct {
+	Team         string   `yaml:"team"`
+	Role         string   `yaml:"role"`
+	Environments []string `yaml:"environments"`
+}
+
+// ValidateSharing checks the Secret's share grants make sense.
+func (s *Secret) ValidateSharing() (err error) {
+	for _, grant := range s.SharedWith {
+		if grant.Team == "" {
+			err = errors.New(fmt.Sprintf("%s: secret %s", ERR_SHARE_WITHOUT_TEAM, s.Name))
+			return err
+		}
+
+		for _, env := range grant.Environments {
+			if !stringInSlice(env, s.Environments) {
+				err = errors.New(fmt.Sprintf("%s: secret %s env %s", ERR_SHARE_ENVIRONMENT_NOT_IN_SECRET, s.Name, env))
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+// IsSharedWith returns true if a Role of a Team may use the Secret in an Environment.  Roles of the Team that owns the Secret always may.
+func (s *Secret) IsSharedWith(team string, role string, env string) bool {
+	if team == s.Team {
+		return true
+	}
+
+	for _, grant := range s.SharedWith {
+		if grant.Team != team {
+			continue
+		}
+
+		if grant.Role != "" && grant.Role != role {
+			continue
+		}
+
+		if len(grant.Environments) > 0 && !stringInSlice(env, grant.Environments) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,101 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestValidateSharing(t *testing.T) {
+	inputs := []struct {
+		name   string
+		grants []*ShareGrant
+		err    string
+	}{
+		{
+			"no-grants",
+			nil,
+			"",
+		},
+		{
+			"good-grants",
+			[]*ShareGrant{
+				{Team: "team2"},
+				{Team: "team3", Role: "app1", Environments: []string{"production"}},
+			},
+			"",
+		},
+		{
+			"no-team",
+			[]*ShareGrant{
+				{Role: "app1"},
+			},
+			ERR_SHARE_WITHOUT_TEAM,
+		},
+		{
+			"bad-environment",
+			[]*ShareGrant{
+				{Team: "team2", Environments: []string{"development"}},
+			},
+			ERR_SHARE_ENVIRONMENT_NOT_IN_SECRET,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := &Secret{
+				Name:         "foo",
+				Team:         "team1",
+				Environments: []string{"production", "staging"},
+				SharedWith:   tc.grants,
+			}
+
+			err := secret.ValidateSharing()
+			if tc.err != "" {
+				assert.True(t, err != nil && strings.HasPrefix(err.Error(), tc.err), "expected %q, got %v", tc.err, err)
+				return
+			}
+
+			if err != nil {
+				log.Printf("Error validating grants: %s", err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestIsSharedWith(t *testing.T) {
+	secret := &Secret{
+		Name:         "foo",
+		Team:         "team1",
+		Environments: []string{"production", "staging"},
+		SharedWith: []*ShareGrant{
+			{Team: "team2"},
+			{Team: "team3", Role: "app1"},
+			{Team: "team4", Environments: []string{"staging"}},
+		},
+	}
+
+	inputs := []struct {
+		name string
+		team string
+		role string
+		env  string
+		out  bool
+	}{
+		{"own-team", "team1", "app9", "production", true},
+		{"whole-team", "team2", "app9", "production", true},
+		{"named-role", "team3", "app1", "production", true},
+		{"other-role", "team3", "app2", "production", false},
+		{"named-environment", "team4", "app1", "staging", true},
+		{"other-environment", "team4", "app1", "production", false},
+		{"not-shared", "team5", "app1", "production", false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.out, secret.IsSharedWith(tc.team, tc.role, tc.env), "sharing meets expectations")
+		})
+	}
+}
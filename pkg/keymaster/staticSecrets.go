@@ -0,0 +1,213 @@
+/*
+	These functions seed the values of Static Secrets from an encrypted file that lives alongside the Team yaml.
+
+	The file is SOPS-style: the structure is plain yaml, and only the leaf values are encrypted, so the file can be reviewed like any other config.
+
+	---
+	team: team1
+	secrets:
+	  blort:
+	    production: ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+	    staging: ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+
+	Values are encrypted with AES-256-GCM using a locally provided 32 byte key.  The path to the value (e.g. 'team1:blort:production:') is used as additional data, so an encrypted value cannot be moved to another secret or environment.
+
+	Seeded values are only ever written into blank buckets.  A value that's already in Vault is never overwritten.
+
+*/
+package keymaster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const ERR_STATIC_SECRETS_LOAD = "failed to load static secrets file"
+const ERR_STATIC_SECRETS_KEY = "static secrets key must be 32 bytes"
+const ERR_STATIC_SECRETS_TEAMLESS = "static secrets file does not name a team"
+const ERR_STATIC_SECRETS_BAD_VALUE = "malformed encrypted static secret value"
+const ERR_STATIC_SECRETS_DECRYPT = "failed to decrypt static secret value"
+
+var encryptedValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:str\]$`)
+
+// StaticSecrets Values for the Static Secrets of a Team, by secret name and environment.
+type StaticSecrets struct {
+	Team    string                       `yaml:"team"`
+	Secrets map[string]map[string]string `yaml:"secrets"`
+}
+
+// SetStaticSecrets Adds decrypted Static Secret values to the KeyMaster.  Replaces any values previously set for the same Team.
+func (km *KeyMaster) SetStaticSecrets(staticSecrets *StaticSecrets) {
+	if km.StaticSecrets == nil {
+		km.StaticSecrets = make(map[string]*StaticSecrets)
+	}
+
+	km.StaticSecrets[staticSecrets.Team] = staticSecrets
+}
+
+// StaticValue returns the seeded value for a Static Secret in an Environment, if there is one.
+func (km *KeyMaster) StaticValue(team string, name string, env string) (value string, ok bool) {
+	staticSecrets, ok := km.StaticSecrets[team]
+	if !ok {
+		return value, ok
+	}
+
+	values, ok := staticSecrets.Secrets[name]
+	if !ok {
+		return value, ok
+	}
+
+	value, ok = values[env]
+
+	return value, ok
+}
+
+// LoadStaticSecretsFile reads and decrypts a static secrets file.
+func LoadStaticSecretsFile(fileName string, key []byte) (staticSecrets *StaticSecrets, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read static secrets file %s", fileName)
+		return staticSecrets, err
+	}
+
+	staticSecrets, err = DecryptStaticSecrets(data, key)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to decrypt %s", fileName)
+		return staticSecrets, err
+	}
+
+	return staticSecrets, err
+}
+
+// DecryptStaticSecrets parses the contents of a static secrets file, and decrypts every value in it.
+func DecryptStaticSecrets(data []byte, key []byte) (staticSecrets *StaticSecrets, err error) {
+	err = yaml.Unmarshal(data, &staticSecrets)
+	if err != nil {
+		err = errors.Wrap(err, ERR_STATIC_SECRETS_LOAD)
+		return staticSecrets, err
+	}
+
+	if staticSecrets == nil || staticSecrets.Team == "" {
+		err = errors.New(ERR_STATIC_SECRETS_TEAMLESS)
+		return staticSecrets, err
+	}
+
+	for name, values := range staticSecrets.Secrets {
+		for env, encrypted := range values {
+			value, err := DecryptStaticValue(key, staticSecrets.Team, name, env, encrypted)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to decrypt secret %s in env %s", name, env)
+				return staticSecrets, err
+			}
+
+			values[env] = value
+		}
+	}
+
+	return staticSecrets, err
+}
+
+// EncryptStaticValue encrypts a single Static Secret value for inclusion in a static secrets file.
+func EncryptStaticValue(key []byte, team string, name string, env string, value string) (encrypted string, err error) {
+	gcm, err := staticSecretsCipher(key)
+	if err != nil {
+		return encrypted, err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(iv)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to generate iv")
+		return encrypted, err
+	}
+
+	sealed := gcm.Seal(nil, iv, []byte(value), staticValueAdditionalData(team, name, env))
+
+	// like SOPS, the tag is stored separately from the ciphertext
+	ciphertext := sealed[:len(sealed)-gcm.Overhead()]
+	tag := sealed[len(sealed)-gcm.Overhead():]
+
+	encrypted = fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(tag),
+	)
+
+	return encrypted, err
+}
+
+// DecryptStaticValue decrypts a single value from a static secrets file.
+func DecryptStaticValue(key []byte, team string, name string, env string, encrypted string) (value string, err error) {
+	gcm, err := staticSecretsCipher(key)
+	if err != nil {
+		return value, err
+	}
+
+	matches := encryptedValuePattern.FindStringSubmatch(strings.TrimSpace(encrypted))
+	if matches == nil {
+		err = errors.New(ERR_STATIC_SECRETS_BAD_VALUE)
+		return value, err
+	}
+
+	parts := make([][]byte, 0)
+
+	for _, match := range matches[1:] {
+		part, err := base64.StdEncoding.DecodeString(match)
+		if err != nil {
+			err = errors.Wrap(err, ERR_STATIC_SECRETS_BAD_VALUE)
+			return value, err
+		}
+
+		parts = append(parts, part)
+	}
+
+	ciphertext, iv, tag := parts[0], parts[1], parts[2]
+
+	if len(iv) != gcm.NonceSize() {
+		err = errors.New(ERR_STATIC_SECRETS_BAD_VALUE)
+		return value, err
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), staticValueAdditionalData(team, name, env))
+	if err != nil {
+		err = errors.Wrap(err, ERR_STATIC_SECRETS_DECRYPT)
+		return value, err
+	}
+
+	value = string(plaintext)
+
+	return value, err
+}
+
+func staticSecretsCipher(key []byte) (gcm cipher.AEAD, err error) {
+	if len(key) != 32 {
+		err = errors.New(ERR_STATIC_SECRETS_KEY)
+		return gcm, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create cipher")
+		return gcm, err
+	}
+
+	gcm, err = cipher.NewGCM(block)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create gcm")
+		return gcm, err
+	}
+
+	return gcm, err
+}
+
+func staticValueAdditionalData(team string, name string, env string) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s:", team, name, env))
+}
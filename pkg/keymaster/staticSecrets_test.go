@@ -0,0 +1,217 @@
+package keymaster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+var testStaticKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestStaticValueEncryption(t *testing.T) {
+	inputs := []struct {
+		name    string
+		key     []byte
+		team    string
+		secret  string
+		env     string
+		decTeam string
+		decName string
+		decEnv  string
+		out     string
+	}{
+		{
+			"roundtrip",
+			testStaticKey,
+			"team1",
+			"blort",
+			"production",
+			"team1",
+			"blort",
+			"production",
+			"",
+		},
+		{
+			"moved-env",
+			testStaticKey,
+			"team1",
+			"blort",
+			"production",
+			"team1",
+			"blort",
+			"development",
+			ERR_STATIC_SECRETS_DECRYPT,
+		},
+		{
+			"moved-secret",
+			testStaticKey,
+			"team1",
+			"blort",
+			"production",
+			"team1",
+			"foo",
+			"production",
+			ERR_STATIC_SECRETS_DECRYPT,
+		},
+		{
+			"short-key",
+			[]byte("tooshort"),
+			"team1",
+			"blort",
+			"production",
+			"team1",
+			"blort",
+			"production",
+			ERR_STATIC_SECRETS_KEY,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypted, err := EncryptStaticValue(tc.key, tc.team, tc.secret, tc.env, "s3kr1t")
+			if err != nil {
+				assert.True(t, strings.HasPrefix(err.Error(), tc.out), "expected %q, got %q", tc.out, err.Error())
+				return
+			}
+
+			assert.False(t, strings.Contains(encrypted, "s3kr1t"), "encrypted value does not contain plaintext")
+
+			value, err := DecryptStaticValue(tc.key, tc.decTeam, tc.decName, tc.decEnv, encrypted)
+			if tc.out == "" {
+				if err != nil {
+					log.Printf("Error decrypting value: %s", err)
+					t.Fail()
+				}
+				assert.Equal(t, "s3kr1t", value, "decrypted value matches")
+				return
+			}
+
+			if err == nil {
+				log.Printf("Decrypting %s should have failed", tc.name)
+				t.Fail()
+				return
+			}
+
+			assert.True(t, strings.HasPrefix(err.Error(), tc.out), "expected %q, got %q", tc.out, err.Error())
+		})
+	}
+
+	_, err := DecryptStaticValue(testStaticKey, "team1", "blort", "production", "not encrypted")
+	assert.True(t, err != nil && err.Error() == ERR_STATIC_SECRETS_BAD_VALUE, "plaintext values are rejected")
+}
+
+func TestWriteStaticSecretFromFile(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	team := "secret-team1"
+	envs := []string{"production", "staging", "development"}
+
+	fileContents := fmt.Sprintf("---\nteam: %s\nsecrets:\n  seeded:\n", team)
+
+	for _, env := range envs {
+		encrypted, err := EncryptStaticValue(testStaticKey, team, "seeded", env, fmt.Sprintf("seed-%s", env))
+		if err != nil {
+			log.Printf("Failed to encrypt value: %s", err)
+			t.Fail()
+			return
+		}
+
+		fileContents += fmt.Sprintf("    %s: %s\n", env, encrypted)
+	}
+
+	staticSecrets, err := DecryptStaticSecrets([]byte(fileContents), testStaticKey)
+	if err != nil {
+		log.Printf("Failed to decrypt static secrets: %s", err)
+		t.Fail()
+		return
+	}
+
+	km.SetStaticSecrets(staticSecrets)
+
+	secret := &Secret{
+		Name: "seeded",
+		Team: team,
+		GeneratorData: GeneratorData{
+			"type": "static",
+		},
+		Environments: envs,
+	}
+
+	g, err := km.NewGenerator(secret.GeneratorData)
+	if err != nil {
+		log.Printf("Error creating generator: %s", err)
+		t.Fail()
+		return
+	}
+
+	secret.SetGenerator(g)
+
+	// production has already been set by hand, staging is an empty bucket, development doesn't exist yet.
+	path, err := km.SecretPath(team, secret.Name, "production")
+	if err != nil {
+		log.Printf("error creating path: %s", err)
+		t.Fail()
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, map[string]interface{}{"data": map[string]interface{}{"value": "set-by-hand"}})
+	if err != nil {
+		log.Printf("Failed to write %s: %s", path, err)
+		t.Fail()
+	}
+
+	path, err = km.SecretPath(team, secret.Name, "staging")
+	if err != nil {
+		log.Printf("error creating path: %s", err)
+		t.Fail()
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, map[string]interface{}{"data": map[string]interface{}{"value": ""}})
+	if err != nil {
+		log.Printf("Failed to write %s: %s", path, err)
+		t.Fail()
+	}
+
+	err = km.WriteSecretIfBlank(secret, true)
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := map[string]string{
+		"production":  "set-by-hand",
+		"staging":     "seed-staging",
+		"development": "seed-development",
+	}
+
+	for _, env := range envs {
+		path, err := km.SecretPath(team, secret.Name, env)
+		if err != nil {
+			log.Printf("error creating path: %s", err)
+			t.Fail()
+		}
+
+		s, err := km.VaultClient.Logical().Read(path)
+		if err != nil {
+			log.Printf("Unable to read %q: %s\n", path, err)
+			t.Fail()
+		}
+
+		if s == nil {
+			log.Printf("Nil secret at %s\n", path)
+			t.Fail()
+			continue
+		}
+
+		data, ok := s.Data["data"].(map[string]interface{})
+		if !ok {
+			log.Printf("No data at %s\n", path)
+			t.Fail()
+			continue
+		}
+
+		assert.Equal(t, expected[env], data["value"], "value in %s meets expectations", env)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+	These functions expand the templates Roles can extend.
+
+	Many Roles share the same Realms: the same clusters, the same AWS account, the same pattern for principals.  Rather than copying them from Role to Role, define a template, and have the Roles extend it:
+
+	templates:
+	  - name: k8s-service
+	    realms:
+	      - type: k8s
+	        identifiers:
+	          - alpha
+	          - bravo
+	        principals:
+	          - "{{.namespace}}"
+	        environment: production
+	  - name: aws-service
+	    extends:                          # templates can include other templates
+	      - k8s-service
+	    realms:
+	      - type: iam
+	        principals:
+	          - "arn:aws:iam::111111111111:role/{{.Team}}-{{.Role}}"
+	        environment: production
+	roles:
+	  - name: app1
+	    extends:
+	      - aws-service
+	    params:
+	      namespace: app1
+	    secrets:
+	      - name: foo
+
+	A Role block gets the Realms and Secrets of each template it extends, as if they were written in the block.  Strings in templates are Go templates, given the block's params, and .Team and .Role, the names of the Team and the Role.  Using a param the Role doesn't give is an error, as is a param named Team or Role.
+
+	Templates can be defined in a Team's yaml, for its own Roles, or in the keymaster config, for every Team.  A Team's template hides one of the same name in the config.
+
+	Templates are expanded before the Team is checked.  Problems in expanded content are reported where they are in the template, and where the template was used:
+
+		iam principals must be IAM role or user ARNs: "arn:aws:iam::1111:role/team1-app1" (keymaster.yml:40:13 templates[1].realms[0].principals[0], via team1.yml:22:9 roles[0].extends[0])
+
+*/
+package keymaster
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"text/template"
+)
+
+const ERR_NAMELESS_TEMPLATE = "nameless templates are not supported"
+const ERR_DUPLICATE_TEMPLATE = "template is defined more than once"
+const ERR_UNKNOWN_TEMPLATE = "unknown template"
+const ERR_TEMPLATE_CYCLE = "template extends itself"
+const ERR_TEMPLATE_SUBSTITUTION = "failed to fill in template"
+const ERR_PARAMS_WITHOUT_TEMPLATE = "role has params, but extends no templates"
+const ERR_RESERVED_PARAM = "param name is reserved for the name of the Team or Role"
+
+// RoleTemplate Realms and Secrets that Roles share by extending the template.
+type RoleTemplate struct {
+	Name    string    `yaml:"name"`
+	Extends []string  `yaml:"extends"` // other templates included in this one
+	Realms  []*Realm  `yaml:"realms"`
+	Secrets []*Secret `yaml:"secrets"`
+	source  *configSource
+}
+
+// SetRoleTemplates sets the templates every Team's Roles can extend.
+func (km *KeyMaster) SetRoleTemplates(templates []*RoleTemplate) {
+	km.RoleTemplates = templates
+}
+
+// validateTemplates checks each template in a list has a name of its own.
+func validateTemplates(templates []*RoleTemplate) (problems ConfigErrors) {
+	names := make([]string, 0)
+
+	for _, tmpl := range templates {
+		if tmpl.Name == "" {
+			problems = append(problems, tmpl.source.errorAt("name", errors.New(ERR_NAMELESS_TEMPLATE)))
+			continue
+		}
+
+		if stringInSlice(tmpl.Name, names) {
+			problems = append(problems, tmpl.source.errorAt("name", errors.New(fmt.Sprintf("%s: %s", ERR_DUPLICATE_TEMPLATE, tmpl.Name))))
+		}
+
+		names = append(names, tmpl.Name)
+	}
+
+	return problems
+}
+
+// expandRoleTemplates fills the Realms and Secrets of the templates each Role block extends into the block.
+func (km *KeyMaster) expandRoleTemplates(team *Team) (problems ConfigErrors) {
+	problems = append(problems, validateTemplates(team.Templates)...)
+
+	// the team's own templates hide the config's
+	templates := make(map[string]*RoleTemplate)
+	for _, tmpl := range km.RoleTemplates {
+		templates[tmpl.Name] = tmpl
+	}
+
+	for _, tmpl := range team.Templates {
+		templates[tmpl.Name] = tmpl
+	}
+
+	for _, role := range team.Roles {
+		if len(role.Extends) == 0 {
+			if len(role.Params) > 0 {
+				problems = append(problems, role.source.errorAt("params", errors.New(fmt.Sprintf("%s: %s", ERR_PARAMS_WITHOUT_TEMPLATE, role.Name))))
+			}
+
+			continue
+		}
+
+		values := map[string]string{
+			"Team": team.Name,
+			"Role": role.Name,
+		}
+
+		// a param can't stand in for the Team or Role, or templates would write paths and principals for someone else
+		for _, reserved := range []string{"Team", "Role"} {
+			_, ok := role.Params[reserved]
+			if ok {
+				problems = append(problems, role.source.errorAt(fmt.Sprintf("params.%s", reserved), errors.New(fmt.Sprintf("%s: %s", ERR_RESERVED_PARAM, reserved))))
+			}
+		}
+
+		for param, value := range role.Params {
+			_, reserved := values[param]
+			if !reserved {
+				values[param] = value
+			}
+		}
+
+		realms := make([]*Realm, 0)
+		secrets := make([]*Secret, 0)
+
+		for i, name := range role.Extends {
+			expandedRealms, expandedSecrets, expandProblems := expandTemplate(templates, name, values, role.source.child(fmt.Sprintf("extends[%d]", i)), []string{})
+			realms = append(realms, expandedRealms...)
+			secrets = append(secrets, expandedSecrets...)
+			problems = append(problems, expandProblems...)
+		}
+
+		role.Realms = append(realms, role.Realms...)
+		role.Secrets = append(secrets, role.Secrets...)
+	}
+
+	return problems
+}
+
+// expandTemplate returns copies of the Realms and Secrets of a template, and of the templates it extends, filled in with the values.  Use is where the template is extended, and extending is the chain of templates that led to it.
+func expandTemplate(templates map[string]*RoleTemplate, name string, values map[string]string, use *configSource, extending []string) (realms []*Realm, secrets []*Secret, problems ConfigErrors) {
+	realms = make([]*Realm, 0)
+	secrets = make([]*Secret, 0)
+
+	tmpl, ok := templates[name]
+	if !ok {
+		problems = append(problems, use.errorAt("", errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_TEMPLATE, name))))
+		return realms, secrets, problems
+	}
+
+	chain := append(append([]string{}, extending...), name)
+
+	if stringInSlice(name, extending) {
+		problems = append(problems, use.errorAt("", errors.New(fmt.Sprintf("%s: %s", ERR_TEMPLATE_CYCLE, strings.Join(chain, " -> ")))))
+		return realms, secrets, problems
+	}
+
+	source := tmpl.source.via(use)
+
+	for i, inner := range tmpl.Extends {
+		innerRealms, innerSecrets, innerProblems := expandTemplate(templates, inner, values, source.child(fmt.Sprintf("extends[%d]", i)), chain)
+		realms = append(realms, innerRealms...)
+		secrets = append(secrets, innerSecrets...)
+		problems = append(problems, innerProblems...)
+	}
+
+	// content that can't be filled in is left out, so it isn't reported again when it's checked
+	for i, realm := range tmpl.Realms {
+		fill := &templateFiller{values: values, source: source.child(fmt.Sprintf("realms[%d]", i))}
+
+		expanded := &Realm{
+			Type:        fill.field("type", realm.Type),
+			Environment: fill.field("environment", realm.Environment),
+			Identifiers: make([]string, 0),
+			Principals:  make([]string, 0),
+			source:      fill.source,
+		}
+
+		for j, identifier := range realm.Identifiers {
+			expanded.Identifiers = append(expanded.Identifiers, fill.field(fmt.Sprintf("identifiers[%d]", j), identifier))
+		}
+
+		for j, principal := range realm.Principals {
+			expanded.Principals = append(expanded.Principals, fill.field(fmt.Sprintf("principals[%d]", j), principal))
+		}
+
+		problems = append(problems, fill.problems...)
+		if len(fill.problems) == 0 {
+			realms = append(realms, expanded)
+		}
+	}
+
+	for i, secret := range tmpl.Secrets {
+		fill := &templateFiller{values: values, source: source.child(fmt.Sprintf("secrets[%d]", i))}
+
+		expanded := *secret
+		expanded.source = fill.source
+		expanded.Name = fill.field("name", secret.Name)
+		expanded.Team = fill.field("team", secret.Team)
+
+		problems = append(problems, fill.problems...)
+		if len(fill.problems) == 0 {
+			secrets = append(secrets, &expanded)
+		}
+	}
+
+	return realms, secrets, problems
+}
+
+// templateFiller fills in the strings of one part of a template, collecting the problems.
+type templateFiller struct {
+	values   map[string]string
+	source   *configSource
+	problems ConfigErrors
+}
+
+// field fills in one string, adding a problem at the field if it can't be.
+func (f *templateFiller) field(field string, text string) (filled string) {
+	filled, err := fillTemplate(text, f.values)
+	if err != nil {
+		f.problems = append(f.problems, f.source.errorAt(field, errors.Wrap(err, ERR_TEMPLATE_SUBSTITUTION)))
+	}
+
+	return filled
+}
+
+// fillTemplate fills the values into a string of a template.  Strings without actions are returned as they are.
+func fillTemplate(text string, values map[string]string) (filled string, err error) {
+	if !strings.Contains(text, "{{") {
+		return text, err
+	}
+
+	tmpl, err := template.New("param").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return text, err
+	}
+
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, values)
+	if err != nil {
+		return text, err
+	}
+
+	return buf.String(), err
+}
@@ -0,0 +1,582 @@
+package keymaster
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRoleTemplates(t *testing.T) {
+	inputs := []struct {
+		name   string
+		in     string
+		errs   []string
+		fields []string
+		via    []string
+	}{
+		{
+			"valid",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - aws-service
+    params:
+      namespace: app1
+      account: "111111111111"
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"unknown-template",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - aws-servcie
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_UNKNOWN_TEMPLATE + ": aws-servcie", ERR_REALMLESS_ROLE},
+			[]string{"roles[0].extends[0]", "roles[0].realms"},
+			[]string{"", ""},
+		},
+		{
+			"missing-param",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - aws-service
+    params:
+      account: "111111111111"
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_TEMPLATE_SUBSTITUTION},
+			[]string{"templates[0].realms[0].principals[0]"},
+			[]string{"templates[1].extends[0]"},
+		},
+		{
+			"invalid-expanded-content",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - aws-service
+    params:
+      namespace: App_1
+      account: "1111"
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_INVALID_K8S_PRINCIPAL, ERR_INVALID_IAM_PRINCIPAL},
+			[]string{"templates[0].realms[0].principals[0]", "templates[1].realms[0].principals[0]"},
+			[]string{"templates[1].extends[0]", "roles[0].extends[0]"},
+		},
+		{
+			"cycle",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: a
+    extends:
+      - b
+  - name: b
+    extends:
+      - a
+roles:
+  - name: app1
+    extends:
+      - a
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_TEMPLATE_CYCLE + ": a -> b -> a"},
+			[]string{"templates[1].extends[0]"},
+			[]string{"templates[0].extends[0]"},
+		},
+		{
+			"bad-templates",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+  - name: k8s-service
+  - realms: []
+roles:
+  - name: app1
+    params:
+      namespace: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: production
+environments:
+  - production
+  - staging
+`,
+			[]string{ERR_DUPLICATE_TEMPLATE + ": k8s-service", ERR_NAMELESS_TEMPLATE, ERR_PARAMS_WITHOUT_TEMPLATE},
+			[]string{"templates[2].name", "templates[3].name", "roles[0].params"},
+			[]string{"", "", ""},
+		},
+		{
+			"reserved-params",
+			`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.Team}}-{{.namespace}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - k8s-service
+    params:
+      namespace: app1
+      Team: someone-else
+      Role: admin
+    secrets:
+      - name: foo
+environments:
+  - production
+`,
+			[]string{ERR_RESERVED_PARAM + ": Team", ERR_RESERVED_PARAM + ": Role"},
+			[]string{"roles[0].params.Team", "roles[0].params.Role"},
+			[]string{"", ""},
+		},
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := km.NewTeam([]byte(tc.in), false)
+			if len(tc.errs) == 0 {
+				if err != nil {
+					log.Printf("Error creating team: %s", err)
+					t.Fail()
+				}
+
+				return
+			}
+
+			configErrs, ok := err.(ConfigErrors)
+			if !ok {
+				log.Printf("Expected config errors, got %v", err)
+				t.Fail()
+				return
+			}
+
+			if len(configErrs) != len(tc.errs) {
+				log.Printf("Expected %d problems, got: %s", len(tc.errs), configErrs)
+				t.Fail()
+				return
+			}
+
+			for i, configErr := range configErrs {
+				assert.True(t, strings.HasPrefix(configErr.Error(), tc.errs[i]), "expected %q, got %q", tc.errs[i], configErr)
+				assert.Equal(t, tc.fields[i], configErr.Field, "error names the field")
+				assert.True(t, configErr.Line > 0, "error gives the line")
+
+				if tc.via[i] == "" {
+					assert.True(t, configErr.Via == nil, "error isn't in a template")
+					continue
+				}
+
+				if configErr.Via == nil {
+					log.Printf("Expected %q to say where the template was used", configErr)
+					t.Fail()
+					continue
+				}
+
+				assert.Equal(t, tc.via[i], configErr.Via.Field, "error says where the template was used")
+				assert.True(t, configErr.Via.Line > 0, "error gives the line the template was used on")
+			}
+		})
+	}
+}
+
+func TestExpandedRoles(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	team, err := km.NewTeam([]byte(`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+    secrets:
+      - name: bar
+  - name: aws-service
+    extends:
+      - k8s-service
+    realms:
+      - type: iam
+        principals:
+          - "arn:aws:iam::{{.account}}:role/{{.Team}}-{{.Role}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - aws-service
+    params:
+      namespace: app1
+      account: "111111111111"
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - app1
+        environment: staging
+    secrets:
+      - name: foo
+  - name: app2
+    extends:
+      - k8s-service
+    params:
+      namespace: app2
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	app1 := team.RolesMap["app1"]
+	assert.Equal(t, 3, len(app1.Realms), "app1 has the realms of both templates, and its own")
+	assert.Equal(t, []string{"app1"}, app1.Realms[0].Principals, "params are filled in")
+	assert.Equal(t, []string{"arn:aws:iam::111111111111:role/templated-app1"}, app1.Realms[1].Principals, "team and role names are filled in")
+	assert.Equal(t, []string{"templated/bar", "templated/foo"}, secretNames(app1.SecretsForEnv("production")), "template secrets are granted where the block's realms are")
+
+	app2 := team.RolesMap["app2"]
+	assert.Equal(t, 1, len(app2.Realms), "app2 has the realms of its template")
+	assert.Equal(t, []string{"app2"}, app2.Realms[0].Principals, "each role gets its own copy of a template")
+
+	assert.Equal(t, []string{"{{.namespace}}"}, team.Templates[0].Realms[0].Principals, "templates aren't changed by expanding them")
+}
+
+func TestConfigRoleTemplates(t *testing.T) {
+	config, err := NewConfig("keymaster.yml", []byte(testConfig(`templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - "{{.namespace}}"
+        environment: production
+  - name: org-only
+    realms:
+      - type: tls
+        principals:
+          - "{{.Role}}"
+        environment: production
+`)))
+	if err != nil {
+		log.Printf("Error loading config: %s", err)
+		t.Fail()
+		return
+	}
+
+	km := NewKeyMaster(kmClient)
+
+	err = km.ApplyConfig(config)
+	if err != nil {
+		log.Printf("Error applying config: %s", err)
+		t.Fail()
+		return
+	}
+
+	// the team's k8s-service hides the config's
+	team, err := km.NewTeam([]byte(`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: k8s-service
+    realms:
+      - type: k8s
+        identifiers:
+          - bravo
+        principals:
+          - "{{.namespace}}"
+        environment: production
+roles:
+  - name: app1
+    extends:
+      - k8s-service
+    params:
+      namespace: app1
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"bravo"}, team.RolesMap["app1"].Realms[0].Identifiers, "team templates hide config templates")
+
+	_, err = km.NewTeam([]byte(`---
+name: templated
+secrets:
+  - name: foo
+    generator:
+      type: uuid
+  - name: bar
+    generator:
+      type: uuid
+templates:
+  - name: unused
+    realms: []
+roles:
+  - name: app1
+    extends:
+      - org-only
+    secrets:
+      - name: foo
+environments:
+  - production
+  - staging
+`), false)
+
+	configErrs, ok := err.(ConfigErrors)
+	if !ok || len(configErrs) != 1 {
+		log.Printf("Expected a config error, got %v", err)
+		t.Fail()
+		return
+	}
+
+	message := configErrs[0].Error()
+	assert.True(t, strings.HasPrefix(message, ERR_INVALID_TLS_PRINCIPAL), "expanded content is checked.  got %q", message)
+	assert.True(t, strings.Contains(message, "(keymaster.yml:"), "error is located in the config.  got %q", message)
+	assert.True(t, strings.Contains(message, "templates[1].realms[0].principals[0], via line 16 column 9 roles[0].extends[0])"), "error says where the template was used.  got %q", message)
+}
+
+func TestConfigErrorVia(t *testing.T) {
+	configErr := &ConfigError{
+		File:   "keymaster.yml",
+		Line:   40,
+		Column: 13,
+		Field:  "templates[1].realms[0].principals[0]",
+		Err:    errors.New("bad principal"),
+		Via: &ConfigError{
+			File:   "team1.yml",
+			Line:   22,
+			Column: 9,
+			Field:  "templates[0].extends[0]",
+			Via: &ConfigError{
+				File:   "team1.yml",
+				Line:   30,
+				Column: 9,
+				Field:  "roles[0].extends[0]",
+			},
+		},
+	}
+
+	assert.Equal(t, "bad principal (keymaster.yml:40:13 templates[1].realms[0].principals[0], via team1.yml:22:9 templates[0].extends[0], via team1.yml:30:9 roles[0].extends[0])", configErr.Error(), "every template used is listed")
+
+	configErr = &ConfigError{Field: "realms[0].type", Err: errors.New("bad type"), Via: &ConfigError{Field: "roles[0].extends[0]"}}
+	assert.Equal(t, "bad type (realms[0].type, via roles[0].extends[0])", configErr.Error(), "templates set in code still say where they were used")
+}
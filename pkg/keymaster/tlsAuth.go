@@ -66,30 +66,13 @@ func (km *KeyMaster) RemovePolicyFromTlsRole(role *Role, env string, policy Vaul
 }
 
 func (km *KeyMaster) GrantedPoliciesForTlsRole(role *Role, env string) (policies []string, err error) {
-	policies = make([]string, 0)
-
 	previousData, err := km.ReadTlsAuth(role, env)
 	if err != nil {
 		err = errors.Wrapf(err, "failed to fetch policy data for role %s", role.Name)
 		return policies, err
 	}
 
-	// fetch current policies for this host
-	if previousData != nil {
-		previousPolicies, ok := previousData["policies"].([]interface{})
-		if ok {
-			for _, p := range previousPolicies {
-				pname, ok := p.(string)
-				if ok {
-					policies = append(policies, pname)
-				}
-			}
-		}
-		return policies, err
-	}
-
-	// else return a list with the default policy
-	policies = append(policies, "default")
+	policies = grantedPolicies(previousData)
 
 	return policies, err
 }
@@ -134,14 +117,40 @@ func (km *KeyMaster) DeleteTlsAuth(role *Role, env string) (err error) {
 
 // WriteTlsAuth writes the auth config to vault
 func (km *KeyMaster) WriteTlsAuth(role *Role, env string, policies []string) (err error) {
+	data, err := km.tlsAuthData(role, env, policies)
+	if err != nil {
+		return err
+	}
+
+	path, err := km.TlsAuthPath(role, env)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create tls auth path")
+		return err
+	}
+
+	_, err = km.VaultClient.Logical().Write(path, data)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write to %s", path)
+		return err
+	}
+
+	return err
+}
+
+// tlsAuthData builds the auth config WriteTlsAuth writes for a Role in an Environment.  Principals' addresses are looked up when they bind logins.
+func (km *KeyMaster) tlsAuthData(role *Role, env string, policies []string) (data map[string]interface{}, err error) {
 	hostnames := make([]string, 0)
 	ips := make([]string, 0)
 
-	if km.TlsAuthCaCert == "" {
-		err = errors.New("Cannot configure TLS Auth without a CA certificate.  call SetTlsAuthCaCert(cert) on keymaster object.")
-		return err
+	caCert := km.TlsAuthCaCertFor(env)
+	if caCert == "" {
+		err = errors.New("Cannot configure TLS Auth without a CA certificate.  call SetTlsAuthCaCert(cert) on keymaster object, or set tls_auth.ca_cert in the keymaster config.")
+		return data, err
 	}
 
+	// each principal's addresses bind logins.  If the environment has cidrs, the addresses have to be in them.
+	envCidrs := km.EnvironmentCidrs(env)
+
 	for _, realm := range role.Realms {
 		if realm.Type == "tls" {
 			for _, hostname := range realm.Principals {
@@ -151,10 +160,15 @@ func (km *KeyMaster) WriteTlsAuth(role *Role, env string, policies []string) (er
 					addrs, err := net.LookupIP(hostname)
 					if err != nil {
 						err = errors.Wrapf(err, "failed to look up ip addresses for %s", hostname)
-						return err
+						return data, err
 					}
 
 					for _, ip := range addrs {
+						if len(envCidrs) > 0 && !cidrsContain(envCidrs, ip.String()) {
+							err = errors.New(fmt.Sprintf("%s: %s is %s, not in %s", ERR_ADDRESS_OUTSIDE_ENVIRONMENT, hostname, ip, env))
+							return data, err
+						}
+
 						ips = append(ips, ip.String())
 					}
 				}
@@ -162,12 +176,12 @@ func (km *KeyMaster) WriteTlsAuth(role *Role, env string, policies []string) (er
 		}
 	}
 
-	data := make(map[string]interface{})
+	data = make(map[string]interface{})
 	data["allowed_common_names"] = strings.Join(hostnames, ",")
 	data["bound_cidrs"] = strings.Join(ips, ",")
 	data["policies"] = policies
 	data["display_name"] = fmt.Sprintf("%s-%s-%s", role.Team, role.Name, env)
-	data["certificate"] = km.TlsAuthCaCert
+	data["certificate"] = caCert
 	// these appear to need to be set to empty lists
 	data["allowed_dns_sans"] = []string{}
 	data["allowed_email_sans"] = []string{}
@@ -176,19 +190,7 @@ func (km *KeyMaster) WriteTlsAuth(role *Role, env string, policies []string) (er
 	data["allowed_uri_sans"] = []string{}
 	data["required_extensions"] = []string{}
 
-	path, err := km.TlsAuthPath(role, env)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to create tls auth path")
-		return err
-	}
-
-	_, err = km.VaultClient.Logical().Write(path, data)
-	if err != nil {
-		err = errors.Wrapf(err, "failed to write to %s", path)
-		return err
-	}
-
-	return err
+	return data, err
 }
 
 /*
@@ -0,0 +1,179 @@
+/*
+	These functions define how TLS Secrets are stored in Vault.
+
+	TLS Secrets live under 'certs/' in the Team's secret path, e.g. 'team1/data/certs/foo.scribd.com/production', rather than alongside single valued Secrets.  Each part of the certificate is stored in its own field, named after the file it becomes when the Secret is rendered:
+
+		crt         the certificate
+		key         the private key
+		ca          the issuing CA
+		chain       the CA chain, as concatenated PEM blocks
+		serial      the serial number
+		type        the type of the private key
+		expiration  when the certificate expires, in seconds since the epoch
+
+	Earlier versions of keymaster wrote TLS Secrets to the plain secret path, with the fields named as Vault's PKI engine returns them ('certificate', 'private_key', and so on).  MigrateSecret moves them into the layout above.
+
+*/
+package keymaster
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const TLS_FIELD_CRT = "crt"
+const TLS_FIELD_KEY = "key"
+const TLS_FIELD_CA = "ca"
+const TLS_FIELD_CHAIN = "chain"
+const TLS_FIELD_SERIAL = "serial"
+const TLS_FIELD_TYPE = "type"
+const TLS_FIELD_EXPIRATION = "expiration"
+
+// the field that marks data written in the layout used before TLS Secrets moved to their own path
+const legacyTlsField = "certificate"
+
+// IsTls returns true if the Secret is a TLS certificate.
+func (s *Secret) IsTls() bool {
+	return s.GeneratorData["type"] == "tls"
+}
+
+// CertLocation Given a Name, Team, and Environment, returns where in Vault that TLS Secret is stored.
+func (km *KeyMaster) CertLocation(team string, name string, env string) (location SecretLocation, err error) {
+	if team == "" {
+		err = errors.New("cannot make cert secret path for nameless team")
+		return location, err
+	}
+
+	location, err = km.SecretLocation(team, name, env)
+	if err != nil {
+		return location, err
+	}
+
+	location.Path = fmt.Sprintf("certs/%s", location.Path)
+
+	return location, err
+}
+
+// SecretLocationFor returns where in Vault a Secret is stored in an Environment, which depends on its type.
+func (km *KeyMaster) SecretLocationFor(secret *Secret, env string) (location SecretLocation, err error) {
+	if secret.IsTls() {
+		return km.CertLocation(secret.Team, secret.Name, env)
+	}
+
+	return km.SecretLocation(secret.Team, secret.Name, env)
+}
+
+// TlsSecretData returns the data to store for a certificate.
+func TlsSecretData(cert VaultCert) (data map[string]interface{}) {
+	data = map[string]interface{}{
+		TLS_FIELD_CRT:        cert.Cert,
+		TLS_FIELD_KEY:        cert.Key,
+		TLS_FIELD_CA:         cert.CA,
+		TLS_FIELD_CHAIN:      strings.Join(cert.Chain, "\n"),
+		TLS_FIELD_SERIAL:     cert.Serial,
+		TLS_FIELD_TYPE:       cert.Type,
+		TLS_FIELD_EXPIRATION: cert.Expiration,
+	}
+
+	return data
+}
+
+// TlsCertFromData reads a certificate back out of stored data.  Data in the legacy layout is understood too.  Cert will be nil if the data doesn't hold a certificate.
+func TlsCertFromData(data map[string]interface{}) (cert *VaultCert, err error) {
+	if IsLegacyTlsData(data) {
+		// the legacy fields are named as vault returns them, so a round trip through json takes care of them
+		jsonBytes, err := json.Marshal(data)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to marshal tls data")
+			return cert, err
+		}
+
+		cert = &VaultCert{}
+
+		err = json.Unmarshal(jsonBytes, cert)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to unmarshal tls data")
+			return cert, err
+		}
+
+		return cert, err
+	}
+
+	_, ok := data[TLS_FIELD_CRT]
+	if !ok {
+		return cert, err
+	}
+
+	cert = &VaultCert{
+		Cert:   tlsField(data, TLS_FIELD_CRT),
+		Key:    tlsField(data, TLS_FIELD_KEY),
+		CA:     tlsField(data, TLS_FIELD_CA),
+		Chain:  splitPemBlocks(tlsField(data, TLS_FIELD_CHAIN)),
+		Serial: tlsField(data, TLS_FIELD_SERIAL),
+		Type:   tlsField(data, TLS_FIELD_TYPE),
+	}
+
+	raw, ok := data[TLS_FIELD_EXPIRATION]
+	if ok && raw != nil {
+		cert.Expiration, err = vaultInt(raw)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse certificate expiration")
+			return cert, err
+		}
+	}
+
+	return cert, err
+}
+
+// IsLegacyTlsData returns true if the data is a certificate stored in the layout used before TLS Secrets moved to their own path.
+func IsLegacyTlsData(data map[string]interface{}) bool {
+	_, ok := data[legacyTlsField]
+	return ok
+}
+
+// ConvertLegacyTlsData converts a certificate stored in the legacy layout into the current one.  Anything that isn't part of the certificate, such as the generator data, is kept.
+func ConvertLegacyTlsData(data map[string]interface{}) (converted map[string]interface{}, err error) {
+	cert, err := TlsCertFromData(data)
+	if err != nil {
+		return converted, err
+	}
+
+	converted = TlsSecretData(*cert)
+
+	encoded, ok := data["generator_data"]
+	if ok {
+		converted["generator_data"] = encoded
+	}
+
+	return converted, err
+}
+
+func tlsField(data map[string]interface{}, field string) (value string) {
+	raw, ok := data[field]
+	if ok && raw != nil {
+		value = fmt.Sprintf("%v", raw)
+	}
+
+	return value
+}
+
+// splitPemBlocks splits concatenated PEM blocks, keeping each block as it was written.
+func splitPemBlocks(input string) (blocks []string) {
+	blocks = make([]string, 0)
+	rest := []byte(input)
+
+	for {
+		block, remainder := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		blocks = append(blocks, strings.TrimSpace(string(rest[:len(rest)-len(remainder)])))
+		rest = remainder
+	}
+
+	return blocks
+}
@@ -0,0 +1,407 @@
+package keymaster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTlsSecretData(t *testing.T) {
+	cert := VaultCert{
+		Cert:       "CERT",
+		Key:        "KEY",
+		CA:         "CA",
+		Chain:      []string{testPemBlock, testPemBlock},
+		Serial:     "01:02",
+		Type:       "rsa",
+		Expiration: 1234567890,
+	}
+
+	data := TlsSecretData(cert)
+
+	expected := map[string]interface{}{
+		TLS_FIELD_CRT:        "CERT",
+		TLS_FIELD_KEY:        "KEY",
+		TLS_FIELD_CA:         "CA",
+		TLS_FIELD_CHAIN:      testPemBlock + "\n" + testPemBlock,
+		TLS_FIELD_SERIAL:     "01:02",
+		TLS_FIELD_TYPE:       "rsa",
+		TLS_FIELD_EXPIRATION: 1234567890,
+	}
+
+	assert.Equal(t, expected, data, "stored fields meet expectations")
+
+	// and back again
+	parsed, err := TlsCertFromData(data)
+	if err != nil {
+		log.Printf("error reading cert: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.True(t, reflect.DeepEqual(cert, *parsed), "cert round trips")
+}
+
+func TestTlsCertFromData(t *testing.T) {
+	inputs := []struct {
+		name string
+		data map[string]interface{}
+		cert *VaultCert
+	}{
+		{
+			"current",
+			map[string]interface{}{
+				"crt":        "CERT",
+				"key":        "KEY",
+				"chain":      testPemBlock,
+				"expiration": "1234567890",
+			},
+			&VaultCert{Cert: "CERT", Key: "KEY", Chain: []string{testPemBlock}, Expiration: 1234567890},
+		},
+		{
+			"legacy",
+			map[string]interface{}{
+				"certificate": "CERT",
+				"private_key": "KEY",
+				"ca_chain":    []interface{}{testPemBlock},
+				"expiration":  1234567890,
+			},
+			&VaultCert{Cert: "CERT", Key: "KEY", Chain: []string{testPemBlock}, Expiration: 1234567890},
+		},
+		{
+			"not-a-cert",
+			map[string]interface{}{
+				"value": "s3kr1t",
+			},
+			nil,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			cert, err := TlsCertFromData(tc.data)
+			if err != nil {
+				log.Printf("error reading cert: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.cert, cert, "cert meets expectations")
+		})
+	}
+}
+
+func TestConvertLegacyTlsData(t *testing.T) {
+	legacy := map[string]interface{}{
+		"certificate":      "CERT",
+		"private_key":      "KEY",
+		"issuing_ca":       "CA",
+		"serial_number":    "01:02",
+		"private_key_type": "rsa",
+		"ca_chain":         []interface{}{testPemBlock},
+		"expiration":       1234567890,
+		"generator_data":   "eyJ0eXBlIjoidGxzIn0=",
+	}
+
+	converted, err := ConvertLegacyTlsData(legacy)
+	if err != nil {
+		log.Printf("error converting data: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := map[string]interface{}{
+		TLS_FIELD_CRT:        "CERT",
+		TLS_FIELD_KEY:        "KEY",
+		TLS_FIELD_CA:         "CA",
+		TLS_FIELD_CHAIN:      testPemBlock,
+		TLS_FIELD_SERIAL:     "01:02",
+		TLS_FIELD_TYPE:       "rsa",
+		TLS_FIELD_EXPIRATION: 1234567890,
+		"generator_data":     "eyJ0eXBlIjoidGxzIn0=",
+	}
+
+	assert.Equal(t, expected, converted, "converted data meets expectations")
+	assert.False(t, IsLegacyTlsData(converted), "converted data is not legacy")
+}
+
+func TestSecretLocationFor(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	inputs := []struct {
+		name   string
+		secret *Secret
+		out    string
+	}{
+		{
+			"tls",
+			&Secret{Name: "foo.scribd.com", Team: "team1", GeneratorData: GeneratorData{"type": "tls"}},
+			"team1/data/certs/foo.scribd.com/production",
+		},
+		{
+			"alpha",
+			&Secret{Name: "foo", Team: "team1", GeneratorData: GeneratorData{"type": "alpha"}},
+			"team1/data/foo/production",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			location, err := km.SecretLocationFor(tc.secret, "production")
+			if err != nil {
+				log.Printf("error creating location: %s", err)
+				t.Fail()
+				return
+			}
+
+			assert.Equal(t, tc.out, location.DataPath(), "location meets expectations")
+		})
+	}
+}
+
+func TestTlsSecretInPolicy(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	teamData := `---
+name: team1
+secrets:
+  - name: foo.scribd.com
+    generator:
+      type: tls
+      cn: foo.scribd.com
+  - name: bar
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: app1
+    realms:
+      - type: k8s
+        identifiers:
+          - bravo
+        principals:
+          - app1
+        environment: production
+    secrets:
+      - name: foo.scribd.com
+      - name: bar
+      - name: baz.scribd.com
+        team: team2
+        generator:
+          type: tls
+environments:
+  - production
+`
+
+	team, err := km.NewTeam([]byte(teamData), true)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	policy, err := km.MakePolicyPayload(team.Roles[0], "production")
+	if err != nil {
+		log.Printf("Error creating policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	paths := make([]string, 0)
+	for path := range policy["path"].(map[string]interface{}) {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	expected := []string{
+		"sys/policy/team1-app1-production",
+		"team1/data/bar/production",
+		"team1/data/certs/foo.scribd.com/production",
+		"team1/metadata/bar/production",
+		"team1/metadata/certs/foo.scribd.com/production",
+		"team2/data/certs/baz.scribd.com/production",
+		"team2/metadata/certs/baz.scribd.com/production",
+	}
+
+	assert.Equal(t, expected, paths, "policy reads the cert paths of tls secrets")
+}
+
+func TestOtherTeamTlsSecretInPolicy(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+	km.SetK8sClusters([]*Cluster{{Name: "alpha"}})
+
+	// configured on its own, the team can't know bar.scribd.com in team2 is a certificate
+	teamData := `---
+name: team4
+secrets:
+  - name: baz
+    generator:
+      type: alpha
+      length: 8
+roles:
+  - name: cert-reader
+    realms:
+      - type: k8s
+        identifiers:
+          - alpha
+        principals:
+          - cert-reader
+        environment: production
+    secrets:
+      - name: baz
+      - name: bar.scribd.com
+        team: team2
+environments:
+  - production
+`
+
+	team, err := km.NewTeam([]byte(teamData), false)
+	if err != nil {
+		log.Printf("Error creating team: %s", err)
+		t.Fail()
+		return
+	}
+
+	_, err = km.ConfigureTeam(team, false)
+	if err != nil {
+		log.Printf("Error configuring team: %s", err)
+		t.Fail()
+		return
+	}
+
+	defer func() {
+		_ = km.DeleteK8sAuth(km.K8sClustersByName["alpha"], team.RolesMap["cert-reader"])
+		_ = km.DeletePolicyFromVault("sys/policy/team4-cert-reader-production")
+	}()
+
+	policy, err := km.ReadPolicyFromVault("sys/policy/team4-cert-reader-production")
+	if err != nil {
+		log.Printf("Error reading policy: %s", err)
+		t.Fail()
+		return
+	}
+
+	paths := policy.Payload["path"].(map[string]interface{})
+
+	for _, path := range []string{
+		"team2/data/certs/bar.scribd.com/production",
+		"team2/metadata/certs/bar.scribd.com/production",
+		"team2/data/bar.scribd.com/production",
+		"team4/data/baz/production",
+	} {
+		_, ok := paths[path]
+		assert.True(t, ok, "policy reads %s", path)
+	}
+
+	_, ok := paths["team4/data/certs/baz/production"]
+	assert.False(t, ok, "the team's own secrets are only read where they are")
+}
+
+func TestMigrateLegacyTlsSecret(t *testing.T) {
+	km := NewKeyMaster(kmClient)
+
+	secret := &Secret{
+		Name: "legacy.scribd.com",
+		Team: "secret-team4",
+		GeneratorData: GeneratorData{
+			"type": "tls",
+			"cn":   "legacy.scribd.com",
+		},
+		Environments: []string{"production", "development"},
+	}
+
+	// production was written in the legacy layout.  Development never was.
+	legacyLocation, err := km.SecretLocation(secret.Team, secret.Name, "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	err = km.WriteSecretData(legacyLocation, map[string]interface{}{
+		"certificate":      "CERT",
+		"private_key":      "KEY",
+		"issuing_ca":       "CA",
+		"serial_number":    "01:02",
+		"private_key_type": "rsa",
+		"ca_chain":         []string{testPemBlock},
+		"expiration":       1234567890,
+	})
+	if err != nil {
+		log.Printf("Failed to write secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	stale, err := km.MigrateSecret(secret, true)
+	if err != nil {
+		log.Printf("Failed to migrate secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"secret-team4/data/legacy.scribd.com/production"}, stale, "legacy path is flagged for cleanup")
+
+	location, err := km.CertLocation(secret.Team, secret.Name, "production")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	data, err := km.ReadSecretData(location)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "CERT", data[TLS_FIELD_CRT], "certificate was migrated")
+	assert.Equal(t, "KEY", data[TLS_FIELD_KEY], "key was migrated")
+	assert.Equal(t, testPemBlock, data[TLS_FIELD_CHAIN], "chain was migrated")
+	assert.False(t, IsLegacyTlsData(data), "migrated data is in the current layout")
+
+	value, err := km.ReadSecretValue(secret.Team, secret.Name, "production")
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	if value == nil || value.Tls == nil {
+		log.Printf("No tls secret read back")
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, "CERT", value.Tls.Cert, "migrated secret reads back")
+
+	development, err := km.CertLocation(secret.Team, secret.Name, "development")
+	if err != nil {
+		log.Printf("error creating location: %s", err)
+		t.Fail()
+		return
+	}
+
+	data, err = km.ReadSecretData(development)
+	if err != nil {
+		log.Printf("Failed to read secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.True(t, data == nil, "nothing to migrate in development")
+
+	// running again changes nothing
+	stale, err = km.MigrateSecret(secret, true)
+	if err != nil {
+		log.Printf("Failed to migrate secret: %s", err)
+		t.Fail()
+		return
+	}
+
+	assert.Equal(t, []string{"secret-team4/data/legacy.scribd.com/production"}, stale, "legacy path is still flagged for cleanup")
+}
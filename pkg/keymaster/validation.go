@@ -0,0 +1,225 @@
+/*
+	These functions check the values of Static Secrets against rules declared in the Team yaml.
+
+	Static Secrets are entered by hand, so nothing stops a bucket from sitting empty, or holding something malformed, until an application trips over it.  A validation rule describes what a good value looks like:
+
+	- name: payment-provider-cert
+	  generator:
+	    type: static
+	  validation:
+	    non_empty: true
+	    format: pem-certificate
+
+	- name: payment-provider-config
+	  generator:
+	    type: static
+	  validation:
+	    json_keys:
+	      - client_id
+	      - client_secret
+
+	- name: payment-provider-pin
+	  generator:
+	    type: static
+	  validation:
+	    regex: ^[0-9]+$
+	    min_length: 4
+	    max_length: 8
+
+	Every rule that's set must pass.  Empty values only break non_empty, as every bucket starts out empty.  Rules are checked against the current value in every environment of the Secret, and violations don't stop a Team being configured, as fixing them takes a human.  ConfigureTeam() returns them as a ValidationViolations error at the end, which callers can report, or ignore.  Values seeded from a static secrets file are checked before they're written, and are refused if they break the rule.
+
+*/
+package keymaster
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const ERR_VALIDATION_NOT_STATIC = "validation rules can only be set on static secrets"
+const ERR_BAD_VALIDATION_REGEX = "bad validation regex"
+const ERR_BAD_VALIDATION_LENGTH = "validation lengths must be positive, and min_length cannot exceed max_length"
+const ERR_UNKNOWN_VALIDATION_FORMAT = "unknown validation format"
+const ERR_STATIC_VALUE_INVALID = "static secret value fails validation"
+
+const VALIDATION_FORMAT_PEM_CERTIFICATE = "pem-certificate"
+const VALIDATION_FORMAT_JSON = "json"
+
+// ValidationRule What a good value for a Static Secret looks like.  Unset fields are not checked.
+type ValidationRule struct {
+	NonEmpty  bool     `yaml:"non_empty"`
+	Regex     string   `yaml:"regex"`
+	MinLength int      `yaml:"min_length"`
+	MaxLength int      `yaml:"max_length"`
+	Format    string   `yaml:"format"`    // pem-certificate or json
+	JsonKeys  []string `yaml:"json_keys"` // implies a format of json
+}
+
+// ValidationViolation A Static Secret value that breaks its validation rule.
+type ValidationViolation struct {
+	Team     string
+	Name     string
+	Env      string
+	Path     string
+	Problems []string
+}
+
+// String renders the violation for humans.
+func (v ValidationViolation) String() string {
+	return fmt.Sprintf("secret %s in team %s env %s (%s): %s", v.Name, v.Team, v.Env, v.Path, strings.Join(v.Problems, ", "))
+}
+
+// ValidationViolations Static Secret values that break their validation rules.  ConfigureTeam() returns them as its error once everything else is configured, so the caller can decide whether they matter.
+type ValidationViolations []ValidationViolation
+
+func (v ValidationViolations) Error() string {
+	violations := make([]string, 0)
+	for _, violation := range v {
+		violations = append(violations, violation.String())
+	}
+
+	return fmt.Sprintf("%s: %s", ERR_STATIC_VALUE_INVALID, strings.Join(violations, "; "))
+}
+
+// Validate checks the rule itself makes sense.
+func (r *ValidationRule) Validate() (err error) {
+	if r.Regex != "" {
+		_, err = regexp.Compile(r.Regex)
+		if err != nil {
+			err = errors.Wrap(err, ERR_BAD_VALIDATION_REGEX)
+			return err
+		}
+	}
+
+	if r.MinLength < 0 || r.MaxLength < 0 || (r.MaxLength > 0 && r.MinLength > r.MaxLength) {
+		err = errors.New(ERR_BAD_VALIDATION_LENGTH)
+		return err
+	}
+
+	switch r.Format {
+	case "", VALIDATION_FORMAT_PEM_CERTIFICATE, VALIDATION_FORMAT_JSON:
+	default:
+		err = errors.New(fmt.Sprintf("%s: %s", ERR_UNKNOWN_VALIDATION_FORMAT, r.Format))
+		return err
+	}
+
+	return err
+}
+
+// Check returns a description of each way in which the value breaks the rule.  No problems means the value is good.
+func (r *ValidationRule) Check(value string) (problems []string) {
+	// a bucket that's never been filled in is empty.  Only non_empty says whether that's a problem.
+	if value == "" {
+		if r.NonEmpty {
+			problems = append(problems, "value is empty")
+		}
+
+		return problems
+	}
+
+	// lengths are in characters, not bytes
+	length := utf8.RuneCountInString(value)
+
+	if r.MinLength > 0 && length < r.MinLength {
+		problems = append(problems, fmt.Sprintf("value is shorter than %d characters", r.MinLength))
+	}
+
+	if r.MaxLength > 0 && length > r.MaxLength {
+		problems = append(problems, fmt.Sprintf("value is longer than %d characters", r.MaxLength))
+	}
+
+	if r.Regex != "" {
+		matched, err := regexp.MatchString(r.Regex, value)
+		if err != nil || !matched {
+			problems = append(problems, fmt.Sprintf("value does not match %s", r.Regex))
+		}
+	}
+
+	if r.Format == VALIDATION_FORMAT_PEM_CERTIFICATE {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil || block.Type != "CERTIFICATE" {
+			problems = append(problems, "value is not a PEM certificate")
+		}
+	}
+
+	if r.Format == VALIDATION_FORMAT_JSON || len(r.JsonKeys) > 0 {
+		var parsed map[string]interface{}
+
+		err := json.Unmarshal([]byte(value), &parsed)
+		if err != nil {
+			problems = append(problems, "value is not a JSON object")
+			return problems
+		}
+
+		for _, key := range r.JsonKeys {
+			if _, ok := parsed[key]; !ok {
+				problems = append(problems, fmt.Sprintf("value is missing JSON key %s", key))
+			}
+		}
+	}
+
+	return problems
+}
+
+// ValidateStaticSecret checks the current value of a Static Secret in each of its environments against its validation rule.
+func (km *KeyMaster) ValidateStaticSecret(secret *Secret, verbose bool) (violations []ValidationViolation, err error) {
+	if secret.Validation == nil {
+		return violations, err
+	}
+
+	verboseOutput(verbose, "validating secret %s", secret.Name)
+	for _, env := range secret.Environments {
+		location, err := km.SecretLocation(secret.Team, secret.Name, env)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create secret path")
+			return violations, err
+		}
+
+		data, err := km.ReadSecretData(location)
+		if err != nil {
+			return violations, err
+		}
+
+		// missing secrets, and values that aren't strings, are checked as empty
+		value, _ := data["value"].(string)
+
+		problems := secret.Validation.Check(value)
+		if len(problems) == 0 {
+			verboseOutput(verbose, "  env %s is valid", env)
+			continue
+		}
+
+		violation := ValidationViolation{
+			Team:     secret.Team,
+			Name:     secret.Name,
+			Env:      env,
+			Path:     location.DataPath(),
+			Problems: problems,
+		}
+
+		verboseOutput(verbose, "  %s", violation)
+		violations = append(violations, violation)
+	}
+
+	return violations, err
+}
+
+// ValidateStaticSecrets checks every Static Secret of a Team that declares a validation rule.
+func (km *KeyMaster) ValidateStaticSecrets(team *Team, verbose bool) (violations []ValidationViolation, err error) {
+	for _, secret := range team.Secrets {
+		secretViolations, err := km.ValidateStaticSecret(secret, verbose)
+		if err != nil {
+			err = errors.Wrapf(err, "failed validating secret %s for team %s", secret.Name, secret.Team)
+			return violations, err
+		}
+
+		violations = append(violations, secretViolations...)
+	}
+
+	return violations, err
+}